@@ -2,17 +2,34 @@ package cal
 
 import (
 	"errors"
+	"sync"
 
 	"github.com/zenpk/chatbone/dal"
 	"github.com/zenpk/chatbone/util"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
+// IUser changes the balance only along with a ledger entry, the entry's amount is the signed change
+type IUser interface {
+	SelectByIdInsertIfNotExists(id string) (*dal.User, error)
+	ReduceBalance(entry *dal.Ledger) error
+	AdjustBalance(entry *dal.Ledger) error
+	SettleBalance(release, charge *dal.Ledger) error
+	ReconcileBalance(id string, expected, balance int64) error
+	UpdateClipboard(id, clipboard string) error
+}
+
+var _ IUser = (*User)(nil)
+
 type User struct {
 	*dal.User
 
 	conf   *util.Configuration
 	logger util.ILogger
+	ledger *dal.Ledger
+	mutex  *sync.RWMutex        // for the cached map, users and opened
 	cached map[string]*dal.User // id -> User
+	opened map[string]bool      // id -> the ledger is known to have the opening entry
 	err    error
 }
 
@@ -22,8 +39,11 @@ func newUser(conf *util.Configuration, logger util.ILogger, db *dal.Database) (*
 	u.User = db.User
 	u.conf = conf
 	u.logger = logger
+	u.ledger = db.Ledger
 	u.err = errors.New("at User cache")
+	u.mutex = new(sync.RWMutex)
 	u.cached = make(map[string]*dal.User)
+	u.opened = make(map[string]bool)
 	cached, err := db.User.SelectAll()
 	if err != nil {
 		return nil, errors.Join(err, u.err)
@@ -37,47 +57,225 @@ func newUser(conf *util.Configuration, logger util.ILogger, db *dal.Database) (*
 	return u, nil
 }
 
+// SelectByIdInsertIfNotExists returns a copy of the cached user, the cached one is only changed under the lock,
+// the initial balance of a new user is recorded as a grant, which is the opening entry of the ledger
 func (u *User) SelectByIdInsertIfNotExists(uuid string) (*dal.User, error) {
 	// cache first
-	if user, ok := u.cached[uuid]; ok {
-		return user, nil
+	u.mutex.RLock()
+	user, ok := u.cached[uuid]
+	if ok {
+		copied := *user
+		u.mutex.RUnlock()
+		return &copied, nil
 	}
-	user, err := u.User.SelectByIdInsertIfNotExists(uuid)
+	u.mutex.RUnlock()
+	user, inserted, err := u.User.SelectByIdInsertIfNotExists(uuid)
 	if err != nil {
 		return nil, err
 	}
 	if user == nil || user.Id == "" {
 		return nil, errors.Join(errors.New("found malformed User data"), u.err)
 	}
-	u.cached[user.Id] = user
-	return user, nil
+	if inserted {
+		// if this fails, the opening entry is recorded before the first balance change
+		if err := u.ledger.Insert(&dal.Ledger{
+			UserId:    uuid,
+			Kind:      dal.LedgerKindGrant,
+			Amount:    dal.InitialBalance,
+			Balance:   dal.InitialBalance,
+			Reference: dal.LedgerReferenceOpening,
+			Note:      "initial balance",
+			Timestamp: util.GetTimestamp(),
+		}); err != nil {
+			u.logger.Warnf("record initial balance failed: %v", err)
+		}
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if inserted {
+		u.opened[uuid] = true
+	}
+	// another request might have cached it meanwhile
+	if cached, ok := u.cached[uuid]; ok {
+		user = cached
+	} else {
+		u.cached[uuid] = user
+	}
+	copied := *user
+	return &copied, nil
+}
+
+// ReduceBalance takes the negative amount of the entry only if the balance covers it,
+// it relies on the conditional update of the database, which sees the charges of every instance
+func (u *User) ReduceBalance(entry *dal.Ledger) error {
+	if entry == nil || entry.Amount >= 0 {
+		return errors.Join(errors.New("balance reduce amount must be negative"), u.err)
+	}
+	// ensure the user exists, so a missing document means the balance isn't enough
+	if _, err := u.SelectByIdInsertIfNotExists(entry.UserId); err != nil {
+		return errors.Join(err, u.err)
+	}
+	if err := u.ensureOpening(entry.UserId); err != nil {
+		return errors.Join(err, u.err)
+	}
+	user, err := u.User.ReduceBalance(entry.UserId, -entry.Amount)
+	if err != nil {
+		return errors.Join(err, u.err)
+	}
+	return u.record(user, entry)
 }
 
-func (u *User) ReduceBalance(id string, amount int64) error {
-	user, err := u.selectByIdUpdateCache(id)
+// AdjustBalance adds the signed amount of the entry unconditionally
+func (u *User) AdjustBalance(entry *dal.Ledger) error {
+	if entry == nil || entry.Amount == 0 {
+		return errors.Join(errors.New("balance adjust amount must not be zero"), u.err)
+	}
+	if _, err := u.SelectByIdInsertIfNotExists(entry.UserId); err != nil {
+		return errors.Join(err, u.err)
+	}
+	if err := u.ensureOpening(entry.UserId); err != nil {
+		return errors.Join(err, u.err)
+	}
+	user, err := u.User.AdjustBalance(entry.UserId, entry.Amount)
 	if err != nil {
 		return errors.Join(err, u.err)
 	}
-	if user.Balance < amount {
-		return errors.Join(errors.New("balance is not enough"), u.err)
+	return u.record(user, entry)
+}
+
+// SettleBalance gives back the hold and takes the charge out of it in a single update, so the released part
+// is never available to another request before the charge, the charge must not be more than the hold
+func (u *User) SettleBalance(release, charge *dal.Ledger) error {
+	if release == nil || charge == nil || release.Amount <= 0 || charge.Amount > 0 || release.Amount+charge.Amount < 0 {
+		return errors.Join(errors.New("balance settle amount is invalid"), u.err)
+	}
+	if err := u.ensureOpening(release.UserId); err != nil {
+		return errors.Join(err, u.err)
 	}
-	newUser, err := u.User.ReduceBalance(id, amount)
+	user, err := u.User.AdjustBalance(release.UserId, release.Amount+charge.Amount)
 	if err != nil {
-		return err
+		return errors.Join(err, u.err)
+	}
+	if charge.Amount == 0 {
+		return u.record(user, release)
+	}
+	return u.record(user, release, charge)
+}
+
+// ReconcileBalance sets the balance if it's still the expected one and keeps the cache in sync
+func (u *User) ReconcileBalance(id string, expected, balance int64) error {
+	if err := u.User.ReconcileBalance(id, expected, balance); err != nil {
+		return errors.Join(err, u.err)
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if cached, ok := u.cached[id]; ok {
+		cached.Balance = balance
 	}
-	// update balance using the newUser pointer to avoid race condition
-	user.Balance = newUser.Balance
 	return nil
 }
 
-func (u *User) selectByIdUpdateCache(id string) (*dal.User, error) {
-	user, ok := u.cached[id]
-	if !ok {
-		user, err := u.SelectByIdInsertIfNotExists(id)
+// ensureOpening records the balance as the opening entry before the user's first entry,
+// every balance change goes through here first, so whichever instance records it reads the balance before any change,
+// the others run into the unique index
+func (u *User) ensureOpening(id string) error {
+	u.mutex.RLock()
+	opened := u.opened[id]
+	u.mutex.RUnlock()
+	if opened {
+		return nil
+	}
+	opened, err := u.ledger.HasOpening(id)
+	if err != nil {
+		return err
+	}
+	if !opened {
+		user, _, err := u.User.SelectByIdInsertIfNotExists(id)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if err := u.ledger.Insert(&dal.Ledger{
+			UserId:    id,
+			Kind:      dal.LedgerKindAdjustment,
+			Amount:    user.Balance,
+			Balance:   user.Balance,
+			Reference: dal.LedgerReferenceOpening,
+			Note:      "opening balance",
+			Timestamp: util.GetTimestamp(),
+		}); err != nil && !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.opened[id] = true
+	return nil
+}
+
+// record appends the entries of the balance change that's just made in order,
+// the part of the change that can't be recorded is undone
+func (u *User) record(user *dal.User, entries ...*dal.Ledger) error {
+	// the balance right after each entry, counted back from the last one
+	balance := user.Balance
+	for i := len(entries) - 1; i >= 0; i-- {
+		entries[i].Balance = balance
+		balance -= entries[i].Amount
+	}
+	timestamp := util.GetTimestamp()
+	for i, entry := range entries {
+		entry.Timestamp = timestamp
+		if err := u.ledger.Insert(entry); err != nil {
+			u.undo(user, entries[i:])
+			return errors.Join(err, u.err)
 		}
-		u.cached[id] = user
 	}
-	return user, nil
+	u.updateBalance(user)
+	return nil
+}
+
+// undo takes back the amounts of the entries that couldn't be recorded
+func (u *User) undo(user *dal.User, entries []*dal.Ledger) {
+	amount := int64(0)
+	for _, entry := range entries {
+		amount += entry.Amount
+	}
+	if amount == 0 {
+		u.updateBalance(user)
+		return
+	}
+	undone, err := u.User.AdjustBalance(user.Id, -amount)
+	if err != nil {
+		// the reconciliation will set the balance back to the sum of the ledger
+		u.logger.Warnf("undo balance change failed: %v", err)
+		u.updateBalance(user)
+		return
+	}
+	u.updateBalance(undone)
+}
+
+// updateBalance replaces the cached balance with the one returned by the database
+func (u *User) updateBalance(user *dal.User) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if cached, ok := u.cached[user.Id]; ok {
+		cached.Balance = user.Balance
+	} else {
+		u.cached[user.Id] = user
+	}
+}
+
+// UpdateClipboard keeps the cached user in sync with the database
+func (u *User) UpdateClipboard(id, clipboard string) error {
+	if _, err := u.SelectByIdInsertIfNotExists(id); err != nil {
+		return errors.Join(err, u.err)
+	}
+	if err := u.User.UpdateClipboard(id, clipboard); err != nil {
+		return err
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if cached, ok := u.cached[id]; ok {
+		cached.Clipboard = clipboard
+	}
+	return nil
 }
@@ -0,0 +1,176 @@
+package cal
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/zenpk/chatbone/dal"
+	"github.com/zenpk/chatbone/util"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	testReplicas          = 4
+	testChargesPerReplica = 25
+)
+
+// newTestReplicas connects to the MongoDB in MONGO_URI with a throwaway database,
+// every returned cal.User stands in for an instance with its own cache
+func newTestReplicas(t *testing.T) ([]*User, *dal.Database) {
+	t.Helper()
+	uri := os.Getenv("MONGO_URI")
+	if uri == "" {
+		t.Skip("MONGO_URI is not set")
+	}
+	name, err := util.RandomString(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &util.Configuration{
+		TimeoutSecond: 10,
+		LogFilePath:   filepath.Join(t.TempDir(), "test.log"),
+		MongoDbUri:    uri,
+		MongoDbName:   "chatbone_test_" + name,
+	}
+	logger, err := util.NewLogger(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = logger.Close()
+	})
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = client.Database(conf.MongoDbName).Drop(context.Background())
+		_ = client.Disconnect(context.Background())
+	})
+	db, err := dal.New(conf, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replicas := make([]*User, 0, testReplicas)
+	for i := 0; i < testReplicas; i++ {
+		cache, err := New(conf, logger, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		replicas = append(replicas, cache.User)
+	}
+	return replicas, db
+}
+
+// chargeConcurrently charges the amount from every replica at once and counts the outcomes
+func chargeConcurrently(t *testing.T, replicas []*User, uuid string, amount int64) (int, int) {
+	t.Helper()
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	succeeded, insufficient := 0, 0
+	for _, replica := range replicas {
+		for i := 0; i < testChargesPerReplica; i++ {
+			wg.Add(1)
+			go func(replica *User) {
+				defer wg.Done()
+				err := replica.ReduceBalance(&dal.Ledger{
+					UserId: uuid,
+					Kind:   dal.LedgerKindCharge,
+					Amount: -amount,
+				})
+				mutex.Lock()
+				defer mutex.Unlock()
+				switch {
+				case err == nil:
+					succeeded++
+				case errors.Is(err, dal.ErrInsufficientBalance):
+					insufficient++
+				default:
+					t.Errorf("unexpected charge error: %v", err)
+				}
+			}(replica)
+		}
+	}
+	wg.Wait()
+	return succeeded, insufficient
+}
+
+// checkBalance compares the stored balance with the expected one and the sum of the ledger,
+// no entry may have left the balance below zero
+func checkBalance(t *testing.T, db *dal.Database, uuid string, expected int64) {
+	t.Helper()
+	user, _, err := db.User.SelectByIdInsertIfNotExists(uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Balance != expected {
+		t.Errorf("balance is %v, expected %v", user.Balance, expected)
+	}
+	sum, _, err := db.Ledger.SumByUserId(uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != expected {
+		t.Errorf("ledger sums to %v, expected %v", sum, expected)
+	}
+	page := &dal.Page{Size: dal.PageSizeMax}
+	for {
+		entries, next, err := db.Ledger.SelectByUserId(uuid, page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			if entry.Balance < 0 {
+				t.Errorf("entry %v left the balance at %v", entry.Id.Hex(), entry.Balance)
+			}
+		}
+		if next == "" {
+			break
+		}
+		page.Cursor = next
+	}
+}
+
+func TestReduceBalanceConcurrent(t *testing.T) {
+	replicas, db := newTestReplicas(t)
+	uuid, err := util.RandomString(12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const amount = 7000
+	succeeded, insufficient := chargeConcurrently(t, replicas, uuid, amount)
+	total := testReplicas * testChargesPerReplica
+	if succeeded != total || insufficient != 0 {
+		t.Errorf("%v charges succeeded and %v were rejected, expected all %v to succeed", succeeded, insufficient, total)
+	}
+	checkBalance(t, db, uuid, dal.InitialBalance-int64(total)*amount)
+}
+
+func TestReduceBalanceInsufficient(t *testing.T) {
+	replicas, db := newTestReplicas(t)
+	uuid, err := util.RandomString(12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const amount = 30000
+	covered := int(dal.InitialBalance / amount)
+	succeeded, insufficient := chargeConcurrently(t, replicas, uuid, amount)
+	total := testReplicas * testChargesPerReplica
+	if succeeded != covered || insufficient != total-covered {
+		t.Errorf("%v charges succeeded and %v were rejected, expected %v and %v",
+			succeeded, insufficient, covered, total-covered)
+	}
+	checkBalance(t, db, uuid, dal.InitialBalance-int64(covered)*amount)
+	// once the balance has run out every replica rejects the charge
+	for _, replica := range replicas {
+		err := replica.ReduceBalance(&dal.Ledger{UserId: uuid, Kind: dal.LedgerKindCharge, Amount: -amount})
+		if !errors.Is(err, dal.ErrInsufficientBalance) {
+			t.Errorf("expected ErrInsufficientBalance, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package dal
+
+import (
+	"errors"
+
+	"github.com/zenpk/chatbone/util"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Arena is a single prompt answered side by side by multiple models
+type Arena struct {
+	Id               string `bson:"id" json:"id"`
+	SessionId        string `bson:"sessionId" json:"sessionId"`
+	UserId           string `bson:"userId" json:"-"` // uuid
+	Timestamp        int64  `bson:"timestamp" json:"timestamp"`
+	ModelIds         []int  `bson:"modelIds" json:"modelIds"`
+	Voted            bool   `bson:"voted" json:"voted"`
+	PreferredModelId int    `bson:"preferredModelId" json:"preferredModelId"` // 0 means tie
+	Task             string `bson:"task" json:"task"`                         // e.g. coding, writing
+
+	conf           *util.Configuration
+	logger         util.ILogger
+	client         *mongo.Client
+	collectionName string
+	err            error
+}
+
+// ArenaRank is the aggregated vote result of one model for one task
+type ArenaRank struct {
+	Task    string `bson:"task" json:"task"`
+	ModelId int    `bson:"modelId" json:"modelId"`
+	Battles int    `bson:"battles" json:"battles"`
+	Wins    int    `bson:"wins" json:"wins"`
+	Ties    int    `bson:"ties" json:"ties"`
+}
+
+func newArena(conf *util.Configuration, client *mongo.Client, logger util.ILogger) (*Arena, error) {
+	a := new(Arena)
+	a.conf = conf
+	a.logger = logger
+	a.client = client
+	a.collectionName = "arena"
+	a.err = errors.New("at Arena table")
+	ctx, cancel := util.GetTimeoutContext(a.conf.TimeoutSecond)
+	defer cancel()
+	collection := a.client.Database(a.conf.MongoDbName).Collection(a.collectionName)
+	mod := mongo.IndexModel{
+		Keys: bson.M{"id": "hashed"},
+	}
+	_, err := collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, a.err)
+	}
+	mod = mongo.IndexModel{
+		Keys: bson.D{{Key: "voted", Value: 1}, {Key: "task", Value: 1}},
+	}
+	_, err = collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, a.err)
+	}
+	return a, nil
+}
+
+func (a *Arena) SelectById(id string) (*Arena, error) {
+	collection := a.client.Database(a.conf.MongoDbName).Collection(a.collectionName)
+	filter := bson.M{"id": id}
+	result := new(Arena)
+	ctx, cancel := util.GetTimeoutContext(a.conf.TimeoutSecond)
+	defer cancel()
+	if err := collection.FindOne(ctx, filter).Decode(result); err != nil {
+		return nil, errors.Join(err, a.err)
+	}
+	return result, nil
+}
+
+func (a *Arena) Insert(arena *Arena) error {
+	if arena == nil || arena.Id == "" || arena.UserId == "" || arena.SessionId == "" ||
+		arena.Timestamp <= 0 || len(arena.ModelIds) < 2 {
+		return errors.Join(errors.New("insert invalid input"), a.err)
+	}
+	collection := a.client.Database(a.conf.MongoDbName).Collection(a.collectionName)
+	ctx, cancel := util.GetTimeoutContext(a.conf.TimeoutSecond)
+	defer cancel()
+	if _, err := collection.InsertOne(ctx, arena); err != nil {
+		return errors.Join(err, a.err)
+	}
+	return nil
+}
+
+func (a *Arena) UpdateVote(id string, preferredModelId int, task string) error {
+	collection := a.client.Database(a.conf.MongoDbName).Collection(a.collectionName)
+	filter := bson.M{"id": id}
+	update := bson.M{"$set": bson.M{"voted": true, "preferredModelId": preferredModelId, "task": task}}
+	ctx, cancel := util.GetTimeoutContext(a.conf.TimeoutSecond)
+	defer cancel()
+	if _, err := collection.UpdateOne(ctx, filter, update); err != nil {
+		return errors.Join(err, a.err)
+	}
+	return nil
+}
+
+// SelectRanks aggregates the votes per task and model, an empty task means all tasks
+func (a *Arena) SelectRanks(task string) ([]*ArenaRank, error) {
+	collection := a.client.Database(a.conf.MongoDbName).Collection(a.collectionName)
+	match := bson.M{"voted": true}
+	if task != "" {
+		match["task"] = task
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$unwind", Value: "$modelIds"}},
+		{{Key: "$group", Value: bson.M{
+			"_id":     bson.M{"task": "$task", "modelId": "$modelIds"},
+			"battles": bson.M{"$sum": 1},
+			"wins": bson.M{"$sum": bson.M{
+				"$cond": bson.A{bson.M{"$eq": bson.A{"$preferredModelId", "$modelIds"}}, 1, 0},
+			}},
+			"ties": bson.M{"$sum": bson.M{
+				"$cond": bson.A{bson.M{"$eq": bson.A{"$preferredModelId", 0}}, 1, 0},
+			}},
+		}}},
+		{{Key: "$project", Value: bson.M{
+			"_id":     0,
+			"task":    "$_id.task",
+			"modelId": "$_id.modelId",
+			"battles": 1,
+			"wins":    1,
+			"ties":    1,
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "task", Value: 1}, {Key: "wins", Value: -1}}}},
+	}
+	ctx, cancel := util.GetTimeoutContext(a.conf.TimeoutSecond)
+	defer cancel()
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, errors.Join(err, a.err)
+	}
+	result := make([]*ArenaRank, 0)
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, errors.Join(err, a.err)
+	}
+	return result, nil
+}
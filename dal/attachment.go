@@ -0,0 +1,258 @@
+package dal
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/zenpk/chatbone/util"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	AttachmentKindText  = "text"
+	AttachmentKindImage = "image"
+)
+
+// Attachment is the metadata of an uploaded file, the content is stored in GridFS under the same ID
+type Attachment struct {
+	Id          string   `bson:"id" json:"id"`
+	UserId      string   `bson:"userId" json:"-"` // uuid
+	SessionId   string   `bson:"sessionId" json:"sessionId"`
+	Holders     []string `bson:"holders,omitempty" json:"-"` // the other sessions referencing it, e.g. forks
+	Filename    string   `bson:"filename" json:"filename"`
+	ContentType string   `bson:"contentType" json:"contentType"` // sniffed from the content
+	Kind        string   `bson:"kind" json:"kind"`               // text or image
+	Size        int64    `bson:"size" json:"size"`               // bytes
+	Timestamp   int64    `bson:"timestamp" json:"timestamp"`
+
+	conf           *util.Configuration
+	logger         util.ILogger
+	client         *mongo.Client
+	collectionName string
+	err            error
+}
+
+func newAttachment(conf *util.Configuration, client *mongo.Client, logger util.ILogger) (*Attachment, error) {
+	a := new(Attachment)
+	a.conf = conf
+	a.logger = logger
+	a.client = client
+	a.collectionName = "attachment"
+	a.err = errors.New("at Attachment table")
+	ctx, cancel := util.GetTimeoutContext(a.conf.TimeoutSecond)
+	defer cancel()
+	collection := a.client.Database(a.conf.MongoDbName).Collection(a.collectionName)
+	mod := mongo.IndexModel{
+		Keys: bson.M{"id": "hashed"},
+	}
+	_, err := collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, a.err)
+	}
+	mod = mongo.IndexModel{
+		Keys: bson.D{{Key: "userId", Value: 1}, {Key: "sessionId", Value: 1}},
+	}
+	_, err = collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, a.err)
+	}
+	mod = mongo.IndexModel{
+		Keys: bson.D{{Key: "holders", Value: 1}},
+	}
+	_, err = collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, a.err)
+	}
+	return a, nil
+}
+
+func (a *Attachment) SelectById(id string) (*Attachment, error) {
+	collection := a.client.Database(a.conf.MongoDbName).Collection(a.collectionName)
+	filter := bson.M{"id": id}
+	result := new(Attachment)
+	ctx, cancel := util.GetTimeoutContext(a.conf.TimeoutSecond)
+	defer cancel()
+	if err := collection.FindOne(ctx, filter).Decode(result); err != nil {
+		return nil, errors.Join(err, a.err)
+	}
+	return result, nil
+}
+
+// SelectBySessionId returns the user's attachments referenced by the session, including the ones it holds
+func (a *Attachment) SelectBySessionId(sessionId, userId string) ([]*Attachment, error) {
+	collection := a.client.Database(a.conf.MongoDbName).Collection(a.collectionName)
+	filter := bson.M{"userId": userId, "$or": bson.A{bson.M{"sessionId": sessionId}, bson.M{"holders": sessionId}}}
+	ctx, cancel := util.GetTimeoutContext(a.conf.TimeoutSecond)
+	defer cancel()
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}})
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.Join(err, a.err)
+	}
+	result := make([]*Attachment, 0)
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, errors.Join(err, a.err)
+	}
+	return result, nil
+}
+
+// SumSizeByUserId returns the total bytes the user has uploaded
+func (a *Attachment) SumSizeByUserId(userId string) (int64, error) {
+	collection := a.client.Database(a.conf.MongoDbName).Collection(a.collectionName)
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"userId": userId}}},
+		{{Key: "$group", Value: bson.M{"_id": nil, "size": bson.M{"$sum": "$size"}}}},
+	}
+	ctx, cancel := util.GetTimeoutContext(a.conf.TimeoutSecond)
+	defer cancel()
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, errors.Join(err, a.err)
+	}
+	result := make([]struct {
+		Size int64 `bson:"size"`
+	}, 0)
+	if err := cursor.All(ctx, &result); err != nil {
+		return 0, errors.Join(err, a.err)
+	}
+	if len(result) == 0 {
+		return 0, nil
+	}
+	return result[0].Size, nil
+}
+
+// Insert uploads the content into GridFS and then inserts the metadata
+func (a *Attachment) Insert(attachment *Attachment, source io.Reader) error {
+	if attachment == nil || attachment.Id == "" || attachment.UserId == "" || attachment.SessionId == "" ||
+		attachment.Kind == "" || attachment.Timestamp <= 0 || source == nil {
+		return errors.Join(errors.New("insert invalid input"), a.err)
+	}
+	bucket, err := a.bucket()
+	if err != nil {
+		return errors.Join(err, a.err)
+	}
+	if err := bucket.SetWriteDeadline(a.deadline()); err != nil {
+		return errors.Join(err, a.err)
+	}
+	if err := bucket.UploadFromStreamWithID(attachment.Id, attachment.Filename, source); err != nil {
+		return errors.Join(err, a.err)
+	}
+	collection := a.client.Database(a.conf.MongoDbName).Collection(a.collectionName)
+	ctx, cancel := util.GetTimeoutContext(a.conf.TimeoutSecond)
+	defer cancel()
+	if _, err := collection.InsertOne(ctx, attachment); err != nil {
+		// don't leave the content behind without the metadata
+		return errors.Join(err, a.deleteFile(attachment.Id), a.err)
+	}
+	return nil
+}
+
+// Open returns a reader of the content, the caller should close it
+func (a *Attachment) Open(id string) (io.ReadCloser, error) {
+	bucket, err := a.bucket()
+	if err != nil {
+		return nil, errors.Join(err, a.err)
+	}
+	if err := bucket.SetReadDeadline(a.deadline()); err != nil {
+		return nil, errors.Join(err, a.err)
+	}
+	stream, err := bucket.OpenDownloadStream(id)
+	if err != nil {
+		return nil, errors.Join(err, a.err)
+	}
+	return stream, nil
+}
+
+func (a *Attachment) DeleteById(id string) error {
+	if err := a.deleteFile(id); err != nil {
+		return errors.Join(err, a.err)
+	}
+	collection := a.client.Database(a.conf.MongoDbName).Collection(a.collectionName)
+	filter := bson.M{"id": id}
+	ctx, cancel := util.GetTimeoutContext(a.conf.TimeoutSecond)
+	defer cancel()
+	if _, err := collection.DeleteOne(ctx, filter); err != nil {
+		return errors.Join(err, a.err)
+	}
+	return nil
+}
+
+// AddHolder records that the session references the user's attachments as well
+func (a *Attachment) AddHolder(ids []string, userId, sessionId string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	collection := a.client.Database(a.conf.MongoDbName).Collection(a.collectionName)
+	filter := bson.M{"id": bson.M{"$in": ids}, "userId": userId, "sessionId": bson.M{"$ne": sessionId}}
+	update := bson.M{"$addToSet": bson.M{"holders": sessionId}}
+	ctx, cancel := util.GetTimeoutContext(a.conf.TimeoutSecond)
+	defer cancel()
+	if _, err := collection.UpdateMany(ctx, filter, update); err != nil {
+		return errors.Join(err, a.err)
+	}
+	return nil
+}
+
+// ReleaseBySessionId drops the session's references to the attachments,
+// an attachment of the session still referenced by another session is handed over to that one,
+// the rest are removed with their content
+func (a *Attachment) ReleaseBySessionId(sessionId string) error {
+	collection := a.client.Database(a.conf.MongoDbName).Collection(a.collectionName)
+	ctx, cancel := util.GetTimeoutContext(a.conf.TimeoutSecond)
+	defer cancel()
+	filter := bson.M{"holders": sessionId}
+	if _, err := collection.UpdateMany(ctx, filter, bson.M{"$pull": bson.M{"holders": sessionId}}); err != nil {
+		return errors.Join(err, a.err)
+	}
+	filter = bson.M{"sessionId": sessionId}
+	cursor, err := collection.Find(ctx, filter, options.Find().SetProjection(bson.M{"id": 1, "holders": 1}))
+	if err != nil {
+		return errors.Join(err, a.err)
+	}
+	attachments := make([]*Attachment, 0)
+	if err := cursor.All(ctx, &attachments); err != nil {
+		return errors.Join(err, a.err)
+	}
+	for _, attachment := range attachments {
+		if len(attachment.Holders) == 0 {
+			if err := a.DeleteById(attachment.Id); err != nil {
+				return err
+			}
+			continue
+		}
+		holder := attachment.Holders[0]
+		update := bson.M{"$set": bson.M{"sessionId": holder}, "$pull": bson.M{"holders": holder}}
+		if _, err := collection.UpdateOne(ctx, bson.M{"id": attachment.Id}, update); err != nil {
+			return errors.Join(err, a.err)
+		}
+	}
+	return nil
+}
+
+// deleteFile removes the content from GridFS, a missing file is not an error
+func (a *Attachment) deleteFile(id string) error {
+	bucket, err := a.bucket()
+	if err != nil {
+		return err
+	}
+	if err := bucket.SetWriteDeadline(a.deadline()); err != nil {
+		return err
+	}
+	if err := bucket.Delete(id); err != nil && !errors.Is(err, gridfs.ErrFileNotFound) {
+		return err
+	}
+	return nil
+}
+
+// bucket opens a new bucket every time, because the deadlines are kept on the bucket
+func (a *Attachment) bucket() (*gridfs.Bucket, error) {
+	return gridfs.NewBucket(a.client.Database(a.conf.MongoDbName), options.GridFSBucket().SetName(a.collectionName))
+}
+
+func (a *Attachment) deadline() time.Time {
+	return time.Now().Add(time.Duration(a.conf.TimeoutSecond) * time.Second)
+}
@@ -0,0 +1,130 @@
+package dal
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/zenpk/chatbone/util"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	BroadcastTopicCollab    = "collab"    // keyed by the session ID
+	BroadcastTopicClipboard = "clipboard" // keyed by the uuid
+	broadcastCollectionSize = 16 * 1024 * 1024
+	broadcastRetryInterval  = time.Second
+)
+
+// Broadcast is a live event passed to every instance through a capped collection,
+// each instance tails the collection, so it works without a replica set
+type Broadcast struct {
+	Id        primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	Topic     string             `bson:"topic" json:"topic"`
+	Key       string             `bson:"key" json:"key"`
+	Data      []byte             `bson:"data" json:"data"` // JSON
+	Timestamp int64              `bson:"timestamp" json:"timestamp"`
+
+	conf           *util.Configuration
+	logger         util.ILogger
+	client         *mongo.Client
+	collectionName string
+	err            error
+}
+
+func newBroadcast(conf *util.Configuration, client *mongo.Client, logger util.ILogger) (*Broadcast, error) {
+	b := new(Broadcast)
+	b.conf = conf
+	b.logger = logger
+	b.client = client
+	b.collectionName = "broadcast"
+	b.err = errors.New("at Broadcast table")
+	ctx, cancel := util.GetTimeoutContext(b.conf.TimeoutSecond)
+	defer cancel()
+	opts := options.CreateCollection().SetCapped(true).SetSizeInBytes(broadcastCollectionSize)
+	if err := b.client.Database(b.conf.MongoDbName).CreateCollection(ctx, b.collectionName, opts); err != nil {
+		var commandErr mongo.CommandError
+		// NamespaceExists
+		if !errors.As(err, &commandErr) || commandErr.Code != 48 {
+			return nil, errors.Join(err, b.err)
+		}
+	}
+	return b, nil
+}
+
+func (b *Broadcast) Insert(broadcast *Broadcast) error {
+	if broadcast == nil || broadcast.Topic == "" || broadcast.Key == "" || broadcast.Timestamp <= 0 {
+		return errors.Join(errors.New("insert invalid input"), b.err)
+	}
+	collection := b.client.Database(b.conf.MongoDbName).Collection(b.collectionName)
+	ctx, cancel := util.GetTimeoutContext(b.conf.TimeoutSecond)
+	defer cancel()
+	if _, err := collection.InsertOne(ctx, broadcast); err != nil {
+		return errors.Join(err, b.err)
+	}
+	return nil
+}
+
+// Tail hands every event inserted from now on to the handler in the insertion order,
+// it blocks until the context is done, the cursor is opened again after the last handled event if it dies
+func (b *Broadcast) Tail(ctx context.Context, handle func(*Broadcast)) {
+	collection := b.client.Database(b.conf.MongoDbName).Collection(b.collectionName)
+	last, err := b.latestId(ctx, collection)
+	if err != nil {
+		b.logger.Warnln(errors.Join(err, b.err))
+		last = primitive.NewObjectIDFromTimestamp(time.Now())
+	}
+	for {
+		if err := b.tail(ctx, collection, &last, handle); err != nil && ctx.Err() == nil {
+			b.logger.Warnln(errors.Join(err, b.err))
+		}
+		// a tailable cursor over an empty collection dies right away
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(broadcastRetryInterval):
+		}
+	}
+}
+
+func (b *Broadcast) tail(ctx context.Context, collection *mongo.Collection, last *primitive.ObjectID,
+	handle func(*Broadcast),
+) error {
+	filter := bson.M{}
+	if !last.IsZero() {
+		filter["_id"] = bson.M{"$gt": *last}
+	}
+	opts := options.Find().SetCursorType(options.TailableAwait).SetMaxAwaitTime(broadcastRetryInterval)
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+	for cursor.Next(ctx) {
+		broadcast := new(Broadcast)
+		if err := cursor.Decode(broadcast); err != nil {
+			return err
+		}
+		*last = broadcast.Id
+		handle(broadcast)
+	}
+	return cursor.Err()
+}
+
+// latestId returns the ID of the last event, the zero ID if there isn't any
+func (b *Broadcast) latestId(ctx context.Context, collection *mongo.Collection) (primitive.ObjectID, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(b.conf.TimeoutSecond)*time.Second)
+	defer cancel()
+	opts := options.FindOne().SetSort(bson.M{"$natural": -1}).SetProjection(bson.M{"_id": 1})
+	result := new(Broadcast)
+	if err := collection.FindOne(ctx, bson.M{}, opts).Decode(result); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return primitive.NilObjectID, nil
+		}
+		return primitive.NilObjectID, err
+	}
+	return result.Id, nil
+}
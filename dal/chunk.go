@@ -0,0 +1,125 @@
+package dal
+
+import (
+	"errors"
+
+	"github.com/zenpk/chatbone/util"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Chunk is a piece of a document's text with its embedding
+type Chunk struct {
+	Id         string    `bson:"id" json:"id"`
+	LibraryId  string    `bson:"libraryId" json:"libraryId"`
+	DocumentId string    `bson:"documentId" json:"documentId"`
+	Index      int       `bson:"index" json:"index"` // position in the document
+	Text       string    `bson:"text" json:"text"`
+	Embedding  []float64 `bson:"embedding" json:"-"`
+
+	conf           *util.Configuration
+	logger         util.ILogger
+	client         *mongo.Client
+	collectionName string
+	err            error
+}
+
+func newChunk(conf *util.Configuration, client *mongo.Client, logger util.ILogger) (*Chunk, error) {
+	c := new(Chunk)
+	c.conf = conf
+	c.logger = logger
+	c.client = client
+	c.collectionName = "chunk"
+	c.err = errors.New("at Chunk table")
+	ctx, cancel := util.GetTimeoutContext(c.conf.TimeoutSecond)
+	defer cancel()
+	collection := c.client.Database(c.conf.MongoDbName).Collection(c.collectionName)
+	mod := mongo.IndexModel{
+		Keys: bson.M{"id": "hashed"},
+	}
+	_, err := collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, c.err)
+	}
+	mod = mongo.IndexModel{
+		Keys: bson.D{{Key: "libraryId", Value: 1}, {Key: "documentId", Value: 1}, {Key: "index", Value: 1}},
+	}
+	_, err = collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, c.err)
+	}
+	return c, nil
+}
+
+// SelectByLibraryId returns all the chunks of the library with their embeddings
+func (c *Chunk) SelectByLibraryId(libraryId string) ([]*Chunk, error) {
+	collection := c.client.Database(c.conf.MongoDbName).Collection(c.collectionName)
+	filter := bson.M{"libraryId": libraryId}
+	ctx, cancel := util.GetTimeoutContext(c.conf.TimeoutSecond)
+	defer cancel()
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return nil, errors.Join(err, c.err)
+	}
+	result := make([]*Chunk, 0)
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, errors.Join(err, c.err)
+	}
+	return result, nil
+}
+
+func (c *Chunk) CountByLibraryId(libraryId string) (int64, error) {
+	collection := c.client.Database(c.conf.MongoDbName).Collection(c.collectionName)
+	filter := bson.M{"libraryId": libraryId}
+	ctx, cancel := util.GetTimeoutContext(c.conf.TimeoutSecond)
+	defer cancel()
+	count, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return 0, errors.Join(err, c.err)
+	}
+	return count, nil
+}
+
+func (c *Chunk) InsertMany(chunks []*Chunk) error {
+	if len(chunks) == 0 {
+		return nil
+	}
+	documents := make([]any, len(chunks))
+	for i, chunk := range chunks {
+		if chunk == nil || chunk.Id == "" || chunk.LibraryId == "" || chunk.DocumentId == "" ||
+			chunk.Text == "" || len(chunk.Embedding) == 0 {
+			return errors.Join(errors.New("insert invalid input"), c.err)
+		}
+		documents[i] = chunk
+	}
+	collection := c.client.Database(c.conf.MongoDbName).Collection(c.collectionName)
+	ctx, cancel := util.GetTimeoutContext(c.conf.TimeoutSecond)
+	defer cancel()
+	if _, err := collection.InsertMany(ctx, documents, options.InsertMany().SetOrdered(false)); err != nil {
+		return errors.Join(err, c.err)
+	}
+	return nil
+}
+
+func (c *Chunk) DeleteByDocumentId(documentId string) error {
+	collection := c.client.Database(c.conf.MongoDbName).Collection(c.collectionName)
+	filter := bson.M{"documentId": documentId}
+	ctx, cancel := util.GetTimeoutContext(c.conf.TimeoutSecond)
+	defer cancel()
+	if _, err := collection.DeleteMany(ctx, filter); err != nil {
+		return errors.Join(err, c.err)
+	}
+	return nil
+}
+
+func (c *Chunk) DeleteByLibraryId(libraryId string) error {
+	collection := c.client.Database(c.conf.MongoDbName).Collection(c.collectionName)
+	filter := bson.M{"libraryId": libraryId}
+	ctx, cancel := util.GetTimeoutContext(c.conf.TimeoutSecond)
+	defer cancel()
+	if _, err := collection.DeleteMany(ctx, filter); err != nil {
+		return errors.Join(err, c.err)
+	}
+	return nil
+}
@@ -3,10 +3,13 @@ package dal
 const (
 	ModelIdOpenAiGpt4  = 1
 	ModelIdOpenAiGpt35 = 2
+	// embedding models
+	ModelIdOpenAiEmbedding3Small = 101
 )
 
 const (
 	BalanceMultipleFactor = 1000000
+	InitialBalance        = 1 * BalanceMultipleFactor // granted to a new user, 1 dollar
 )
 
 const (
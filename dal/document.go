@@ -0,0 +1,120 @@
+package dal
+
+import (
+	"errors"
+
+	"github.com/zenpk/chatbone/util"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Document is a file uploaded to a library, the text is kept in its chunks
+type Document struct {
+	Id          string `bson:"id" json:"id"`
+	LibraryId   string `bson:"libraryId" json:"libraryId"`
+	UserId      string `bson:"userId" json:"-"` // uuid
+	Filename    string `bson:"filename" json:"filename"`
+	ContentType string `bson:"contentType" json:"contentType"` // sniffed from the content
+	Size        int64  `bson:"size" json:"size"`               // bytes
+	ChunkCount  int    `bson:"chunkCount" json:"chunkCount"`
+	Timestamp   int64  `bson:"timestamp" json:"timestamp"`
+
+	conf           *util.Configuration
+	logger         util.ILogger
+	client         *mongo.Client
+	collectionName string
+	err            error
+}
+
+func newDocument(conf *util.Configuration, client *mongo.Client, logger util.ILogger) (*Document, error) {
+	d := new(Document)
+	d.conf = conf
+	d.logger = logger
+	d.client = client
+	d.collectionName = "document"
+	d.err = errors.New("at Document table")
+	ctx, cancel := util.GetTimeoutContext(d.conf.TimeoutSecond)
+	defer cancel()
+	collection := d.client.Database(d.conf.MongoDbName).Collection(d.collectionName)
+	mod := mongo.IndexModel{
+		Keys: bson.M{"id": "hashed"},
+	}
+	_, err := collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, d.err)
+	}
+	mod = mongo.IndexModel{
+		Keys: bson.D{{Key: "libraryId", Value: 1}, {Key: "timestamp", Value: 1}},
+	}
+	_, err = collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, d.err)
+	}
+	return d, nil
+}
+
+func (d *Document) SelectById(id string) (*Document, error) {
+	collection := d.client.Database(d.conf.MongoDbName).Collection(d.collectionName)
+	filter := bson.M{"id": id}
+	result := new(Document)
+	ctx, cancel := util.GetTimeoutContext(d.conf.TimeoutSecond)
+	defer cancel()
+	if err := collection.FindOne(ctx, filter).Decode(result); err != nil {
+		return nil, errors.Join(err, d.err)
+	}
+	return result, nil
+}
+
+func (d *Document) SelectByLibraryId(libraryId string) ([]*Document, error) {
+	collection := d.client.Database(d.conf.MongoDbName).Collection(d.collectionName)
+	filter := bson.M{"libraryId": libraryId}
+	ctx, cancel := util.GetTimeoutContext(d.conf.TimeoutSecond)
+	defer cancel()
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}})
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.Join(err, d.err)
+	}
+	result := make([]*Document, 0)
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, errors.Join(err, d.err)
+	}
+	return result, nil
+}
+
+func (d *Document) Insert(document *Document) error {
+	if document == nil || document.Id == "" || document.LibraryId == "" || document.UserId == "" ||
+		document.Timestamp <= 0 {
+		return errors.Join(errors.New("insert invalid input"), d.err)
+	}
+	collection := d.client.Database(d.conf.MongoDbName).Collection(d.collectionName)
+	ctx, cancel := util.GetTimeoutContext(d.conf.TimeoutSecond)
+	defer cancel()
+	if _, err := collection.InsertOne(ctx, document); err != nil {
+		return errors.Join(err, d.err)
+	}
+	return nil
+}
+
+func (d *Document) DeleteById(id string) error {
+	collection := d.client.Database(d.conf.MongoDbName).Collection(d.collectionName)
+	filter := bson.M{"id": id}
+	ctx, cancel := util.GetTimeoutContext(d.conf.TimeoutSecond)
+	defer cancel()
+	if _, err := collection.DeleteOne(ctx, filter); err != nil {
+		return errors.Join(err, d.err)
+	}
+	return nil
+}
+
+func (d *Document) DeleteByLibraryId(libraryId string) error {
+	collection := d.client.Database(d.conf.MongoDbName).Collection(d.collectionName)
+	filter := bson.M{"libraryId": libraryId}
+	ctx, cancel := util.GetTimeoutContext(d.conf.TimeoutSecond)
+	defer cancel()
+	if _, err := collection.DeleteMany(ctx, filter); err != nil {
+		return errors.Join(err, d.err)
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package dal
+
+import (
+	"context"
+	"errors"
+
+	"github.com/zenpk/chatbone/util"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	FeedbackRatingUp   = 1
+	FeedbackRatingDown = -1
+)
+
+// Feedback is a user's rating of an assistant message, one per user and message
+type Feedback struct {
+	Id        string         `bson:"id" json:"id"`
+	UserId    string         `bson:"userId" json:"-"` // uuid
+	SessionId string         `bson:"sessionId" json:"sessionId"`
+	MessageId string         `bson:"messageId" json:"messageId"`
+	ModelId   int            `bson:"modelId" json:"modelId"`
+	Timestamp int64          `bson:"timestamp" json:"timestamp"`
+	Rating    int            `bson:"rating" json:"rating"` // 1 or -1
+	Comment   string         `bson:"comment" json:"comment"`
+	Category  string         `bson:"category" json:"category"`
+	Prompt    []*ChatMessage `bson:"prompt" json:"-"` // the messages before the answer when the feedback was given
+	Answer    *ChatMessage   `bson:"answer" json:"-"`
+
+	conf           *util.Configuration
+	logger         util.ILogger
+	client         *mongo.Client
+	collectionName string
+	err            error
+}
+
+// FeedbackFilter narrows down the export, zero values are ignored
+type FeedbackFilter struct {
+	ModelId int
+	Rating  int
+	From    int64 // ms timestamp, inclusive
+	To      int64 // ms timestamp, exclusive
+}
+
+// FeedbackStat is the feedback count of a model
+type FeedbackStat struct {
+	ModelId int `bson:"modelId" json:"modelId"`
+	Up      int `bson:"up" json:"up"`
+	Down    int `bson:"down" json:"down"`
+}
+
+func newFeedback(conf *util.Configuration, client *mongo.Client, logger util.ILogger) (*Feedback, error) {
+	f := new(Feedback)
+	f.conf = conf
+	f.logger = logger
+	f.client = client
+	f.collectionName = "feedback"
+	f.err = errors.New("at Feedback table")
+	ctx, cancel := util.GetTimeoutContext(f.conf.TimeoutSecond)
+	defer cancel()
+	collection := f.client.Database(f.conf.MongoDbName).Collection(f.collectionName)
+	mod := mongo.IndexModel{
+		Keys:    bson.D{{Key: "sessionId", Value: 1}, {Key: "messageId", Value: 1}, {Key: "userId", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+	_, err := collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, f.err)
+	}
+	mod = mongo.IndexModel{
+		Keys: bson.D{{Key: "modelId", Value: 1}, {Key: "timestamp", Value: 1}},
+	}
+	_, err = collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, f.err)
+	}
+	return f, nil
+}
+
+// SelectBySessionId returns the user's feedback on the session's messages
+func (f *Feedback) SelectBySessionId(sessionId, userId string) ([]*Feedback, error) {
+	collection := f.client.Database(f.conf.MongoDbName).Collection(f.collectionName)
+	filter := bson.M{"sessionId": sessionId, "userId": userId}
+	ctx, cancel := util.GetTimeoutContext(f.conf.TimeoutSecond)
+	defer cancel()
+	opts := options.Find().SetProjection(bson.M{"prompt": 0, "answer": 0})
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.Join(err, f.err)
+	}
+	result := make([]*Feedback, 0)
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, errors.Join(err, f.err)
+	}
+	return result, nil
+}
+
+// Upsert replaces the user's previous feedback on the message, the ID of the first one is kept
+func (f *Feedback) Upsert(feedback *Feedback) error {
+	if feedback == nil || feedback.Id == "" || feedback.UserId == "" || feedback.SessionId == "" ||
+		feedback.MessageId == "" || feedback.ModelId <= 0 || feedback.Timestamp <= 0 ||
+		(feedback.Rating != FeedbackRatingUp && feedback.Rating != FeedbackRatingDown) || feedback.Answer == nil {
+		return errors.Join(errors.New("upsert invalid input"), f.err)
+	}
+	collection := f.client.Database(f.conf.MongoDbName).Collection(f.collectionName)
+	filter := bson.M{"sessionId": feedback.SessionId, "messageId": feedback.MessageId, "userId": feedback.UserId}
+	update := bson.M{
+		"$set": bson.M{
+			"modelId":   feedback.ModelId,
+			"timestamp": feedback.Timestamp,
+			"rating":    feedback.Rating,
+			"comment":   feedback.Comment,
+			"category":  feedback.Category,
+			"prompt":    feedback.Prompt,
+			"answer":    feedback.Answer,
+		},
+		"$setOnInsert": bson.M{"id": feedback.Id},
+	}
+	opts := options.Update().SetUpsert(true)
+	ctx, cancel := util.GetTimeoutContext(f.conf.TimeoutSecond)
+	defer cancel()
+	if _, err := collection.UpdateOne(ctx, filter, update, opts); err != nil {
+		return errors.Join(err, f.err)
+	}
+	return nil
+}
+
+func (f *Feedback) DeleteByMessageId(sessionId, messageId, userId string) error {
+	collection := f.client.Database(f.conf.MongoDbName).Collection(f.collectionName)
+	filter := bson.M{"sessionId": sessionId, "messageId": messageId, "userId": userId}
+	ctx, cancel := util.GetTimeoutContext(f.conf.TimeoutSecond)
+	defer cancel()
+	result, err := collection.DeleteOne(ctx, filter)
+	if err != nil {
+		return errors.Join(err, f.err)
+	}
+	if result.DeletedCount == 0 {
+		return errors.Join(mongo.ErrNoDocuments, f.err)
+	}
+	return nil
+}
+
+// DeleteBySessionId removes all the feedback on the session's messages
+func (f *Feedback) DeleteBySessionId(sessionId string) error {
+	collection := f.client.Database(f.conf.MongoDbName).Collection(f.collectionName)
+	filter := bson.M{"sessionId": sessionId}
+	ctx, cancel := util.GetTimeoutContext(f.conf.TimeoutSecond)
+	defer cancel()
+	if _, err := collection.DeleteMany(ctx, filter); err != nil {
+		return errors.Join(err, f.err)
+	}
+	return nil
+}
+
+// Each calls fn with every feedback matching the filter in the time order, the cursor isn't bound by
+// the database timeout since the export can be large, it stops at the first error
+func (f *Feedback) Each(ctx context.Context, feedbackFilter *FeedbackFilter, fn func(*Feedback) error) error {
+	collection := f.client.Database(f.conf.MongoDbName).Collection(f.collectionName)
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}})
+	cursor, err := collection.Find(ctx, feedbackFilter.query(), opts)
+	if err != nil {
+		return errors.Join(err, f.err)
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		feedback := new(Feedback)
+		if err := cursor.Decode(feedback); err != nil {
+			return errors.Join(err, f.err)
+		}
+		if err := fn(feedback); err != nil {
+			return err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return errors.Join(err, f.err)
+	}
+	return nil
+}
+
+// SelectStats counts the ratings per model
+func (f *Feedback) SelectStats(feedbackFilter *FeedbackFilter) ([]*FeedbackStat, error) {
+	collection := f.client.Database(f.conf.MongoDbName).Collection(f.collectionName)
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: feedbackFilter.query()}},
+		{{Key: "$group", Value: bson.M{
+			"_id": "$modelId",
+			"up": bson.M{"$sum": bson.M{
+				"$cond": bson.A{bson.M{"$eq": bson.A{"$rating", FeedbackRatingUp}}, 1, 0},
+			}},
+			"down": bson.M{"$sum": bson.M{
+				"$cond": bson.A{bson.M{"$eq": bson.A{"$rating", FeedbackRatingDown}}, 1, 0},
+			}},
+		}}},
+		{{Key: "$project", Value: bson.M{
+			"_id":     0,
+			"modelId": "$_id",
+			"up":      1,
+			"down":    1,
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "modelId", Value: 1}}}},
+	}
+	ctx, cancel := util.GetTimeoutContext(f.conf.TimeoutSecond)
+	defer cancel()
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, errors.Join(err, f.err)
+	}
+	result := make([]*FeedbackStat, 0)
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, errors.Join(err, f.err)
+	}
+	return result, nil
+}
+
+// query builds the filter, a nil filter matches all
+func (ff *FeedbackFilter) query() bson.M {
+	filter := bson.M{}
+	if ff == nil {
+		return filter
+	}
+	if ff.ModelId > 0 {
+		filter["modelId"] = ff.ModelId
+	}
+	if ff.Rating != 0 {
+		filter["rating"] = ff.Rating
+	}
+	timestamp := bson.M{}
+	if ff.From > 0 {
+		timestamp["$gte"] = ff.From
+	}
+	if ff.To > 0 {
+		timestamp["$lt"] = ff.To
+	}
+	if len(timestamp) > 0 {
+		filter["timestamp"] = timestamp
+	}
+	return filter
+}
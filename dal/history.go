@@ -5,16 +5,20 @@ import (
 
 	"github.com/zenpk/chatbone/util"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type History struct {
-	SessionId     string
-	Timestamp     int64
-	UserId        string
-	ModelId       int
-	InTokenCount  int
-	OutTokenCount int
+	Id            primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	SessionId     string             `bson:"sessionId" json:"sessionId"`
+	LibraryId     string             `bson:"libraryId,omitempty" json:"libraryId,omitempty"` // set instead of the session for document embeddings
+	Timestamp     int64              `bson:"timestamp" json:"timestamp"`
+	UserId        string             `bson:"userId" json:"-"`
+	ModelId       int                `bson:"modelId" json:"modelId"`
+	InTokenCount  int                `bson:"inTokenCount" json:"inTokenCount"`
+	OutTokenCount int                `bson:"outTokenCount" json:"outTokenCount"`
 
 	conf           *util.Configuration
 	logger         util.ILogger
@@ -40,6 +44,20 @@ func newHistory(conf *util.Configuration, client *mongo.Client, logger util.ILog
 	if err != nil {
 		return nil, errors.Join(err, h.err)
 	}
+	mod = mongo.IndexModel{
+		Keys: bson.M{"sessionId": "hashed"},
+	}
+	_, err = collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, h.err)
+	}
+	mod = mongo.IndexModel{
+		Keys: bson.D{{Key: "userId", Value: 1}, {Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}},
+	}
+	_, err = collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, h.err)
+	}
 	return h, nil
 }
 
@@ -48,7 +66,8 @@ func (h *History) SelectBySessionId(sessionId string) ([]*History, error) {
 	filter := bson.M{"sessionId": sessionId}
 	ctx, cancel := util.GetTimeoutContext(h.conf.TimeoutSecond)
 	defer cancel()
-	cursor, err := collection.Find(ctx, filter)
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}})
+	cursor, err := collection.Find(ctx, filter, opts)
 	if err != nil {
 		return nil, errors.Join(err, h.err)
 	}
@@ -59,25 +78,41 @@ func (h *History) SelectBySessionId(sessionId string) ([]*History, error) {
 	return result, nil
 }
 
-func (h *History) SelectByUserIdAfter(userId string, timestamp int64) ([]*History, error) {
+// SelectByUserId returns a page of the user's usage, the most recent first
+func (h *History) SelectByUserId(userId string, page *Page) ([]*History, string, error) {
+	cursor, err := page.decode()
+	if err != nil {
+		return nil, "", errors.Join(err, h.err)
+	}
 	collection := h.client.Database(h.conf.MongoDbName).Collection(h.collectionName)
-	filter := bson.M{"userId": userId, "timestamp": bson.M{"$gt": timestamp}}
+	filter := bson.M{"userId": userId}
+	if cursor != nil {
+		filter["$and"] = bson.A{cursor.after("timestamp")}
+	}
+	size := page.size()
 	ctx, cancel := util.GetTimeoutContext(h.conf.TimeoutSecond)
 	defer cancel()
-	cursor, err := collection.Find(ctx, filter)
+	opts := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}).
+		SetLimit(size + 1)
+	mongoCursor, err := collection.Find(ctx, filter, opts)
 	if err != nil {
-		return nil, errors.Join(err, h.err)
+		return nil, "", errors.Join(err, h.err)
 	}
 	result := make([]*History, 0)
-	if err := cursor.All(ctx, &result); err != nil {
-		return nil, errors.Join(err, h.err)
+	if err := mongoCursor.All(ctx, &result); err != nil {
+		return nil, "", errors.Join(err, h.err)
 	}
-	return result, nil
+	result, next := nextPage(result, size, func(history *History) *pageCursor {
+		return &pageCursor{Key: history.Timestamp, Id: history.Id}
+	})
+	return result, next, nil
 }
 
 func (h *History) Insert(history *History) error {
-	if history == nil || history.SessionId == "" || history.UserId == "" || history.ModelId <= 0 ||
-		history.Timestamp <= 0 || history.InTokenCount <= 0 || history.OutTokenCount <= 0 {
+	// embeddings have no output tokens
+	if history == nil || (history.SessionId == "" && history.LibraryId == "") || history.UserId == "" ||
+		history.ModelId <= 0 || history.Timestamp <= 0 || history.InTokenCount <= 0 || history.OutTokenCount < 0 {
 		return errors.Join(errors.New("insert invalid input"), h.err)
 	}
 	collection := h.client.Database(h.conf.MongoDbName).Collection(h.collectionName)
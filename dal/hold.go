@@ -0,0 +1,98 @@
+package dal
+
+import (
+	"errors"
+
+	"github.com/zenpk/chatbone/util"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Hold is the balance reserved for a request in progress, it's already taken from the user's balance,
+// the part not spent is given back once the request ends
+type Hold struct {
+	Id        string `bson:"id" json:"id"`
+	UserId    string `bson:"userId" json:"-"` // uuid
+	Amount    int64  `bson:"amount" json:"amount"`
+	Timestamp int64  `bson:"timestamp" json:"timestamp"`
+
+	conf           *util.Configuration
+	logger         util.ILogger
+	client         *mongo.Client
+	collectionName string
+	err            error
+}
+
+func newHold(conf *util.Configuration, client *mongo.Client, logger util.ILogger) (*Hold, error) {
+	h := new(Hold)
+	h.conf = conf
+	h.logger = logger
+	h.client = client
+	h.collectionName = "hold"
+	h.err = errors.New("at Hold table")
+	ctx, cancel := util.GetTimeoutContext(h.conf.TimeoutSecond)
+	defer cancel()
+	collection := h.client.Database(h.conf.MongoDbName).Collection(h.collectionName)
+	mod := mongo.IndexModel{
+		Keys:    bson.D{{Key: "id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+	_, err := collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, h.err)
+	}
+	mod = mongo.IndexModel{
+		Keys: bson.D{{Key: "timestamp", Value: 1}},
+	}
+	_, err = collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, h.err)
+	}
+	return h, nil
+}
+
+// SelectBefore returns the oldest holds placed before the timestamp
+func (h *Hold) SelectBefore(timestamp, limit int64) ([]*Hold, error) {
+	collection := h.client.Database(h.conf.MongoDbName).Collection(h.collectionName)
+	filter := bson.M{"timestamp": bson.M{"$lt": timestamp}}
+	ctx, cancel := util.GetTimeoutContext(h.conf.TimeoutSecond)
+	defer cancel()
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}}).SetLimit(limit)
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.Join(err, h.err)
+	}
+	result := make([]*Hold, 0)
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, errors.Join(err, h.err)
+	}
+	return result, nil
+}
+
+func (h *Hold) Insert(hold *Hold) error {
+	collection := h.client.Database(h.conf.MongoDbName).Collection(h.collectionName)
+	ctx, cancel := util.GetTimeoutContext(h.conf.TimeoutSecond)
+	defer cancel()
+	if _, err := collection.InsertOne(ctx, hold); err != nil {
+		return errors.Join(err, h.err)
+	}
+	return nil
+}
+
+// DeleteById returns mongo.ErrNoDocuments if the hold is already gone,
+// whoever deletes it is the only one to give the balance back
+func (h *Hold) DeleteById(id string) error {
+	collection := h.client.Database(h.conf.MongoDbName).Collection(h.collectionName)
+	filter := bson.M{"id": id}
+	ctx, cancel := util.GetTimeoutContext(h.conf.TimeoutSecond)
+	defer cancel()
+	result, err := collection.DeleteOne(ctx, filter)
+	if err != nil {
+		return errors.Join(err, h.err)
+	}
+	if result.DeletedCount == 0 {
+		return errors.Join(mongo.ErrNoDocuments, h.err)
+	}
+	return nil
+}
@@ -9,10 +9,27 @@ import (
 )
 
 type Database struct {
-	History *History
-	Message *Message
-	Model   *Model
-	User    *User
+	Arena      *Arena
+	Attachment *Attachment
+	Broadcast  *Broadcast
+	Chunk      *Chunk
+	Document   *Document
+	Feedback   *Feedback
+	History    *History
+	Hold       *Hold
+	Label      *Label
+	Lease      *Lease
+	Ledger     *Ledger
+	Library    *Library
+	Member     *Member
+	Message    *Message
+	Model      *Model
+	Persona    *Persona
+	Presence   *Presence
+	Share      *Share
+	Template   *Template
+	User       *User
+	Version    *Version
 }
 
 func New(conf *util.Configuration, logger util.ILogger) (*Database, error) {
@@ -24,10 +41,58 @@ func New(conf *util.Configuration, logger util.ILogger) (*Database, error) {
 	if err != nil {
 		return nil, err
 	}
+	arena, err := newArena(conf, client, logger)
+	if err != nil {
+		return nil, err
+	}
+	attachment, err := newAttachment(conf, client, logger)
+	if err != nil {
+		return nil, err
+	}
+	broadcast, err := newBroadcast(conf, client, logger)
+	if err != nil {
+		return nil, err
+	}
+	chunk, err := newChunk(conf, client, logger)
+	if err != nil {
+		return nil, err
+	}
+	document, err := newDocument(conf, client, logger)
+	if err != nil {
+		return nil, err
+	}
+	feedback, err := newFeedback(conf, client, logger)
+	if err != nil {
+		return nil, err
+	}
 	history, err := newHistory(conf, client, logger)
 	if err != nil {
 		return nil, err
 	}
+	hold, err := newHold(conf, client, logger)
+	if err != nil {
+		return nil, err
+	}
+	label, err := newLabel(conf, client, logger)
+	if err != nil {
+		return nil, err
+	}
+	lease, err := newLease(conf, client, logger)
+	if err != nil {
+		return nil, err
+	}
+	ledger, err := newLedger(conf, client, logger)
+	if err != nil {
+		return nil, err
+	}
+	library, err := newLibrary(conf, client, logger)
+	if err != nil {
+		return nil, err
+	}
+	member, err := newMember(conf, client, logger)
+	if err != nil {
+		return nil, err
+	}
 	message, err := newMessage(conf, client, logger)
 	if err != nil {
 		return nil, err
@@ -37,9 +102,51 @@ func New(conf *util.Configuration, logger util.ILogger) (*Database, error) {
 	if err != nil {
 		return nil, err
 	}
+	persona, err := newPersona(conf, client, logger)
+	if err != nil {
+		return nil, err
+	}
+	presence, err := newPresence(conf, client, logger)
+	if err != nil {
+		return nil, err
+	}
+	share, err := newShare(conf, client, logger)
+	if err != nil {
+		return nil, err
+	}
+	template, err := newTemplate(conf, client, logger)
+	if err != nil {
+		return nil, err
+	}
 	user, err := newUser(conf, client, logger)
 	if err != nil {
 		return nil, err
 	}
-	return &Database{history, message, model, user}, nil
+	version, err := newVersion(conf, client, logger)
+	if err != nil {
+		return nil, err
+	}
+	return &Database{
+		Arena:      arena,
+		Attachment: attachment,
+		Broadcast:  broadcast,
+		Chunk:      chunk,
+		Document:   document,
+		Feedback:   feedback,
+		History:    history,
+		Hold:       hold,
+		Label:      label,
+		Lease:      lease,
+		Ledger:     ledger,
+		Library:    library,
+		Member:     member,
+		Message:    message,
+		Model:      model,
+		Persona:    persona,
+		Presence:   presence,
+		Share:      share,
+		Template:   template,
+		User:       user,
+		Version:    version,
+	}, nil
 }
@@ -0,0 +1,150 @@
+package dal
+
+import (
+	"errors"
+
+	"github.com/zenpk/chatbone/util"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	LabelTypeFolder = "folder"
+	LabelTypeTag    = "tag"
+)
+
+// Label is a user-defined folder or tag, sessions only keep the label IDs
+// so renaming a label doesn't touch the sessions
+type Label struct {
+	Id        string `bson:"id" json:"id"`
+	UserId    string `bson:"userId" json:"-"` // uuid
+	Type      string `bson:"type" json:"type"`
+	Name      string `bson:"name" json:"name"`
+	Color     string `bson:"color" json:"color"`
+	Timestamp int64  `bson:"timestamp" json:"timestamp"`
+
+	conf           *util.Configuration
+	logger         util.ILogger
+	client         *mongo.Client
+	collectionName string
+	err            error
+}
+
+func newLabel(conf *util.Configuration, client *mongo.Client, logger util.ILogger) (*Label, error) {
+	l := new(Label)
+	l.conf = conf
+	l.logger = logger
+	l.client = client
+	l.collectionName = "label"
+	l.err = errors.New("at Label table")
+	ctx, cancel := util.GetTimeoutContext(l.conf.TimeoutSecond)
+	defer cancel()
+	collection := l.client.Database(l.conf.MongoDbName).Collection(l.collectionName)
+	mod := mongo.IndexModel{
+		Keys: bson.M{"id": "hashed"},
+	}
+	_, err := collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	mod = mongo.IndexModel{
+		Keys: bson.D{{Key: "userId", Value: 1}, {Key: "type", Value: 1}, {Key: "name", Value: 1}},
+	}
+	_, err = collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	return l, nil
+}
+
+func (l *Label) SelectById(id string) (*Label, error) {
+	collection := l.client.Database(l.conf.MongoDbName).Collection(l.collectionName)
+	filter := bson.M{"id": id}
+	result := new(Label)
+	ctx, cancel := util.GetTimeoutContext(l.conf.TimeoutSecond)
+	defer cancel()
+	if err := collection.FindOne(ctx, filter).Decode(result); err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	return result, nil
+}
+
+// SelectByUserId returns the user's labels of the type, an empty type means all types
+func (l *Label) SelectByUserId(userId, labelType string) ([]*Label, error) {
+	collection := l.client.Database(l.conf.MongoDbName).Collection(l.collectionName)
+	filter := bson.M{"userId": userId}
+	if labelType != "" {
+		filter["type"] = labelType
+	}
+	ctx, cancel := util.GetTimeoutContext(l.conf.TimeoutSecond)
+	defer cancel()
+	opts := options.Find().SetSort(bson.D{{Key: "type", Value: 1}, {Key: "name", Value: 1}})
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	result := make([]*Label, 0)
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	return result, nil
+}
+
+func (l *Label) CountByUserId(userId string) (int64, error) {
+	collection := l.client.Database(l.conf.MongoDbName).Collection(l.collectionName)
+	filter := bson.M{"userId": userId}
+	ctx, cancel := util.GetTimeoutContext(l.conf.TimeoutSecond)
+	defer cancel()
+	count, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return 0, errors.Join(err, l.err)
+	}
+	return count, nil
+}
+
+func (l *Label) Insert(label *Label) error {
+	if label == nil || label.Id == "" || label.UserId == "" || label.Name == "" || label.Timestamp <= 0 ||
+		(label.Type != LabelTypeFolder && label.Type != LabelTypeTag) {
+		return errors.Join(errors.New("insert invalid input"), l.err)
+	}
+	collection := l.client.Database(l.conf.MongoDbName).Collection(l.collectionName)
+	ctx, cancel := util.GetTimeoutContext(l.conf.TimeoutSecond)
+	defer cancel()
+	if _, err := collection.InsertOne(ctx, label); err != nil {
+		return errors.Join(err, l.err)
+	}
+	return nil
+}
+
+// UpdateById renames the label owned by the user, the type can't be changed
+func (l *Label) UpdateById(id, userId, name, color string) error {
+	collection := l.client.Database(l.conf.MongoDbName).Collection(l.collectionName)
+	filter := bson.M{"id": id, "userId": userId}
+	update := bson.M{"$set": bson.M{"name": name, "color": color}}
+	ctx, cancel := util.GetTimeoutContext(l.conf.TimeoutSecond)
+	defer cancel()
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.Join(err, l.err)
+	}
+	if result.MatchedCount == 0 {
+		return errors.Join(mongo.ErrNoDocuments, l.err)
+	}
+	return nil
+}
+
+func (l *Label) DeleteById(id, userId string) error {
+	collection := l.client.Database(l.conf.MongoDbName).Collection(l.collectionName)
+	filter := bson.M{"id": id, "userId": userId}
+	ctx, cancel := util.GetTimeoutContext(l.conf.TimeoutSecond)
+	defer cancel()
+	result, err := collection.DeleteOne(ctx, filter)
+	if err != nil {
+		return errors.Join(err, l.err)
+	}
+	if result.DeletedCount == 0 {
+		return errors.Join(mongo.ErrNoDocuments, l.err)
+	}
+	return nil
+}
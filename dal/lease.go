@@ -0,0 +1,72 @@
+package dal
+
+import (
+	"errors"
+	"time"
+
+	"github.com/zenpk/chatbone/util"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Lease lets a single instance run a background job, the holder keeps it by extending it before it expires,
+// another instance takes it over once it has expired
+type Lease struct {
+	Name     string    `bson:"name" json:"name"`
+	Holder   string    `bson:"holder" json:"holder"` // the instance
+	ExpireAt time.Time `bson:"expireAt" json:"expireAt"`
+
+	conf           *util.Configuration
+	logger         util.ILogger
+	client         *mongo.Client
+	collectionName string
+	err            error
+}
+
+func newLease(conf *util.Configuration, client *mongo.Client, logger util.ILogger) (*Lease, error) {
+	l := new(Lease)
+	l.conf = conf
+	l.logger = logger
+	l.client = client
+	l.collectionName = "lease"
+	l.err = errors.New("at Lease table")
+	ctx, cancel := util.GetTimeoutContext(l.conf.TimeoutSecond)
+	defer cancel()
+	collection := l.client.Database(l.conf.MongoDbName).Collection(l.collectionName)
+	mod := mongo.IndexModel{
+		Keys:    bson.D{{Key: "name", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+	_, err := collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	return l, nil
+}
+
+// Acquire takes the lease if it's free or expired, or extends it if the holder has it already,
+// it tells if the holder has the lease for the duration from now
+func (l *Lease) Acquire(name, holder string, duration time.Duration) (bool, error) {
+	if name == "" || holder == "" || duration <= 0 {
+		return false, errors.Join(errors.New("acquire invalid input"), l.err)
+	}
+	collection := l.client.Database(l.conf.MongoDbName).Collection(l.collectionName)
+	now := time.Now()
+	filter := bson.M{"name": name, "$or": bson.A{
+		bson.M{"holder": holder},
+		bson.M{"expireAt": bson.M{"$lte": now}},
+	}}
+	update := bson.M{"$set": bson.M{"holder": holder, "expireAt": now.Add(duration)}}
+	opts := options.Update().SetUpsert(true)
+	ctx, cancel := util.GetTimeoutContext(l.conf.TimeoutSecond)
+	defer cancel()
+	if _, err := collection.UpdateOne(ctx, filter, update, opts); err != nil {
+		// held by another instance, so the upsert runs into the unique name
+		if mongo.IsDuplicateKeyError(err) {
+			return false, nil
+		}
+		return false, errors.Join(err, l.err)
+	}
+	return true, nil
+}
@@ -0,0 +1,165 @@
+package dal
+
+import (
+	"errors"
+
+	"github.com/zenpk/chatbone/util"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	LedgerKindCharge     = "charge"     // the cost of a request, references the history
+	LedgerKindTopUp      = "topUp"      // added by an admin
+	LedgerKindRefund     = "refund"     // given back by an admin, might reference the history
+	LedgerKindAdjustment = "adjustment" // a correction by an admin or the reconciliation
+	LedgerKindGrant      = "grant"      // the free balance of a new user, or given by an admin
+	LedgerKindHold       = "hold"       // reserved before a request, references the hold
+	LedgerKindRelease    = "release"    // the hold given back once the request ends
+	// LedgerReferenceOpening is the reference of the first entry of a user, one per user:
+	// the initial grant, or the balance the user had before the ledger which might be zero
+	LedgerReferenceOpening = "opening"
+)
+
+// Ledger is an append-only entry of the balance changes, the user's balance is the sum of the entries
+type Ledger struct {
+	Id        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserId    string             `bson:"userId" json:"-"` // uuid
+	Kind      string             `bson:"kind" json:"kind"`
+	Amount    int64              `bson:"amount" json:"amount"`                           // signed, dollar * BalanceMultipleFactor
+	Balance   int64              `bson:"balance" json:"balance"`                         // right after the entry
+	Reference string             `bson:"reference,omitempty" json:"reference,omitempty"` // the history or the hold ID
+	AdminId   string             `bson:"adminId,omitempty" json:"-"`                     // who made the entry by hand
+	Note      string             `bson:"note,omitempty" json:"note,omitempty"`
+	Timestamp int64              `bson:"timestamp" json:"timestamp"`
+
+	conf           *util.Configuration
+	logger         util.ILogger
+	client         *mongo.Client
+	collectionName string
+	err            error
+}
+
+func newLedger(conf *util.Configuration, client *mongo.Client, logger util.ILogger) (*Ledger, error) {
+	l := new(Ledger)
+	l.conf = conf
+	l.logger = logger
+	l.client = client
+	l.collectionName = "ledger"
+	l.err = errors.New("at Ledger table")
+	ctx, cancel := util.GetTimeoutContext(l.conf.TimeoutSecond)
+	defer cancel()
+	collection := l.client.Database(l.conf.MongoDbName).Collection(l.collectionName)
+	mod := mongo.IndexModel{
+		Keys: bson.D{{Key: "userId", Value: 1}, {Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}},
+	}
+	_, err := collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	// any instance might record the opening entry, it must still be recorded only once
+	mod = mongo.IndexModel{
+		Keys: bson.D{{Key: "userId", Value: 1}, {Key: "reference", Value: 1}},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"reference": LedgerReferenceOpening}),
+	}
+	_, err = collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	return l, nil
+}
+
+// SelectByUserId returns a page of the user's entries, the most recent first
+func (l *Ledger) SelectByUserId(userId string, page *Page) ([]*Ledger, string, error) {
+	cursor, err := page.decode()
+	if err != nil {
+		return nil, "", errors.Join(err, l.err)
+	}
+	collection := l.client.Database(l.conf.MongoDbName).Collection(l.collectionName)
+	filter := bson.M{"userId": userId}
+	if cursor != nil {
+		filter["$and"] = bson.A{cursor.after("timestamp")}
+	}
+	size := page.size()
+	ctx, cancel := util.GetTimeoutContext(l.conf.TimeoutSecond)
+	defer cancel()
+	opts := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}).
+		SetLimit(size + 1)
+	mongoCursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, "", errors.Join(err, l.err)
+	}
+	result := make([]*Ledger, 0)
+	if err := mongoCursor.All(ctx, &result); err != nil {
+		return nil, "", errors.Join(err, l.err)
+	}
+	result, next := nextPage(result, size, func(entry *Ledger) *pageCursor {
+		return &pageCursor{Key: entry.Timestamp, Id: entry.Id}
+	})
+	return result, next, nil
+}
+
+// SumByUserId returns the sum of the user's entries and the number of them
+func (l *Ledger) SumByUserId(userId string) (int64, int64, error) {
+	collection := l.client.Database(l.conf.MongoDbName).Collection(l.collectionName)
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"userId": userId}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   nil,
+			"sum":   bson.M{"$sum": "$amount"},
+			"count": bson.M{"$sum": 1},
+		}}},
+	}
+	ctx, cancel := util.GetTimeoutContext(l.conf.TimeoutSecond)
+	defer cancel()
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, 0, errors.Join(err, l.err)
+	}
+	result := make([]struct {
+		Sum   int64 `bson:"sum"`
+		Count int64 `bson:"count"`
+	}, 0)
+	if err := cursor.All(ctx, &result); err != nil {
+		return 0, 0, errors.Join(err, l.err)
+	}
+	if len(result) == 0 {
+		return 0, 0, nil
+	}
+	return result[0].Sum, result[0].Count, nil
+}
+
+// HasOpening tells if the user's ledger has the opening entry
+func (l *Ledger) HasOpening(userId string) (bool, error) {
+	collection := l.client.Database(l.conf.MongoDbName).Collection(l.collectionName)
+	filter := bson.M{"userId": userId, "reference": LedgerReferenceOpening}
+	ctx, cancel := util.GetTimeoutContext(l.conf.TimeoutSecond)
+	defer cancel()
+	count, err := collection.CountDocuments(ctx, filter, options.Count().SetLimit(1))
+	if err != nil {
+		return false, errors.Join(err, l.err)
+	}
+	return count > 0, nil
+}
+
+func (l *Ledger) Insert(entry *Ledger) error {
+	if entry == nil || entry.UserId == "" || entry.Kind == "" || entry.Timestamp <= 0 ||
+		(entry.Amount == 0 && entry.Reference != LedgerReferenceOpening) {
+		return errors.Join(errors.New("insert invalid input"), l.err)
+	}
+	collection := l.client.Database(l.conf.MongoDbName).Collection(l.collectionName)
+	ctx, cancel := util.GetTimeoutContext(l.conf.TimeoutSecond)
+	defer cancel()
+	result, err := collection.InsertOne(ctx, entry)
+	if err != nil {
+		return errors.Join(err, l.err)
+	}
+	if id, ok := result.InsertedID.(primitive.ObjectID); ok {
+		entry.Id = id
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package dal
+
+import (
+	"errors"
+
+	"github.com/zenpk/chatbone/util"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Library is a collection of documents that sessions could retrieve from
+type Library struct {
+	Id        string `bson:"id" json:"id"`
+	UserId    string `bson:"userId" json:"-"` // uuid
+	Name      string `bson:"name" json:"name"`
+	Timestamp int64  `bson:"timestamp" json:"timestamp"`
+
+	conf           *util.Configuration
+	logger         util.ILogger
+	client         *mongo.Client
+	collectionName string
+	err            error
+}
+
+func newLibrary(conf *util.Configuration, client *mongo.Client, logger util.ILogger) (*Library, error) {
+	l := new(Library)
+	l.conf = conf
+	l.logger = logger
+	l.client = client
+	l.collectionName = "library"
+	l.err = errors.New("at Library table")
+	ctx, cancel := util.GetTimeoutContext(l.conf.TimeoutSecond)
+	defer cancel()
+	collection := l.client.Database(l.conf.MongoDbName).Collection(l.collectionName)
+	mod := mongo.IndexModel{
+		Keys: bson.M{"id": "hashed"},
+	}
+	_, err := collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	mod = mongo.IndexModel{
+		Keys: bson.D{{Key: "userId", Value: 1}, {Key: "name", Value: 1}},
+	}
+	_, err = collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	return l, nil
+}
+
+func (l *Library) SelectById(id string) (*Library, error) {
+	collection := l.client.Database(l.conf.MongoDbName).Collection(l.collectionName)
+	filter := bson.M{"id": id}
+	result := new(Library)
+	ctx, cancel := util.GetTimeoutContext(l.conf.TimeoutSecond)
+	defer cancel()
+	if err := collection.FindOne(ctx, filter).Decode(result); err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	return result, nil
+}
+
+func (l *Library) SelectByUserId(userId string) ([]*Library, error) {
+	collection := l.client.Database(l.conf.MongoDbName).Collection(l.collectionName)
+	filter := bson.M{"userId": userId}
+	ctx, cancel := util.GetTimeoutContext(l.conf.TimeoutSecond)
+	defer cancel()
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}})
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	result := make([]*Library, 0)
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	return result, nil
+}
+
+func (l *Library) CountByUserId(userId string) (int64, error) {
+	collection := l.client.Database(l.conf.MongoDbName).Collection(l.collectionName)
+	filter := bson.M{"userId": userId}
+	ctx, cancel := util.GetTimeoutContext(l.conf.TimeoutSecond)
+	defer cancel()
+	count, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return 0, errors.Join(err, l.err)
+	}
+	return count, nil
+}
+
+func (l *Library) Insert(library *Library) error {
+	if library == nil || library.Id == "" || library.UserId == "" || library.Name == "" || library.Timestamp <= 0 {
+		return errors.Join(errors.New("insert invalid input"), l.err)
+	}
+	collection := l.client.Database(l.conf.MongoDbName).Collection(l.collectionName)
+	ctx, cancel := util.GetTimeoutContext(l.conf.TimeoutSecond)
+	defer cancel()
+	if _, err := collection.InsertOne(ctx, library); err != nil {
+		return errors.Join(err, l.err)
+	}
+	return nil
+}
+
+func (l *Library) UpdateById(id, userId, name string) error {
+	collection := l.client.Database(l.conf.MongoDbName).Collection(l.collectionName)
+	filter := bson.M{"id": id, "userId": userId}
+	update := bson.M{"$set": bson.M{"name": name}}
+	ctx, cancel := util.GetTimeoutContext(l.conf.TimeoutSecond)
+	defer cancel()
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.Join(err, l.err)
+	}
+	if result.MatchedCount == 0 {
+		return errors.Join(mongo.ErrNoDocuments, l.err)
+	}
+	return nil
+}
+
+func (l *Library) DeleteById(id, userId string) error {
+	collection := l.client.Database(l.conf.MongoDbName).Collection(l.collectionName)
+	filter := bson.M{"id": id, "userId": userId}
+	ctx, cancel := util.GetTimeoutContext(l.conf.TimeoutSecond)
+	defer cancel()
+	if _, err := collection.DeleteOne(ctx, filter); err != nil {
+		return errors.Join(err, l.err)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package dal
+
+import (
+	"errors"
+
+	"github.com/zenpk/chatbone/util"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	MemberRoleViewer      = "viewer"      // could watch the session live
+	MemberRoleParticipant = "participant" // could chat in the session as well
+)
+
+// Member is a user invited to another user's session, the owner isn't a member
+type Member struct {
+	SessionId string `bson:"sessionId" json:"sessionId"`
+	UserId    string `bson:"userId" json:"userId"` // uuid
+	Role      string `bson:"role" json:"role"`
+	Timestamp int64  `bson:"timestamp" json:"timestamp"`
+
+	conf           *util.Configuration
+	logger         util.ILogger
+	client         *mongo.Client
+	collectionName string
+	err            error
+}
+
+func newMember(conf *util.Configuration, client *mongo.Client, logger util.ILogger) (*Member, error) {
+	m := new(Member)
+	m.conf = conf
+	m.logger = logger
+	m.client = client
+	m.collectionName = "member"
+	m.err = errors.New("at Member table")
+	ctx, cancel := util.GetTimeoutContext(m.conf.TimeoutSecond)
+	defer cancel()
+	collection := m.client.Database(m.conf.MongoDbName).Collection(m.collectionName)
+	mod := mongo.IndexModel{
+		Keys:    bson.D{{Key: "sessionId", Value: 1}, {Key: "userId", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+	_, err := collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, m.err)
+	}
+	return m, nil
+}
+
+func (m *Member) SelectOne(sessionId, userId string) (*Member, error) {
+	collection := m.client.Database(m.conf.MongoDbName).Collection(m.collectionName)
+	filter := bson.M{"sessionId": sessionId, "userId": userId}
+	result := new(Member)
+	ctx, cancel := util.GetTimeoutContext(m.conf.TimeoutSecond)
+	defer cancel()
+	if err := collection.FindOne(ctx, filter).Decode(result); err != nil {
+		return nil, errors.Join(err, m.err)
+	}
+	return result, nil
+}
+
+func (m *Member) SelectBySessionId(sessionId string) ([]*Member, error) {
+	collection := m.client.Database(m.conf.MongoDbName).Collection(m.collectionName)
+	filter := bson.M{"sessionId": sessionId}
+	ctx, cancel := util.GetTimeoutContext(m.conf.TimeoutSecond)
+	defer cancel()
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}})
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.Join(err, m.err)
+	}
+	result := make([]*Member, 0)
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, errors.Join(err, m.err)
+	}
+	return result, nil
+}
+
+func (m *Member) CountBySessionId(sessionId string) (int64, error) {
+	collection := m.client.Database(m.conf.MongoDbName).Collection(m.collectionName)
+	filter := bson.M{"sessionId": sessionId}
+	ctx, cancel := util.GetTimeoutContext(m.conf.TimeoutSecond)
+	defer cancel()
+	count, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return 0, errors.Join(err, m.err)
+	}
+	return count, nil
+}
+
+// Upsert invites the user or changes the role, the invitation time is kept
+func (m *Member) Upsert(member *Member) error {
+	if member == nil || member.SessionId == "" || member.UserId == "" || member.Timestamp <= 0 ||
+		(member.Role != MemberRoleViewer && member.Role != MemberRoleParticipant) {
+		return errors.Join(errors.New("upsert invalid input"), m.err)
+	}
+	collection := m.client.Database(m.conf.MongoDbName).Collection(m.collectionName)
+	filter := bson.M{"sessionId": member.SessionId, "userId": member.UserId}
+	update := bson.M{
+		"$set":         bson.M{"role": member.Role},
+		"$setOnInsert": bson.M{"timestamp": member.Timestamp},
+	}
+	opts := options.Update().SetUpsert(true)
+	ctx, cancel := util.GetTimeoutContext(m.conf.TimeoutSecond)
+	defer cancel()
+	if _, err := collection.UpdateOne(ctx, filter, update, opts); err != nil {
+		return errors.Join(err, m.err)
+	}
+	return nil
+}
+
+func (m *Member) Delete(sessionId, userId string) error {
+	collection := m.client.Database(m.conf.MongoDbName).Collection(m.collectionName)
+	filter := bson.M{"sessionId": sessionId, "userId": userId}
+	ctx, cancel := util.GetTimeoutContext(m.conf.TimeoutSecond)
+	defer cancel()
+	result, err := collection.DeleteOne(ctx, filter)
+	if err != nil {
+		return errors.Join(err, m.err)
+	}
+	if result.DeletedCount == 0 {
+		return errors.Join(mongo.ErrNoDocuments, m.err)
+	}
+	return nil
+}
+
+func (m *Member) DeleteBySessionId(sessionId string) error {
+	collection := m.client.Database(m.conf.MongoDbName).Collection(m.collectionName)
+	filter := bson.M{"sessionId": sessionId}
+	ctx, cancel := util.GetTimeoutContext(m.conf.TimeoutSecond)
+	defer cancel()
+	if _, err := collection.DeleteMany(ctx, filter); err != nil {
+		return errors.Join(err, m.err)
+	}
+	return nil
+}
@@ -1,23 +1,35 @@
 package dal
 
 import (
+	"context"
 	"errors"
+	"strings"
 
 	"github.com/zenpk/chatbone/util"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type Message struct {
-	Deleted   bool
-	SessionId string
-	UserId    string // uuid
-	Timestamp int64
-	Messages  string // json string of messages, might include persona (role: system)
-	ModelId   int
-	Shared    bool
-	Saved     bool // if false, it means the message is automatically saved (last)
+	Id         primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	Deleted    bool               `bson:"deleted" json:"-"`
+	DeletedAt  int64              `bson:"deletedAt,omitempty" json:"deletedAt,omitempty"` // ms timestamp of moving into the trash
+	SessionId  string             `bson:"sessionId" json:"sessionId"`
+	UserId     string             `bson:"userId" json:"-"` // uuid
+	Timestamp  int64              `bson:"timestamp" json:"timestamp"`
+	Title      string             `bson:"title" json:"title"`
+	Messages   []*ChatMessage     `bson:"messages" json:"-"` // might include persona (role: system)
+	ModelId    int                `bson:"modelId" json:"modelId"`
+	Shared     bool               `bson:"shared" json:"shared"`
+	Saved      bool               `bson:"saved" json:"saved"` // if false, it means the message is automatically saved (last)
+	FolderId   string             `bson:"folderId" json:"folderId"`
+	TagIds     []string           `bson:"tagIds" json:"tagIds"`
+	Pinned     bool               `bson:"pinned" json:"pinned"`
+	LibraryId  string             `bson:"libraryId,omitempty" json:"libraryId,omitempty"` // the documents to retrieve from
+	ForkedFrom *ForkedFrom        `bson:"forkedFrom,omitempty" json:"forkedFrom,omitempty"`
+	Settings   *SessionSettings   `bson:"settings,omitempty" json:"settings,omitempty"` // the chat falls back to them
 
 	conf           *util.Configuration
 	logger         util.ILogger
@@ -57,9 +69,174 @@ func newMessage(conf *util.Configuration, client *mongo.Client, logger util.ILog
 	if err != nil {
 		return nil, errors.Join(err, m.err)
 	}
+	mod = mongo.IndexModel{
+		Keys: bson.D{{Key: "userId", Value: 1}, {Key: "pinned", Value: -1}, {Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}},
+	}
+	_, err = collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, m.err)
+	}
+	mod = mongo.IndexModel{
+		Keys:    bson.D{{Key: "deletedAt", Value: 1}},
+		Options: options.Index().SetPartialFilterExpression(bson.M{"deleted": true}),
+	}
+	_, err = collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, m.err)
+	}
+	mod = mongo.IndexModel{
+		Keys:    bson.D{{Key: "userId", Value: 1}, {Key: "deletedAt", Value: -1}, {Key: "_id", Value: -1}},
+		Options: options.Index().SetPartialFilterExpression(bson.M{"deleted": true}),
+	}
+	_, err = collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, m.err)
+	}
+	if _, err := collection.Indexes().CreateOne(ctx, messageTextIndex()); err != nil {
+		// only one text index is allowed, the former one over the plain texts is replaced by the migration
+		if !isIndexConflict(err) {
+			return nil, errors.Join(err, m.err)
+		}
+		m.logger.Warnf("the message text index is outdated, run the migration: %v", err)
+	}
 	return m, nil
 }
 
+// messageTextIndex covers the title and the text parts of the messages
+func messageTextIndex() mongo.IndexModel {
+	return mongo.IndexModel{
+		Keys:    bson.D{{Key: "title", Value: "text"}, {Key: "messages.content.text", Value: "text"}},
+		Options: options.Index().SetWeights(bson.M{"title": 5, "messages.content.text": 1}),
+	}
+}
+
+const (
+	ContentTypeText       = "text"
+	ContentTypeAttachment = "attachment"
+)
+
+// SessionSettings are used by the chat when the request omits them
+type SessionSettings struct {
+	ModelId       int        `bson:"modelId,omitempty" json:"modelId,omitempty"`
+	PersonaId     string     `bson:"personaId,omitempty" json:"personaId,omitempty"`
+	Parameters    Parameters `bson:"parameters" json:"parameters"`
+	RetrievalTopK int        `bson:"retrievalTopK,omitempty" json:"retrievalTopK,omitempty"` // 0 means the default
+}
+
+// ForkedFrom is the provenance of a session copied from another one
+type ForkedFrom struct {
+	SessionId  string `bson:"sessionId" json:"sessionId"`
+	UserId     string `bson:"userId" json:"-"`                                  // owner of the original session
+	ShareToken string `bson:"shareToken,omitempty" json:"shareToken,omitempty"` // if forked from a share
+	MessageId  string `bson:"messageId" json:"messageId"`                       // the last copied message
+	Timestamp  int64  `bson:"timestamp" json:"timestamp"`
+}
+
+// ChatMessage is a message of the session
+type ChatMessage struct {
+	Id            string         `bson:"id" json:"id"` // unique in the session
+	Role          string         `bson:"role" json:"role"`
+	Content       []*ContentPart `bson:"content" json:"content"`
+	ModelId       int            `bson:"modelId,omitempty" json:"modelId,omitempty"`             // assistant only
+	InTokenCount  int            `bson:"inTokenCount,omitempty" json:"inTokenCount,omitempty"`   // assistant only, the prompt tokens
+	OutTokenCount int            `bson:"outTokenCount,omitempty" json:"outTokenCount,omitempty"` // assistant only
+	Timestamp     int64          `bson:"timestamp" json:"timestamp"`
+}
+
+type ContentPart struct {
+	Type         string `bson:"type" json:"type"`
+	Text         string `bson:"text,omitempty" json:"text,omitempty"`
+	AttachmentId string `bson:"attachmentId,omitempty" json:"attachmentId,omitempty"`
+}
+
+// Text joins the text parts of the message
+func (c *ChatMessage) Text() string {
+	if len(c.Content) == 1 {
+		return c.Content[0].Text
+	}
+	texts := make([]string, 0, len(c.Content))
+	for _, part := range c.Content {
+		if part.Type == ContentTypeText {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// AttachmentIds returns the IDs of the attachment parts in order
+func (c *ChatMessage) AttachmentIds() []string {
+	ids := make([]string, 0)
+	for _, part := range c.Content {
+		if part.Type == ContentTypeAttachment {
+			ids = append(ids, part.AttachmentId)
+		}
+	}
+	return ids
+}
+
+// TextMessage builds a message with a single text part
+func TextMessage(id, role, text string, timestamp int64) *ChatMessage {
+	return &ChatMessage{
+		Id:        id,
+		Role:      role,
+		Content:   []*ContentPart{{Type: ContentTypeText, Text: text}},
+		Timestamp: timestamp,
+	}
+}
+
+// MessageFilter narrows down the listing and the search, zero values are ignored
+type MessageFilter struct {
+	ModelId  int
+	From     int64 // ms timestamp, inclusive
+	To       int64 // ms timestamp, exclusive
+	Saved    *bool
+	Shared   *bool
+	FolderId string
+	TagId    string
+	Pinned   *bool
+}
+
+// apply adds the filter conditions to the query
+func (f *MessageFilter) apply(filter bson.M) {
+	if f == nil {
+		return
+	}
+	if f.ModelId > 0 {
+		filter["modelId"] = f.ModelId
+	}
+	timestamp := bson.M{}
+	if f.From > 0 {
+		timestamp["$gte"] = f.From
+	}
+	if f.To > 0 {
+		timestamp["$lt"] = f.To
+	}
+	if len(timestamp) > 0 {
+		filter["timestamp"] = timestamp
+	}
+	if f.Saved != nil {
+		filter["saved"] = *f.Saved
+	}
+	if f.Shared != nil {
+		filter["shared"] = *f.Shared
+	}
+	if f.FolderId != "" {
+		filter["folderId"] = f.FolderId
+	}
+	if f.TagId != "" {
+		filter["tagIds"] = f.TagId
+	}
+	if f.Pinned != nil {
+		filter["pinned"] = *f.Pinned
+	}
+}
+
+// MessageSearchResult is a session matched by the text search
+type MessageSearchResult struct {
+	Message `bson:",inline"`
+	Score   float64 `bson:"score"`
+}
+
 func (m *Message) SelectBySessionId(id string) (*Message, error) {
 	collection := m.client.Database(m.conf.MongoDbName).Collection(m.collectionName)
 	filter := bson.M{"deleted": false, "sessionId": id}
@@ -72,17 +249,53 @@ func (m *Message) SelectBySessionId(id string) (*Message, error) {
 	return result, nil
 }
 
-func (m *Message) SelectByUserId(userId string) ([]*Message, error) {
+// SelectByUserId returns a page of the metadata, messages are left empty, pinned sessions come first
+func (m *Message) SelectByUserId(userId string, messageFilter *MessageFilter, page *Page) ([]*Message, string, error) {
+	cursor, err := page.decode()
+	if err != nil {
+		return nil, "", errors.Join(err, m.err)
+	}
 	collection := m.client.Database(m.conf.MongoDbName).Collection(m.collectionName)
 	filter := bson.M{"deleted": false, "userId": userId}
+	messageFilter.apply(filter)
+	if cursor != nil {
+		filter["$and"] = bson.A{cursor.afterPinned("timestamp")}
+	}
+	size := page.size()
+	ctx, cancel := util.GetTimeoutContext(m.conf.TimeoutSecond)
+	defer cancel()
+	opts := options.Find().
+		SetSort(bson.D{{Key: "pinned", Value: -1}, {Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}).
+		SetProjection(bson.M{"messages": 0}).
+		SetLimit(size + 1)
+	result, err := m.find(ctx, collection, filter, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	result, next := nextPage(result, size, func(message *Message) *pageCursor {
+		return &pageCursor{Pinned: message.Pinned, Key: message.Timestamp, Id: message.Id}
+	})
+	return result, next, nil
+}
+
+// SearchByUserId runs the text search over the user's sessions ordered by relevance,
+// the messages are returned for the snippets
+func (m *Message) SearchByUserId(userId, query string, messageFilter *MessageFilter, limit int64) ([]*MessageSearchResult, error) {
+	collection := m.client.Database(m.conf.MongoDbName).Collection(m.collectionName)
+	filter := bson.M{"deleted": false, "userId": userId, "$text": bson.M{"$search": query}}
+	messageFilter.apply(filter)
+	score := bson.M{"$meta": "textScore"}
+	opts := options.Find().
+		SetProjection(bson.M{"score": score}).
+		SetSort(bson.D{{Key: "score", Value: score}, {Key: "timestamp", Value: -1}}).
+		SetLimit(limit)
 	ctx, cancel := util.GetTimeoutContext(m.conf.TimeoutSecond)
 	defer cancel()
-	opts := options.Find().SetSort(bson.D{{"timestamp", -1}})
 	cursor, err := collection.Find(ctx, filter, opts)
 	if err != nil {
 		return nil, errors.Join(err, m.err)
 	}
-	result := make([]*Message, 0)
+	result := make([]*MessageSearchResult, 0)
 	if err := cursor.All(ctx, &result); err != nil {
 		return nil, errors.Join(err, m.err)
 	}
@@ -95,7 +308,8 @@ func (m *Message) SelectLastByUserId(userId string) (*Message, error) {
 	result := new(Message)
 	ctx, cancel := util.GetTimeoutContext(m.conf.TimeoutSecond)
 	defer cancel()
-	if err := collection.FindOne(ctx, filter).Decode(result); err != nil {
+	opts := options.FindOne().SetSort(bson.D{{Key: "timestamp", Value: -1}})
+	if err := collection.FindOne(ctx, filter, opts).Decode(result); err != nil {
 		return nil, errors.Join(err, m.err)
 	}
 	return result, nil
@@ -117,15 +331,365 @@ func (m *Message) ReplaceBySessionId(message *Message) error {
 		return err
 	}
 	collection := m.client.Database(m.conf.MongoDbName).Collection(m.collectionName)
-	filter := bson.M{"deleted": false, "sessionId": message.SessionId}
+	filter := bson.M{"deleted": false, "sessionId": message.SessionId, "userId": message.UserId}
 	ctx, cancel := util.GetTimeoutContext(m.conf.TimeoutSecond)
 	defer cancel()
 	_, err := collection.ReplaceOne(ctx, filter, message)
 	return errors.Join(err, m.err)
 }
 
+// DeleteBySessionId soft deletes the session owned by the user, moving it into the trash
+func (m *Message) DeleteBySessionId(sessionId, userId string, deletedAt int64) error {
+	return m.updateOwned(sessionId, userId, bson.M{"$set": bson.M{"deleted": true, "deletedAt": deletedAt}})
+}
+
+// SelectDeletedBySessionId returns the session in the trash
+func (m *Message) SelectDeletedBySessionId(id string) (*Message, error) {
+	collection := m.client.Database(m.conf.MongoDbName).Collection(m.collectionName)
+	filter := bson.M{"deleted": true, "sessionId": id}
+	result := new(Message)
+	ctx, cancel := util.GetTimeoutContext(m.conf.TimeoutSecond)
+	defer cancel()
+	opts := options.FindOne().SetProjection(bson.M{"messages": 0})
+	if err := collection.FindOne(ctx, filter, opts).Decode(result); err != nil {
+		return nil, errors.Join(err, m.err)
+	}
+	return result, nil
+}
+
+// SelectDeletedByUserId returns a page of the metadata of the user's trash, the most recently deleted first
+func (m *Message) SelectDeletedByUserId(userId string, page *Page) ([]*Message, string, error) {
+	cursor, err := page.decode()
+	if err != nil {
+		return nil, "", errors.Join(err, m.err)
+	}
+	collection := m.client.Database(m.conf.MongoDbName).Collection(m.collectionName)
+	filter := bson.M{"deleted": true, "userId": userId}
+	if cursor != nil {
+		filter["$and"] = bson.A{cursor.after("deletedAt")}
+	}
+	size := page.size()
+	ctx, cancel := util.GetTimeoutContext(m.conf.TimeoutSecond)
+	defer cancel()
+	opts := options.Find().
+		SetSort(bson.D{{Key: "deletedAt", Value: -1}, {Key: "_id", Value: -1}}).
+		SetProjection(bson.M{"messages": 0}).
+		SetLimit(size + 1)
+	result, err := m.find(ctx, collection, filter, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	result, next := nextPage(result, size, func(message *Message) *pageCursor {
+		return &pageCursor{Key: message.DeletedAt, Id: message.Id}
+	})
+	return result, next, nil
+}
+
+// SelectDeletedBefore returns at most limit sessions of all users trashed before the timestamp,
+// only the session and user IDs are filled
+func (m *Message) SelectDeletedBefore(deletedAt, limit int64) ([]*Message, error) {
+	collection := m.client.Database(m.conf.MongoDbName).Collection(m.collectionName)
+	filter := bson.M{"deleted": true, "deletedAt": bson.M{"$lt": deletedAt}}
+	ctx, cancel := util.GetTimeoutContext(m.conf.TimeoutSecond)
+	defer cancel()
+	opts := options.Find().
+		SetSort(bson.D{{Key: "deletedAt", Value: 1}}).
+		SetProjection(bson.M{"sessionId": 1, "userId": 1}).
+		SetLimit(limit)
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.Join(err, m.err)
+	}
+	result := make([]*Message, 0)
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, errors.Join(err, m.err)
+	}
+	return result, nil
+}
+
+// RestoreBySessionId moves the session owned by the user out of the trash
+func (m *Message) RestoreBySessionId(sessionId, userId string) error {
+	collection := m.client.Database(m.conf.MongoDbName).Collection(m.collectionName)
+	filter := bson.M{"deleted": true, "sessionId": sessionId, "userId": userId}
+	update := bson.M{"$set": bson.M{"deleted": false}, "$unset": bson.M{"deletedAt": ""}}
+	ctx, cancel := util.GetTimeoutContext(m.conf.TimeoutSecond)
+	defer cancel()
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.Join(err, m.err)
+	}
+	if result.MatchedCount == 0 {
+		return errors.Join(mongo.ErrNoDocuments, m.err)
+	}
+	return nil
+}
+
+// PurgeBySessionId hard deletes the session in the trash
+func (m *Message) PurgeBySessionId(sessionId, userId string) error {
+	collection := m.client.Database(m.conf.MongoDbName).Collection(m.collectionName)
+	filter := bson.M{"deleted": true, "sessionId": sessionId, "userId": userId}
+	ctx, cancel := util.GetTimeoutContext(m.conf.TimeoutSecond)
+	defer cancel()
+	result, err := collection.DeleteOne(ctx, filter)
+	if err != nil {
+		return errors.Join(err, m.err)
+	}
+	if result.DeletedCount == 0 {
+		return errors.Join(mongo.ErrNoDocuments, m.err)
+	}
+	return nil
+}
+
+// UpsertDraft automatically saves the messages of the user's unsaved session, a saved session is never touched,
+// a new session is inserted as unsaved and replaces the user's previous unsaved one, which is moved into the trash
+func (m *Message) UpsertDraft(message *Message) error {
+	if err := m.checkInput(message); err != nil {
+		return err
+	}
+	collection := m.client.Database(m.conf.MongoDbName).Collection(m.collectionName)
+	filter := bson.M{"deleted": false, "sessionId": message.SessionId, "userId": message.UserId, "saved": false}
+	update := bson.M{"$set": bson.M{
+		"timestamp": message.Timestamp,
+		"messages":  message.Messages,
+		"modelId":   message.ModelId,
+	}}
+	ctx, cancel := util.GetTimeoutContext(m.conf.TimeoutSecond)
+	defer cancel()
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.Join(err, m.err)
+	}
+	if result.MatchedCount > 0 {
+		return nil
+	}
+	count, err := collection.CountDocuments(ctx, bson.M{"deleted": false, "sessionId": message.SessionId})
+	if err != nil {
+		return errors.Join(err, m.err)
+	}
+	if count > 0 {
+		return errors.Join(errors.New("the session is saved or owned by someone else"), m.err)
+	}
+	// only the last unsaved session is kept
+	previous := new(Message)
+	filter = bson.M{"deleted": false, "userId": message.UserId, "saved": false}
+	opts := options.FindOne().SetSort(bson.D{{Key: "timestamp", Value: -1}}).SetProjection(bson.M{"_id": 1})
+	if err := collection.FindOne(ctx, filter, opts).Decode(previous); err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return errors.Join(err, m.err)
+	}
+	message.Title = ""
+	message.Saved = false
+	if message.TagIds == nil {
+		message.TagIds = make([]string, 0)
+	}
+	if _, err := collection.InsertOne(ctx, message); err != nil {
+		return errors.Join(err, m.err)
+	}
+	if previous.Id.IsZero() {
+		return nil
+	}
+	update = bson.M{"$set": bson.M{"deleted": true, "deletedAt": message.Timestamp}}
+	if _, err := collection.UpdateOne(ctx, bson.M{"_id": previous.Id, "saved": false}, update); err != nil {
+		return errors.Join(err, m.err)
+	}
+	return nil
+}
+
+// UpdateMessages replaces the messages of the session owned by the user, the messages must not come from the client
+func (m *Message) UpdateMessages(sessionId, userId string, messages []*ChatMessage, timestamp int64, modelId int) error {
+	return m.updateOwned(sessionId, userId, bson.M{"$set": bson.M{
+		"timestamp": timestamp,
+		"messages":  messages,
+		"modelId":   modelId,
+	}})
+}
+
+// UpdateSaved marks the user's unsaved session as saved, an empty title keeps the current one
+func (m *Message) UpdateSaved(sessionId, userId, title string) error {
+	collection := m.client.Database(m.conf.MongoDbName).Collection(m.collectionName)
+	filter := bson.M{"deleted": false, "sessionId": sessionId, "userId": userId, "saved": false}
+	set := bson.M{"saved": true}
+	if title != "" {
+		set["title"] = title
+	}
+	update := bson.M{"$set": set}
+	ctx, cancel := util.GetTimeoutContext(m.conf.TimeoutSecond)
+	defer cancel()
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.Join(err, m.err)
+	}
+	if result.MatchedCount == 0 {
+		return errors.Join(mongo.ErrNoDocuments, m.err)
+	}
+	return nil
+}
+
+func (m *Message) UpdateShared(sessionId, userId string, shared bool) error {
+	collection := m.client.Database(m.conf.MongoDbName).Collection(m.collectionName)
+	filter := bson.M{"deleted": false, "sessionId": sessionId, "userId": userId}
+	update := bson.M{"$set": bson.M{"shared": shared}}
+	ctx, cancel := util.GetTimeoutContext(m.conf.TimeoutSecond)
+	defer cancel()
+	if _, err := collection.UpdateOne(ctx, filter, update); err != nil {
+		return errors.Join(err, m.err)
+	}
+	return nil
+}
+
+// UpsertTitle sets the title of the session owned by the user,
+// an unsaved placeholder is created if the session doesn't exist yet
+func (m *Message) UpsertTitle(message *Message) error {
+	if message == nil || message.UserId == "" || message.SessionId == "" || message.Title == "" ||
+		message.Timestamp <= 0 || message.ModelId <= 0 {
+		return errors.Join(errors.New("upsert title invalid input"), m.err)
+	}
+	collection := m.client.Database(m.conf.MongoDbName).Collection(m.collectionName)
+	filter := bson.M{"deleted": false, "sessionId": message.SessionId, "userId": message.UserId}
+	update := bson.M{
+		"$set": bson.M{"title": message.Title},
+		"$setOnInsert": bson.M{
+			"timestamp": message.Timestamp,
+			"messages":  bson.A{},
+			"modelId":   message.ModelId,
+			"shared":    false,
+			"saved":     false,
+			"folderId":  "",
+			"tagIds":    bson.A{},
+			"pinned":    false,
+		},
+	}
+	opts := options.Update().SetUpsert(true)
+	ctx, cancel := util.GetTimeoutContext(m.conf.TimeoutSecond)
+	defer cancel()
+	_, err := collection.UpdateOne(ctx, filter, update, opts)
+	return errors.Join(err, m.err)
+}
+
+// UpdateFolder moves the session owned by the user into the folder, an empty folder ID removes it from its folder
+func (m *Message) UpdateFolder(sessionId, userId, folderId string) error {
+	return m.updateOwned(sessionId, userId, bson.M{"$set": bson.M{"folderId": folderId}})
+}
+
+func (m *Message) UpdateTags(sessionId, userId string, tagIds []string) error {
+	return m.updateOwned(sessionId, userId, bson.M{"$set": bson.M{"tagIds": tagIds}})
+}
+
+func (m *Message) UpdatePinned(sessionId, userId string, pinned bool) error {
+	return m.updateOwned(sessionId, userId, bson.M{"$set": bson.M{"pinned": pinned}})
+}
+
+func (m *Message) UpdateLibrary(sessionId, userId, libraryId string) error {
+	return m.updateOwned(sessionId, userId, bson.M{"$set": bson.M{"libraryId": libraryId}})
+}
+
+// UpdateSettings replaces the settings, the library is part of the retrieval settings
+func (m *Message) UpdateSettings(sessionId, userId, libraryId string, settings *SessionSettings) error {
+	return m.updateOwned(sessionId, userId, bson.M{"$set": bson.M{"settings": settings, "libraryId": libraryId}})
+}
+
+// RemovePersona unsets the deleted persona from all the user's session settings
+func (m *Message) RemovePersona(userId, personaId string) error {
+	collection := m.client.Database(m.conf.MongoDbName).Collection(m.collectionName)
+	ctx, cancel := util.GetTimeoutContext(m.conf.TimeoutSecond)
+	defer cancel()
+	filter := bson.M{"userId": userId, "settings.personaId": personaId}
+	if _, err := collection.UpdateMany(ctx, filter, bson.M{"$unset": bson.M{"settings.personaId": ""}}); err != nil {
+		return errors.Join(err, m.err)
+	}
+	return nil
+}
+
+// RemoveLibrary detaches the deleted library from all the user's sessions
+func (m *Message) RemoveLibrary(userId, libraryId string) error {
+	collection := m.client.Database(m.conf.MongoDbName).Collection(m.collectionName)
+	ctx, cancel := util.GetTimeoutContext(m.conf.TimeoutSecond)
+	defer cancel()
+	filter := bson.M{"userId": userId, "libraryId": libraryId}
+	if _, err := collection.UpdateMany(ctx, filter, bson.M{"$unset": bson.M{"libraryId": ""}}); err != nil {
+		return errors.Join(err, m.err)
+	}
+	return nil
+}
+
+// RemoveLabel takes the deleted folder or tag off all the user's sessions
+func (m *Message) RemoveLabel(userId, labelId string) error {
+	collection := m.client.Database(m.conf.MongoDbName).Collection(m.collectionName)
+	ctx, cancel := util.GetTimeoutContext(m.conf.TimeoutSecond)
+	defer cancel()
+	filter := bson.M{"userId": userId, "folderId": labelId}
+	if _, err := collection.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"folderId": ""}}); err != nil {
+		return errors.Join(err, m.err)
+	}
+	filter = bson.M{"userId": userId, "tagIds": labelId}
+	if _, err := collection.UpdateMany(ctx, filter, bson.M{"$pull": bson.M{"tagIds": labelId}}); err != nil {
+		return errors.Join(err, m.err)
+	}
+	return nil
+}
+
+func (m *Message) updateOwned(sessionId, userId string, update bson.M) error {
+	collection := m.client.Database(m.conf.MongoDbName).Collection(m.collectionName)
+	filter := bson.M{"deleted": false, "sessionId": sessionId, "userId": userId}
+	ctx, cancel := util.GetTimeoutContext(m.conf.TimeoutSecond)
+	defer cancel()
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.Join(err, m.err)
+	}
+	if result.MatchedCount == 0 {
+		return errors.Join(mongo.ErrNoDocuments, m.err)
+	}
+	return nil
+}
+
+// UpdateMessage replaces the message with the same ID in the session owned by the user
+func (m *Message) UpdateMessage(sessionId, userId string, message *ChatMessage) error {
+	collection := m.client.Database(m.conf.MongoDbName).Collection(m.collectionName)
+	filter := bson.M{"deleted": false, "sessionId": sessionId, "userId": userId, "messages.id": message.Id}
+	update := bson.M{"$set": bson.M{"messages.$": message}}
+	ctx, cancel := util.GetTimeoutContext(m.conf.TimeoutSecond)
+	defer cancel()
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.Join(err, m.err)
+	}
+	if result.MatchedCount == 0 {
+		return errors.Join(mongo.ErrNoDocuments, m.err)
+	}
+	return nil
+}
+
+// UpdateTitle renames the session owned by the user
+func (m *Message) UpdateTitle(sessionId, userId, title string) error {
+	collection := m.client.Database(m.conf.MongoDbName).Collection(m.collectionName)
+	filter := bson.M{"deleted": false, "sessionId": sessionId, "userId": userId}
+	update := bson.M{"$set": bson.M{"title": title}}
+	ctx, cancel := util.GetTimeoutContext(m.conf.TimeoutSecond)
+	defer cancel()
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.Join(err, m.err)
+	}
+	if result.MatchedCount == 0 {
+		return errors.Join(mongo.ErrNoDocuments, m.err)
+	}
+	return nil
+}
+
+func (m *Message) find(ctx context.Context, collection *mongo.Collection, filter bson.M, opts *options.FindOptions) ([]*Message, error) {
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.Join(err, m.err)
+	}
+	result := make([]*Message, 0)
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, errors.Join(err, m.err)
+	}
+	return result, nil
+}
+
 func (m *Message) checkInput(message *Message) error {
-	if message == nil || message.UserId == "" || message.SessionId == "" || message.Messages == "" ||
+	if message == nil || message.UserId == "" || message.SessionId == "" || len(message.Messages) == 0 ||
 		message.Timestamp <= 0 || message.ModelId <= 0 {
 		return errors.Join(errors.New("insert invalid input"), m.err)
 	}
@@ -0,0 +1,264 @@
+package dal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/zenpk/chatbone/util"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// legacyMessage is the format of the messages stored as a JSON string
+type legacyMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// legacyDocument is a session or share snapshot with the messages stored as a JSON string
+type legacyDocument struct {
+	Id        primitive.ObjectID `bson:"_id"`
+	Timestamp int64              `bson:"timestamp"`
+	Messages  string             `bson:"messages"`
+}
+
+// MigrateMessages converts the messages of the sessions and share snapshots stored as JSON strings
+// into structured documents in place, every converted document is read back and compared,
+// it's safe to run again after a failure since only the remaining strings are converted
+func (d *Database) MigrateMessages() error {
+	targets := []struct {
+		name       string
+		collection *mongo.Collection
+		unset      bson.M
+	}{
+		{"message", d.Message.client.Database(d.Message.conf.MongoDbName).Collection(d.Message.collectionName), bson.M{"texts": ""}},
+		{"share", d.Share.client.Database(d.Share.conf.MongoDbName).Collection(d.Share.collectionName), nil},
+	}
+	for _, target := range targets {
+		count, err := migrateCollection(d.Message.conf, target.collection, target.unset)
+		if err != nil {
+			return fmt.Errorf("migrate %v: %w", target.name, err)
+		}
+		d.Message.logger.Printf("migrated %v %v documents\n", count, target.name)
+		left, err := countLegacy(d.Message.conf, target.collection)
+		if err != nil {
+			return fmt.Errorf("verify %v: %w", target.name, err)
+		}
+		if left > 0 {
+			return fmt.Errorf("verify %v: %v documents are left unconverted", target.name, left)
+		}
+	}
+	// only one text index is allowed, the one over the plain texts is replaced
+	collection := targets[0].collection
+	ctx := context.Background()
+	specs, err := collection.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return fmt.Errorf("migrate message index: %w", err)
+	}
+	for _, spec := range specs {
+		if spec.Name == "title_text_texts_text" {
+			if _, err := collection.Indexes().DropOne(ctx, spec.Name); err != nil {
+				return fmt.Errorf("migrate message index: %w", err)
+			}
+		}
+	}
+	if _, err := collection.Indexes().CreateOne(ctx, messageTextIndex()); err != nil {
+		return fmt.Errorf("migrate message index: %w", err)
+	}
+	return nil
+}
+
+// MigratePinned sets the field on the sessions saved before pinning existed, which would break the page order
+func (d *Database) MigratePinned() error {
+	collection := d.Message.client.Database(d.Message.conf.MongoDbName).Collection(d.Message.collectionName)
+	// the update runs over the whole collection, it isn't bounded by the request timeout
+	ctx := context.Background()
+	result, err := collection.UpdateMany(ctx, bson.M{"pinned": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"pinned": false}})
+	if err != nil {
+		return fmt.Errorf("migrate pinned: %w", err)
+	}
+	d.Message.logger.Printf("migrated %v pinned documents\n", result.ModifiedCount)
+	return nil
+}
+
+// MigrateUsers removes the users inserted twice before the ID index was unique and replaces the old index,
+// the oldest document is kept since the balance updates matched it first, it's safe to run again
+func (d *Database) MigrateUsers() error {
+	collection := d.User.client.Database(d.User.conf.MongoDbName).Collection(d.User.collectionName)
+	// the aggregation runs over the whole collection, it isn't bounded by the request timeout
+	ctx := context.Background()
+	pipeline := mongo.Pipeline{
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   "$id",
+			"ids":   bson.M{"$push": "$_id"},
+			"count": bson.M{"$sum": 1},
+		}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+	}
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return fmt.Errorf("migrate users: %w", err)
+	}
+	duplicates := make([]struct {
+		UserId string               `bson:"_id"`
+		Ids    []primitive.ObjectID `bson:"ids"`
+	}, 0)
+	if err := cursor.All(ctx, &duplicates); err != nil {
+		return fmt.Errorf("migrate users: %w", err)
+	}
+	removed := int64(0)
+	for _, duplicate := range duplicates {
+		result, err := collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": duplicate.Ids[1:]}})
+		if err != nil {
+			return fmt.Errorf("migrate user %v: %w", duplicate.UserId, err)
+		}
+		removed += result.DeletedCount
+	}
+	d.User.logger.Printf("removed %v duplicate users\n", removed)
+	specs, err := collection.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return fmt.Errorf("migrate user index: %w", err)
+	}
+	for _, spec := range specs {
+		if spec.Name == "id_1" && (spec.Unique == nil || !*spec.Unique) {
+			if _, err := collection.Indexes().DropOne(ctx, spec.Name); err != nil {
+				return fmt.Errorf("migrate user index: %w", err)
+			}
+		}
+	}
+	mod := mongo.IndexModel{
+		Keys:    bson.D{{Key: "id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+	if _, err := collection.Indexes().CreateOne(ctx, mod); err != nil {
+		return fmt.Errorf("migrate user index: %w", err)
+	}
+	return nil
+}
+
+// legacyHistoryKeys are the keys the history was stored with before it had bson tags
+var legacyHistoryKeys = bson.M{
+	"sessionid":     "sessionId",
+	"userid":        "userId",
+	"modelid":       "modelId",
+	"intokencount":  "inTokenCount",
+	"outtokencount": "outTokenCount",
+}
+
+// MigrateHistory renames the lower-cased keys of the history records, it's safe to run again
+func (d *Database) MigrateHistory() error {
+	collection := d.History.client.Database(d.History.conf.MongoDbName).Collection(d.History.collectionName)
+	legacy := make(bson.A, 0, len(legacyHistoryKeys))
+	for key := range legacyHistoryKeys {
+		legacy = append(legacy, bson.M{key: bson.M{"$exists": true}})
+	}
+	filter := bson.M{"$or": legacy}
+	// the rename runs over the whole collection, it isn't bounded by the request timeout
+	ctx := context.Background()
+	result, err := collection.UpdateMany(ctx, filter, bson.M{"$rename": legacyHistoryKeys})
+	if err != nil {
+		return fmt.Errorf("migrate history: %w", err)
+	}
+	d.History.logger.Printf("migrated %v history documents\n", result.ModifiedCount)
+	left, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return fmt.Errorf("verify history: %w", err)
+	}
+	if left > 0 {
+		return fmt.Errorf("verify history: %v documents are left with the old keys", left)
+	}
+	return nil
+}
+
+func migrateCollection(conf *util.Configuration, collection *mongo.Collection, unset bson.M) (int, error) {
+	filter := bson.M{"messages": bson.M{"$type": "string"}}
+	// the cursor has to stay open for the whole collection, the updates use their own timeouts
+	ctx := context.Background()
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+	count := 0
+	for cursor.Next(ctx) {
+		legacy := new(legacyDocument)
+		if err := cursor.Decode(legacy); err != nil {
+			return count, err
+		}
+		messages, err := convertLegacyMessages(legacy.Messages, legacy.Timestamp)
+		if err != nil {
+			return count, fmt.Errorf("document %v: %w", legacy.Id.Hex(), err)
+		}
+		if err := replaceLegacyMessages(conf, collection, legacy, messages, unset); err != nil {
+			return count, fmt.Errorf("document %v: %w", legacy.Id.Hex(), err)
+		}
+		count++
+	}
+	return count, cursor.Err()
+}
+
+// replaceLegacyMessages updates the document only if it hasn't changed since it was read, then verifies it
+func replaceLegacyMessages(conf *util.Configuration, collection *mongo.Collection, legacy *legacyDocument,
+	messages []*ChatMessage, unset bson.M,
+) error {
+	ctx, cancel := util.GetTimeoutContext(conf.TimeoutSecond)
+	defer cancel()
+	update := bson.M{"$set": bson.M{"messages": messages}}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	filter := bson.M{"_id": legacy.Id, "messages": legacy.Messages}
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errors.New("changed during the migration")
+	}
+	converted := new(struct {
+		Messages []*ChatMessage `bson:"messages"`
+	})
+	if err := collection.FindOne(ctx, bson.M{"_id": legacy.Id}).Decode(converted); err != nil {
+		return err
+	}
+	if len(converted.Messages) != len(messages) {
+		return errors.New("message count mismatch after the migration")
+	}
+	for i, message := range converted.Messages {
+		if message.Id != messages[i].Id || message.Role != messages[i].Role || message.Text() != messages[i].Text() {
+			return fmt.Errorf("message %v mismatch after the migration", i)
+		}
+	}
+	return nil
+}
+
+func countLegacy(conf *util.Configuration, collection *mongo.Collection) (int64, error) {
+	ctx, cancel := util.GetTimeoutContext(conf.TimeoutSecond)
+	defer cancel()
+	return collection.CountDocuments(ctx, bson.M{"messages": bson.M{"$type": "string"}})
+}
+
+// convertLegacyMessages parses the JSON string, an empty one is a session without messages yet
+func convertLegacyMessages(raw string, timestamp int64) ([]*ChatMessage, error) {
+	messages := make([]*ChatMessage, 0)
+	if raw == "" {
+		return messages, nil
+	}
+	legacy := make([]legacyMessage, 0)
+	if err := json.Unmarshal([]byte(raw), &legacy); err != nil {
+		return nil, err
+	}
+	for _, message := range legacy {
+		id, err := util.RandomString(12)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, TextMessage(id, message.Role, message.Content, timestamp))
+	}
+	return messages, nil
+}
@@ -8,8 +8,12 @@ type Model struct {
 	InRate       float64 `json:"inRate"`
 	OutRate      float64 `json:"outRate"`
 	SupportImage bool    `json:"supportImage"`
+	Embedding    bool    `json:"embedding"` // embedding models can't chat
+	Dimension    int     `json:"dimension,omitempty"`
+	MaxOutTokens int     `json:"maxOutTokens,omitempty"` // the completion limit, held in full if the request doesn't set one
 
 	hardcoded []*Model
+	embedding []*Model
 }
 
 func newModel() (*Model, error) {
@@ -22,6 +26,7 @@ func newModel() (*Model, error) {
 		InRate:       0.00001,
 		OutRate:      0.00003,
 		SupportImage: false,
+		MaxOutTokens: 4096,
 	}, &Model{
 		Id:           ModelIdOpenAiGpt35,
 		Name:         "gpt-3.5-turbo",
@@ -30,10 +35,21 @@ func newModel() (*Model, error) {
 		InRate:       0.0000005,
 		OutRate:      0.0000015,
 		SupportImage: false,
+		MaxOutTokens: 4096,
+	})
+	m.embedding = append(m.embedding, &Model{
+		Id:        ModelIdOpenAiEmbedding3Small,
+		Name:      "text-embedding-3-small",
+		Encoding:  "cl100k_base",
+		Provider:  ProviderOpenAi,
+		InRate:    0.00000002,
+		Embedding: true,
+		Dimension: 1536,
 	})
 	return m, nil
 }
 
+// SelectAll returns the chat models
 func (m *Model) SelectAll() ([]*Model, error) {
 	return m.hardcoded, nil
 }
@@ -44,5 +60,31 @@ func (m *Model) SelectById(id int) (*Model, error) {
 			return v, nil
 		}
 	}
+	for _, v := range m.embedding {
+		if v.Id == id {
+			return v, nil
+		}
+	}
 	return nil, nil
 }
+
+// Parameters are the optional generation parameters, zero values fall back to the provider defaults
+type Parameters struct {
+	Temperature *float64 `bson:"temperature,omitempty" json:"temperature,omitempty"`
+	TopP        *float64 `bson:"topP,omitempty" json:"topP,omitempty"`
+	MaxTokens   int      `bson:"maxTokens,omitempty" json:"maxTokens,omitempty"`
+}
+
+// Merge fills the unset parameters with the fallback ones
+func (p Parameters) Merge(fallback Parameters) Parameters {
+	if p.Temperature == nil {
+		p.Temperature = fallback.Temperature
+	}
+	if p.TopP == nil {
+		p.TopP = fallback.TopP
+	}
+	if p.MaxTokens == 0 {
+		p.MaxTokens = fallback.MaxTokens
+	}
+	return p
+}
@@ -0,0 +1,87 @@
+package dal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	PageSizeDefault = 20
+	PageSizeMax     = 100
+)
+
+var ErrInvalidCursor = errors.New("invalid page cursor")
+
+// Page requests the documents after the cursor, an empty cursor means the first page
+type Page struct {
+	Cursor string
+	Size   int64 // 0 means the default size, capped at PageSizeMax
+}
+
+func (p *Page) size() int64 {
+	if p == nil || p.Size <= 0 {
+		return PageSizeDefault
+	}
+	return min(p.Size, PageSizeMax)
+}
+
+// pageCursor is the position of the last document of a page,
+// pages are in the descending order of (pinned, key, _id) so equal keys are still stable
+type pageCursor struct {
+	Pinned bool               `json:"p,omitempty"`
+	Key    int64              `json:"k"`
+	Id     primitive.ObjectID `json:"i"`
+}
+
+func (p *Page) decode() (*pageCursor, error) {
+	if p == nil || p.Cursor == "" {
+		return nil, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(p.Cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	cursor := new(pageCursor)
+	if err := json.Unmarshal(raw, cursor); err != nil || cursor.Id.IsZero() {
+		return nil, ErrInvalidCursor
+	}
+	return cursor, nil
+}
+
+func (c *pageCursor) encode() string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// after matches the documents after the cursor in the descending order of (key, _id)
+func (c *pageCursor) after(key string) bson.M {
+	return bson.M{"$or": bson.A{
+		bson.M{key: bson.M{"$lt": c.Key}},
+		bson.M{key: c.Key, "_id": bson.M{"$lt": c.Id}},
+	}}
+}
+
+// afterPinned is after with the pinned documents ordered first
+func (c *pageCursor) afterPinned(key string) bson.M {
+	if c.Pinned {
+		return bson.M{"$or": bson.A{
+			bson.M{"$and": bson.A{bson.M{"pinned": true}, c.after(key)}},
+			bson.M{"pinned": false},
+		}}
+	}
+	return bson.M{"$and": bson.A{bson.M{"pinned": false}, c.after(key)}}
+}
+
+// nextPage trims the extra document fetched to tell if there's a next page,
+// the returned cursor is empty on the last page
+func nextPage[T any](items []T, size int64, cursorOf func(T) *pageCursor) ([]T, string) {
+	if int64(len(items)) <= size {
+		return items, ""
+	}
+	items = items[:size]
+	return items, cursorOf(items[size-1]).encode()
+}
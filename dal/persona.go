@@ -0,0 +1,150 @@
+package dal
+
+import (
+	"errors"
+
+	"github.com/zenpk/chatbone/util"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Persona is a saved system prompt with its default model and parameters
+type Persona struct {
+	Id           string     `bson:"id" json:"id"`
+	UserId       string     `bson:"userId" json:"-"` // uuid
+	Timestamp    int64      `bson:"timestamp" json:"timestamp"`
+	Name         string     `bson:"name" json:"name"`
+	SystemPrompt string     `bson:"systemPrompt" json:"systemPrompt"`
+	ModelId      int        `bson:"modelId" json:"modelId"` // 0 means no default model
+	Parameters   Parameters `bson:"parameters" json:"parameters"`
+
+	conf           *util.Configuration
+	logger         util.ILogger
+	client         *mongo.Client
+	collectionName string
+	err            error
+}
+
+func newPersona(conf *util.Configuration, client *mongo.Client, logger util.ILogger) (*Persona, error) {
+	p := new(Persona)
+	p.conf = conf
+	p.logger = logger
+	p.client = client
+	p.collectionName = "persona"
+	p.err = errors.New("at Persona table")
+	ctx, cancel := util.GetTimeoutContext(p.conf.TimeoutSecond)
+	defer cancel()
+	collection := p.client.Database(p.conf.MongoDbName).Collection(p.collectionName)
+	mod := mongo.IndexModel{
+		Keys: bson.M{"id": "hashed"},
+	}
+	_, err := collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, p.err)
+	}
+	mod = mongo.IndexModel{
+		Keys: bson.D{{Key: "userId", Value: 1}, {Key: "timestamp", Value: -1}},
+	}
+	_, err = collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, p.err)
+	}
+	return p, nil
+}
+
+func (p *Persona) SelectById(id string) (*Persona, error) {
+	collection := p.client.Database(p.conf.MongoDbName).Collection(p.collectionName)
+	filter := bson.M{"id": id}
+	result := new(Persona)
+	ctx, cancel := util.GetTimeoutContext(p.conf.TimeoutSecond)
+	defer cancel()
+	if err := collection.FindOne(ctx, filter).Decode(result); err != nil {
+		return nil, errors.Join(err, p.err)
+	}
+	return result, nil
+}
+
+func (p *Persona) SelectByUserId(userId string) ([]*Persona, error) {
+	collection := p.client.Database(p.conf.MongoDbName).Collection(p.collectionName)
+	filter := bson.M{"userId": userId}
+	ctx, cancel := util.GetTimeoutContext(p.conf.TimeoutSecond)
+	defer cancel()
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: -1}})
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.Join(err, p.err)
+	}
+	result := make([]*Persona, 0)
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, errors.Join(err, p.err)
+	}
+	return result, nil
+}
+
+func (p *Persona) CountByUserId(userId string) (int64, error) {
+	collection := p.client.Database(p.conf.MongoDbName).Collection(p.collectionName)
+	filter := bson.M{"userId": userId}
+	ctx, cancel := util.GetTimeoutContext(p.conf.TimeoutSecond)
+	defer cancel()
+	count, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return 0, errors.Join(err, p.err)
+	}
+	return count, nil
+}
+
+func (p *Persona) Insert(persona *Persona) error {
+	if err := p.checkInput(persona); err != nil {
+		return err
+	}
+	collection := p.client.Database(p.conf.MongoDbName).Collection(p.collectionName)
+	ctx, cancel := util.GetTimeoutContext(p.conf.TimeoutSecond)
+	defer cancel()
+	if _, err := collection.InsertOne(ctx, persona); err != nil {
+		return errors.Join(err, p.err)
+	}
+	return nil
+}
+
+// ReplaceById only replaces the persona owned by the same user
+func (p *Persona) ReplaceById(persona *Persona) error {
+	if err := p.checkInput(persona); err != nil {
+		return err
+	}
+	collection := p.client.Database(p.conf.MongoDbName).Collection(p.collectionName)
+	filter := bson.M{"id": persona.Id, "userId": persona.UserId}
+	ctx, cancel := util.GetTimeoutContext(p.conf.TimeoutSecond)
+	defer cancel()
+	result, err := collection.ReplaceOne(ctx, filter, persona)
+	if err != nil {
+		return errors.Join(err, p.err)
+	}
+	if result.MatchedCount == 0 {
+		return errors.Join(mongo.ErrNoDocuments, p.err)
+	}
+	return nil
+}
+
+func (p *Persona) DeleteById(id, userId string) error {
+	collection := p.client.Database(p.conf.MongoDbName).Collection(p.collectionName)
+	filter := bson.M{"id": id, "userId": userId}
+	ctx, cancel := util.GetTimeoutContext(p.conf.TimeoutSecond)
+	defer cancel()
+	result, err := collection.DeleteOne(ctx, filter)
+	if err != nil {
+		return errors.Join(err, p.err)
+	}
+	if result.DeletedCount == 0 {
+		return errors.Join(mongo.ErrNoDocuments, p.err)
+	}
+	return nil
+}
+
+func (p *Persona) checkInput(persona *Persona) error {
+	if persona == nil || persona.Id == "" || persona.UserId == "" || persona.Name == "" ||
+		persona.SystemPrompt == "" || persona.Timestamp <= 0 || persona.ModelId < 0 {
+		return errors.Join(errors.New("insert invalid input"), p.err)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package dal
+
+import (
+	"errors"
+	"time"
+
+	"github.com/zenpk/chatbone/util"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Presence is a live subscription to a session on any instance,
+// it expires unless it's refreshed, so the ones left by a crashed instance go away by themselves
+type Presence struct {
+	Id        string    `bson:"id" json:"id"` // the subscription
+	SessionId string    `bson:"sessionId" json:"sessionId"`
+	UserId    string    `bson:"userId" json:"userId"` // uuid
+	ExpireAt  time.Time `bson:"expireAt" json:"expireAt"`
+
+	conf           *util.Configuration
+	logger         util.ILogger
+	client         *mongo.Client
+	collectionName string
+	err            error
+}
+
+func newPresence(conf *util.Configuration, client *mongo.Client, logger util.ILogger) (*Presence, error) {
+	p := new(Presence)
+	p.conf = conf
+	p.logger = logger
+	p.client = client
+	p.collectionName = "presence"
+	p.err = errors.New("at Presence table")
+	ctx, cancel := util.GetTimeoutContext(p.conf.TimeoutSecond)
+	defer cancel()
+	collection := p.client.Database(p.conf.MongoDbName).Collection(p.collectionName)
+	mod := mongo.IndexModel{
+		Keys:    bson.D{{Key: "id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+	_, err := collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, p.err)
+	}
+	mod = mongo.IndexModel{
+		Keys: bson.D{{Key: "sessionId", Value: 1}},
+	}
+	_, err = collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, p.err)
+	}
+	mod = mongo.IndexModel{
+		Keys:    bson.D{{Key: "expireAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	}
+	_, err = collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, p.err)
+	}
+	return p, nil
+}
+
+// SelectUserIdsBySessionId returns the distinct users online in the session,
+// the expired ones are skipped since the TTL monitor only runs every minute
+func (p *Presence) SelectUserIdsBySessionId(sessionId string) ([]string, error) {
+	collection := p.client.Database(p.conf.MongoDbName).Collection(p.collectionName)
+	filter := bson.M{"sessionId": sessionId, "expireAt": bson.M{"$gt": time.Now()}}
+	ctx, cancel := util.GetTimeoutContext(p.conf.TimeoutSecond)
+	defer cancel()
+	values, err := collection.Distinct(ctx, "userId", filter)
+	if err != nil {
+		return nil, errors.Join(err, p.err)
+	}
+	result := make([]string, 0, len(values))
+	for _, value := range values {
+		if userId, ok := value.(string); ok {
+			result = append(result, userId)
+		}
+	}
+	return result, nil
+}
+
+// Upsert adds the subscription or pushes back its expiry
+func (p *Presence) Upsert(presence *Presence) error {
+	if presence == nil || presence.Id == "" || presence.SessionId == "" || presence.UserId == "" ||
+		presence.ExpireAt.IsZero() {
+		return errors.Join(errors.New("upsert invalid input"), p.err)
+	}
+	collection := p.client.Database(p.conf.MongoDbName).Collection(p.collectionName)
+	filter := bson.M{"id": presence.Id}
+	update := bson.M{"$set": bson.M{
+		"sessionId": presence.SessionId,
+		"userId":    presence.UserId,
+		"expireAt":  presence.ExpireAt,
+	}}
+	opts := options.Update().SetUpsert(true)
+	ctx, cancel := util.GetTimeoutContext(p.conf.TimeoutSecond)
+	defer cancel()
+	if _, err := collection.UpdateOne(ctx, filter, update, opts); err != nil {
+		return errors.Join(err, p.err)
+	}
+	return nil
+}
+
+func (p *Presence) DeleteById(id string) error {
+	collection := p.client.Database(p.conf.MongoDbName).Collection(p.collectionName)
+	filter := bson.M{"id": id}
+	ctx, cancel := util.GetTimeoutContext(p.conf.TimeoutSecond)
+	defer cancel()
+	if _, err := collection.DeleteOne(ctx, filter); err != nil {
+		return errors.Join(err, p.err)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package dal
+
+import (
+	"errors"
+
+	"github.com/zenpk/chatbone/util"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Share is a public read-only link to a session
+type Share struct {
+	Token        string         `bson:"token" json:"token"`
+	SessionId    string         `bson:"sessionId" json:"sessionId"`
+	UserId       string         `bson:"userId" json:"-"` // uuid
+	Timestamp    int64          `bson:"timestamp" json:"timestamp"`
+	ExpireAt     int64          `bson:"expireAt" json:"expireAt"` // 0 means never
+	PasswordHash string         `bson:"passwordHash" json:"-"`    // bcrypt, empty means no password
+	Snapshot     bool           `bson:"snapshot" json:"snapshot"` // if false, the live session is shown
+	Title        string         `bson:"title" json:"title"`       // only for snapshots
+	ModelId      int            `bson:"modelId" json:"modelId"`   // only for snapshots
+	Messages     []*ChatMessage `bson:"messages" json:"-"`        // only for snapshots
+
+	conf           *util.Configuration
+	logger         util.ILogger
+	client         *mongo.Client
+	collectionName string
+	err            error
+}
+
+func newShare(conf *util.Configuration, client *mongo.Client, logger util.ILogger) (*Share, error) {
+	s := new(Share)
+	s.conf = conf
+	s.logger = logger
+	s.client = client
+	s.collectionName = "share"
+	s.err = errors.New("at Share table")
+	ctx, cancel := util.GetTimeoutContext(s.conf.TimeoutSecond)
+	defer cancel()
+	collection := s.client.Database(s.conf.MongoDbName).Collection(s.collectionName)
+	mod := mongo.IndexModel{
+		Keys: bson.M{"token": "hashed"},
+	}
+	_, err := collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, s.err)
+	}
+	mod = mongo.IndexModel{
+		Keys: bson.M{"sessionId": "hashed"},
+	}
+	_, err = collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, s.err)
+	}
+	return s, nil
+}
+
+func (s *Share) SelectByToken(token string) (*Share, error) {
+	collection := s.client.Database(s.conf.MongoDbName).Collection(s.collectionName)
+	filter := bson.M{"token": token}
+	result := new(Share)
+	ctx, cancel := util.GetTimeoutContext(s.conf.TimeoutSecond)
+	defer cancel()
+	if err := collection.FindOne(ctx, filter).Decode(result); err != nil {
+		return nil, errors.Join(err, s.err)
+	}
+	return result, nil
+}
+
+// SelectBySessionId doesn't return the snapshot messages
+func (s *Share) SelectBySessionId(sessionId string) ([]*Share, error) {
+	collection := s.client.Database(s.conf.MongoDbName).Collection(s.collectionName)
+	filter := bson.M{"sessionId": sessionId}
+	ctx, cancel := util.GetTimeoutContext(s.conf.TimeoutSecond)
+	defer cancel()
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: -1}}).SetProjection(bson.M{"messages": 0})
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.Join(err, s.err)
+	}
+	result := make([]*Share, 0)
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, errors.Join(err, s.err)
+	}
+	return result, nil
+}
+
+func (s *Share) Insert(share *Share) error {
+	if share == nil || share.Token == "" || share.SessionId == "" || share.UserId == "" || share.Timestamp <= 0 ||
+		(share.Snapshot && len(share.Messages) == 0) {
+		return errors.Join(errors.New("insert invalid input"), s.err)
+	}
+	collection := s.client.Database(s.conf.MongoDbName).Collection(s.collectionName)
+	ctx, cancel := util.GetTimeoutContext(s.conf.TimeoutSecond)
+	defer cancel()
+	if _, err := collection.InsertOne(ctx, share); err != nil {
+		return errors.Join(err, s.err)
+	}
+	return nil
+}
+
+func (s *Share) DeleteByToken(token, userId string) error {
+	collection := s.client.Database(s.conf.MongoDbName).Collection(s.collectionName)
+	filter := bson.M{"token": token, "userId": userId}
+	ctx, cancel := util.GetTimeoutContext(s.conf.TimeoutSecond)
+	defer cancel()
+	result, err := collection.DeleteOne(ctx, filter)
+	if err != nil {
+		return errors.Join(err, s.err)
+	}
+	if result.DeletedCount == 0 {
+		return errors.Join(mongo.ErrNoDocuments, s.err)
+	}
+	return nil
+}
+
+// DeleteBySessionId removes all the shares of the session
+func (s *Share) DeleteBySessionId(sessionId string) error {
+	collection := s.client.Database(s.conf.MongoDbName).Collection(s.collectionName)
+	filter := bson.M{"sessionId": sessionId}
+	ctx, cancel := util.GetTimeoutContext(s.conf.TimeoutSecond)
+	defer cancel()
+	if _, err := collection.DeleteMany(ctx, filter); err != nil {
+		return errors.Join(err, s.err)
+	}
+	return nil
+}
+
+func (s *Share) CountBySessionId(sessionId string) (int64, error) {
+	collection := s.client.Database(s.conf.MongoDbName).Collection(s.collectionName)
+	filter := bson.M{"sessionId": sessionId}
+	ctx, cancel := util.GetTimeoutContext(s.conf.TimeoutSecond)
+	defer cancel()
+	count, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return 0, errors.Join(err, s.err)
+	}
+	return count, nil
+}
@@ -0,0 +1,173 @@
+package dal
+
+import (
+	"errors"
+
+	"github.com/zenpk/chatbone/util"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	TemplateVariableString  = "string"
+	TemplateVariableNumber  = "number"
+	TemplateVariableBoolean = "boolean"
+	TemplateVariableEnum    = "enum"
+)
+
+// Template is a saved prompt with {{variable}} placeholders
+type Template struct {
+	Id        string              `bson:"id" json:"id"`
+	UserId    string              `bson:"userId" json:"-"` // uuid
+	Timestamp int64               `bson:"timestamp" json:"timestamp"`
+	Name      string              `bson:"name" json:"name"`
+	Content   string              `bson:"content" json:"content"`
+	Variables []*TemplateVariable `bson:"variables" json:"variables"`
+	Shared    bool                `bson:"shared" json:"shared"` // visible to everyone in the organization
+
+	conf           *util.Configuration
+	logger         util.ILogger
+	client         *mongo.Client
+	collectionName string
+	err            error
+}
+
+type TemplateVariable struct {
+	Name     string   `bson:"name" json:"name"`
+	Type     string   `bson:"type" json:"type"`
+	Default  string   `bson:"default" json:"default"` // empty means no default
+	Required bool     `bson:"required" json:"required"`
+	Options  []string `bson:"options" json:"options"` // only for enum
+}
+
+func newTemplate(conf *util.Configuration, client *mongo.Client, logger util.ILogger) (*Template, error) {
+	t := new(Template)
+	t.conf = conf
+	t.logger = logger
+	t.client = client
+	t.collectionName = "template"
+	t.err = errors.New("at Template table")
+	ctx, cancel := util.GetTimeoutContext(t.conf.TimeoutSecond)
+	defer cancel()
+	collection := t.client.Database(t.conf.MongoDbName).Collection(t.collectionName)
+	mod := mongo.IndexModel{
+		Keys: bson.M{"id": "hashed"},
+	}
+	_, err := collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, t.err)
+	}
+	mod = mongo.IndexModel{
+		Keys: bson.D{{Key: "userId", Value: 1}, {Key: "timestamp", Value: -1}},
+	}
+	_, err = collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, t.err)
+	}
+	mod = mongo.IndexModel{
+		Keys: bson.D{{Key: "shared", Value: 1}, {Key: "timestamp", Value: -1}},
+	}
+	_, err = collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, t.err)
+	}
+	return t, nil
+}
+
+func (t *Template) SelectById(id string) (*Template, error) {
+	collection := t.client.Database(t.conf.MongoDbName).Collection(t.collectionName)
+	filter := bson.M{"id": id}
+	result := new(Template)
+	ctx, cancel := util.GetTimeoutContext(t.conf.TimeoutSecond)
+	defer cancel()
+	if err := collection.FindOne(ctx, filter).Decode(result); err != nil {
+		return nil, errors.Join(err, t.err)
+	}
+	return result, nil
+}
+
+// SelectVisibleByUserId returns the user's own templates and the shared ones
+func (t *Template) SelectVisibleByUserId(userId string) ([]*Template, error) {
+	collection := t.client.Database(t.conf.MongoDbName).Collection(t.collectionName)
+	filter := bson.M{"$or": bson.A{bson.M{"userId": userId}, bson.M{"shared": true}}}
+	ctx, cancel := util.GetTimeoutContext(t.conf.TimeoutSecond)
+	defer cancel()
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: -1}})
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.Join(err, t.err)
+	}
+	result := make([]*Template, 0)
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, errors.Join(err, t.err)
+	}
+	return result, nil
+}
+
+func (t *Template) CountByUserId(userId string) (int64, error) {
+	collection := t.client.Database(t.conf.MongoDbName).Collection(t.collectionName)
+	filter := bson.M{"userId": userId}
+	ctx, cancel := util.GetTimeoutContext(t.conf.TimeoutSecond)
+	defer cancel()
+	count, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return 0, errors.Join(err, t.err)
+	}
+	return count, nil
+}
+
+func (t *Template) Insert(template *Template) error {
+	if err := t.checkInput(template); err != nil {
+		return err
+	}
+	collection := t.client.Database(t.conf.MongoDbName).Collection(t.collectionName)
+	ctx, cancel := util.GetTimeoutContext(t.conf.TimeoutSecond)
+	defer cancel()
+	if _, err := collection.InsertOne(ctx, template); err != nil {
+		return errors.Join(err, t.err)
+	}
+	return nil
+}
+
+// ReplaceById only replaces the template owned by the same user
+func (t *Template) ReplaceById(template *Template) error {
+	if err := t.checkInput(template); err != nil {
+		return err
+	}
+	collection := t.client.Database(t.conf.MongoDbName).Collection(t.collectionName)
+	filter := bson.M{"id": template.Id, "userId": template.UserId}
+	ctx, cancel := util.GetTimeoutContext(t.conf.TimeoutSecond)
+	defer cancel()
+	result, err := collection.ReplaceOne(ctx, filter, template)
+	if err != nil {
+		return errors.Join(err, t.err)
+	}
+	if result.MatchedCount == 0 {
+		return errors.Join(mongo.ErrNoDocuments, t.err)
+	}
+	return nil
+}
+
+func (t *Template) DeleteById(id, userId string) error {
+	collection := t.client.Database(t.conf.MongoDbName).Collection(t.collectionName)
+	filter := bson.M{"id": id, "userId": userId}
+	ctx, cancel := util.GetTimeoutContext(t.conf.TimeoutSecond)
+	defer cancel()
+	result, err := collection.DeleteOne(ctx, filter)
+	if err != nil {
+		return errors.Join(err, t.err)
+	}
+	if result.DeletedCount == 0 {
+		return errors.Join(mongo.ErrNoDocuments, t.err)
+	}
+	return nil
+}
+
+func (t *Template) checkInput(template *Template) error {
+	if template == nil || template.Id == "" || template.UserId == "" || template.Name == "" ||
+		template.Content == "" || template.Timestamp <= 0 {
+		return errors.Join(errors.New("insert invalid input"), t.err)
+	}
+	return nil
+}
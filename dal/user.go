@@ -2,18 +2,14 @@ package dal
 
 import (
 	"errors"
-	"fmt"
-	"sync"
 
 	"github.com/zenpk/chatbone/util"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-type IUser interface {
-	SelectByIdInsertIfNotExists(id string) (*User, error)
-	ReduceBalance(id string, amount int64) error
-}
+var ErrInsufficientBalance = errors.New("balance is not enough")
 
 type User struct {
 	Id        string // uuid
@@ -23,7 +19,6 @@ type User struct {
 	conf           *util.Configuration
 	logger         util.ILogger
 	client         *mongo.Client
-	mutex          *sync.Mutex // for charging the balance
 	collectionName string
 	err            error
 }
@@ -35,66 +30,111 @@ func newUser(conf *util.Configuration, client *mongo.Client, logger util.ILogger
 	u.client = client
 	u.collectionName = "user"
 	u.err = errors.New("at User table")
-	u.mutex = new(sync.Mutex)
 	ctx, cancel := util.GetTimeoutContext(u.conf.TimeoutSecond)
 	defer cancel()
 	collection := u.client.Database(u.conf.MongoDbName).Collection(u.collectionName)
 	mod := mongo.IndexModel{
-		Keys: bson.D{{"id", 1}},
+		Keys:    bson.D{{Key: "id", Value: 1}},
+		Options: options.Index().SetUnique(true),
 	}
-	_, err := collection.Indexes().CreateOne(ctx, mod)
-	if err != nil {
-		return nil, errors.Join(err, u.err)
+	if _, err := collection.Indexes().CreateOne(ctx, mod); err != nil {
+		// the former index isn't unique and might have let a user be inserted twice, the migration replaces it
+		if !isIndexConflict(err) && !mongo.IsDuplicateKeyError(err) {
+			return nil, errors.Join(err, u.err)
+		}
+		u.logger.Warnf("the user ID index isn't unique yet, run the migration: %v", err)
 	}
 	return u, nil
 }
 
-func (u *User) SelectByIdInsertIfNotExists(uuid string) (*User, error) {
+// SelectByIdInsertIfNotExists upserts the user, so concurrent calls from any instance insert it only once,
+// it also tells if this call inserted the user, which then has the initial balance to be granted in the ledger
+func (u *User) SelectByIdInsertIfNotExists(uuid string) (*User, bool, error) {
 	collection := u.client.Database(u.conf.MongoDbName).Collection(u.collectionName)
 	filter := bson.M{"id": uuid}
+	update := bson.M{"$setOnInsert": bson.M{
+		"balance":   InitialBalance,
+		"clipboard": "",
+	}}
+	ctx, cancel := util.GetTimeoutContext(u.conf.TimeoutSecond)
+	defer cancel()
+	upsertResult, err := collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		return nil, false, errors.Join(err, u.err)
+	}
+	result := new(User)
+	if err := collection.FindOne(ctx, filter).Decode(result); err != nil {
+		return nil, false, errors.Join(err, u.err)
+	}
+	return result, upsertResult.UpsertedCount > 0, nil
+}
+
+// SelectById reads the user from the database, it returns mongo.ErrNoDocuments if the user doesn't exist
+func (u *User) SelectById(id string) (*User, error) {
+	collection := u.client.Database(u.conf.MongoDbName).Collection(u.collectionName)
+	filter := bson.M{"id": id}
 	result := new(User)
 	ctx, cancel := util.GetTimeoutContext(u.conf.TimeoutSecond)
 	defer cancel()
-	// get mutex, this is for ensuring the user we get has the latest balance value
-	u.mutex.Lock()
-	defer u.mutex.Unlock()
 	if err := collection.FindOne(ctx, filter).Decode(result); err != nil {
-		if errors.Is(err, mongo.ErrNoDocuments) {
-			result.Id = uuid
-			result.Balance = 1 * BalanceMultipleFactor // 1 dollar
-			result.Clipboard = ""
-			if _, err := collection.InsertOne(ctx, result); err != nil {
-				return nil, errors.Join(err, u.err)
-			}
-			return result, nil
-		}
 		return nil, errors.Join(err, u.err)
 	}
 	return result, nil
 }
 
+// ReduceBalance deducts the amount only if the balance covers it, in a single atomic update,
+// so it stays consistent under concurrent charges from any number of instances,
+// the user with the new balance is returned, a missing user is taken as having no balance
 func (u *User) ReduceBalance(id string, amount int64) (*User, error) {
 	if amount <= 0 {
 		return nil, errors.Join(errors.New("balance reduce amount must be positive"), u.err)
 	}
-	// ensure the user exists
-	user, err := u.SelectByIdInsertIfNotExists(id)
-	if err != nil {
-		return nil, fmt.Errorf("reduce balance: select user failed: %w", err)
+	collection := u.client.Database(u.conf.MongoDbName).Collection(u.collectionName)
+	filter := bson.M{"id": id, "balance": bson.M{"$gte": amount}}
+	update := bson.M{"$inc": bson.M{"balance": -amount}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	result := new(User)
+	ctx, cancel := util.GetTimeoutContext(u.conf.TimeoutSecond)
+	defer cancel()
+	if err := collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(result); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, errors.Join(ErrInsufficientBalance, u.err)
+		}
+		return nil, errors.Join(err, u.err)
 	}
+	return result, nil
+}
+
+// AdjustBalance adds the signed delta unconditionally, it's for giving back or settling what's already held
+func (u *User) AdjustBalance(id string, delta int64) (*User, error) {
 	collection := u.client.Database(u.conf.MongoDbName).Collection(u.collectionName)
 	filter := bson.M{"id": id}
-	update := bson.M{"$set": bson.M{"balance": user.Balance - amount}}
+	update := bson.M{"$inc": bson.M{"balance": delta}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	result := new(User)
 	ctx, cancel := util.GetTimeoutContext(u.conf.TimeoutSecond)
 	defer cancel()
-	// update with mutex
-	u.mutex.Lock()
-	defer u.mutex.Unlock()
-	if _, err := collection.UpdateOne(ctx, filter, update); err != nil {
+	if err := collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(result); err != nil {
 		return nil, errors.Join(err, u.err)
 	}
-	user.Balance -= amount
-	return user, nil
+	return result, nil
+}
+
+// ReconcileBalance sets the balance only if it's still the expected one, it returns mongo.ErrNoDocuments otherwise
+func (u *User) ReconcileBalance(id string, expected, balance int64) error {
+	collection := u.client.Database(u.conf.MongoDbName).Collection(u.collectionName)
+	filter := bson.M{"id": id, "balance": expected}
+	update := bson.M{"$set": bson.M{"balance": balance}}
+	ctx, cancel := util.GetTimeoutContext(u.conf.TimeoutSecond)
+	defer cancel()
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.Join(err, u.err)
+	}
+	if result.MatchedCount == 0 {
+		return errors.Join(mongo.ErrNoDocuments, u.err)
+	}
+	return nil
 }
 
 func (u *User) SelectAll() ([]*User, error) {
@@ -127,3 +167,10 @@ func (u *User) UpdateClipboard(id, clipboard string) error {
 	}
 	return nil
 }
+
+// isIndexConflict tells if an index with the same name or keys already exists with other options
+func isIndexConflict(err error) bool {
+	var commandErr mongo.CommandError
+	// IndexOptionsConflict and IndexKeySpecsConflict
+	return errors.As(err, &commandErr) && (commandErr.Code == 85 || commandErr.Code == 86)
+}
@@ -0,0 +1,116 @@
+package dal
+
+import (
+	"errors"
+
+	"github.com/zenpk/chatbone/util"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Version is a previous content of a message, archived when the message is edited, regenerated or removed
+type Version struct {
+	Id        string       `bson:"id" json:"id"`
+	SessionId string       `bson:"sessionId" json:"sessionId"`
+	UserId    string       `bson:"userId" json:"-"` // uuid
+	MessageId string       `bson:"messageId" json:"messageId"`
+	Timestamp int64        `bson:"timestamp" json:"timestamp"` // when it's archived
+	Message   *ChatMessage `bson:"message" json:"message"`
+
+	conf           *util.Configuration
+	logger         util.ILogger
+	client         *mongo.Client
+	collectionName string
+	err            error
+}
+
+func newVersion(conf *util.Configuration, client *mongo.Client, logger util.ILogger) (*Version, error) {
+	v := new(Version)
+	v.conf = conf
+	v.logger = logger
+	v.client = client
+	v.collectionName = "version"
+	v.err = errors.New("at Version table")
+	ctx, cancel := util.GetTimeoutContext(v.conf.TimeoutSecond)
+	defer cancel()
+	collection := v.client.Database(v.conf.MongoDbName).Collection(v.collectionName)
+	mod := mongo.IndexModel{
+		Keys: bson.M{"id": "hashed"},
+	}
+	_, err := collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, v.err)
+	}
+	mod = mongo.IndexModel{
+		Keys: bson.D{{Key: "sessionId", Value: 1}, {Key: "messageId", Value: 1}, {Key: "timestamp", Value: -1}},
+	}
+	_, err = collection.Indexes().CreateOne(ctx, mod)
+	if err != nil {
+		return nil, errors.Join(err, v.err)
+	}
+	return v, nil
+}
+
+func (v *Version) SelectById(id string) (*Version, error) {
+	collection := v.client.Database(v.conf.MongoDbName).Collection(v.collectionName)
+	filter := bson.M{"id": id}
+	result := new(Version)
+	ctx, cancel := util.GetTimeoutContext(v.conf.TimeoutSecond)
+	defer cancel()
+	if err := collection.FindOne(ctx, filter).Decode(result); err != nil {
+		return nil, errors.Join(err, v.err)
+	}
+	return result, nil
+}
+
+// SelectByMessageId returns the versions of the message in the user's session, the most recent first
+func (v *Version) SelectByMessageId(sessionId, userId, messageId string) ([]*Version, error) {
+	collection := v.client.Database(v.conf.MongoDbName).Collection(v.collectionName)
+	filter := bson.M{"sessionId": sessionId, "userId": userId, "messageId": messageId}
+	ctx, cancel := util.GetTimeoutContext(v.conf.TimeoutSecond)
+	defer cancel()
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: -1}})
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.Join(err, v.err)
+	}
+	result := make([]*Version, 0)
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, errors.Join(err, v.err)
+	}
+	return result, nil
+}
+
+func (v *Version) InsertMany(versions []*Version) error {
+	if len(versions) == 0 {
+		return nil
+	}
+	documents := make([]any, len(versions))
+	for i, version := range versions {
+		if version == nil || version.Id == "" || version.SessionId == "" || version.UserId == "" ||
+			version.MessageId == "" || version.Timestamp <= 0 || version.Message == nil {
+			return errors.Join(errors.New("insert invalid input"), v.err)
+		}
+		documents[i] = version
+	}
+	collection := v.client.Database(v.conf.MongoDbName).Collection(v.collectionName)
+	ctx, cancel := util.GetTimeoutContext(v.conf.TimeoutSecond)
+	defer cancel()
+	if _, err := collection.InsertMany(ctx, documents); err != nil {
+		return errors.Join(err, v.err)
+	}
+	return nil
+}
+
+// DeleteBySessionId removes all the versions of the session's messages
+func (v *Version) DeleteBySessionId(sessionId string) error {
+	collection := v.client.Database(v.conf.MongoDbName).Collection(v.collectionName)
+	filter := bson.M{"sessionId": sessionId}
+	ctx, cancel := util.GetTimeoutContext(v.conf.TimeoutSecond)
+	defer cancel()
+	if _, err := collection.DeleteMany(ctx, filter); err != nil {
+		return errors.Join(err, v.err)
+	}
+	return nil
+}
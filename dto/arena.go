@@ -0,0 +1,32 @@
+package dto
+
+import "github.com/zenpk/chatbone/dal"
+
+type ArenaReqFromClient struct {
+	ModelIds  []int           `json:"modelIds"`
+	SessionId string          `json:"sessionId"`
+	Messages  []OpenAiMessage `json:"messages"`
+}
+
+// ArenaResp tags a streamed reply with the model that produced it
+type ArenaResp struct {
+	ModelId int    `json:"modelId"`
+	Content string `json:"content,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type ArenaStartResp struct {
+	ArenaId  string `json:"arenaId"`
+	ModelIds []int  `json:"modelIds"`
+}
+
+type ArenaVoteReq struct {
+	ArenaId          string `json:"arenaId"`
+	PreferredModelId int    `json:"preferredModelId"` // 0 means tie
+	Task             string `json:"task"`
+}
+
+type ArenaLeaderboardResp struct {
+	CommonResp
+	Ranks []*dal.ArenaRank `json:"ranks"`
+}
@@ -0,0 +1,15 @@
+package dto
+
+import "github.com/zenpk/chatbone/dal"
+
+type AttachmentResp struct {
+	CommonResp
+	Attachment *dal.Attachment `json:"attachment"`
+}
+
+type AttachmentsResp struct {
+	CommonResp
+	Attachments []*dal.Attachment `json:"attachments"`
+	Used        int64             `json:"used"`  // bytes
+	Quota       int64             `json:"quota"` // bytes, 0 means unlimited
+}
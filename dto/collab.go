@@ -0,0 +1,37 @@
+package dto
+
+import "github.com/zenpk/chatbone/dal"
+
+const (
+	CollabEventSnapshot = "snapshot" // the current messages, sent first to a new subscriber
+	CollabEventPresence = "presence" // the users online changed
+	CollabEventTurn     = "turn"     // someone sent a prompt
+	CollabEventDelta    = "delta"    // a piece of the streamed answer
+	CollabEventDone     = "done"     // the answer is finished
+	CollabEventError    = "error"    // the answer failed
+	CollabEventRemoved  = "removed"  // the subscriber lost the access or fell behind, the stream ends
+)
+
+type MemberReq struct {
+	Role string `json:"role"` // viewer or participant
+}
+
+type MemberResp struct {
+	CommonResp
+	Member *dal.Member `json:"member"`
+}
+
+type MembersResp struct {
+	CommonResp
+	OwnerId string        `json:"ownerId"`
+	Members []*dal.Member `json:"members"`
+}
+
+// CollabEvent is sent to everyone subscribed to the session
+type CollabEvent struct {
+	Type     string             `json:"type"`
+	UserId   string             `json:"userId,omitempty"`  // who sent the prompt of the turn
+	Content  string             `json:"content,omitempty"` // the prompt or the delta
+	Online   []string           `json:"online,omitempty"`  // presence only
+	Messages []*dal.ChatMessage `json:"messages,omitempty"`
+}
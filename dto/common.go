@@ -1,12 +1,25 @@
 package dto
 
+import (
+	"encoding/json"
+
+	"github.com/zenpk/chatbone/dal"
+)
+
 type CommonResp struct {
 	Code int    `json:"code"`
 	Msg  string `json:"msg"`
 }
 
 type ChatReqFromClient struct {
-	ModelId   int    `json:"modelId"`
-	SessionId string `json:"sessionId"`
-	Messages  any    `json:"messages"`
+	ModelId    int             `json:"modelId"` // could be omitted if the persona has a default model
+	SessionId  string          `json:"sessionId"`
+	Messages   json.RawMessage `json:"messages"` // decoded by the model provider
+	PersonaId  string          `json:"personaId"`
+	Parameters dal.Parameters  `json:"parameters"`
+	// the rendered template is appended to the messages as a user message
+	TemplateId     string         `json:"templateId"`
+	TemplateValues map[string]any `json:"templateValues"`
+	// optional, the library to retrieve from instead of the session's
+	LibraryId string `json:"libraryId"`
 }
@@ -7,4 +7,7 @@ const (
 	ErrUnauthorized  = 4010
 	ErrAuthFailed    = 4011
 	ErrRefreshFailed = 4012
+	ErrBalance       = 4020 // the balance can't cover the request
+	ErrForbidden     = 4030
+	ErrNotFound      = 4040
 )
@@ -0,0 +1,47 @@
+package dto
+
+import "github.com/zenpk/chatbone/dal"
+
+type FeedbackReq struct {
+	Rating   int    `json:"rating"`   // 1 or -1
+	Comment  string `json:"comment"`  // optional
+	Category string `json:"category"` // optional
+}
+
+type FeedbackResp struct {
+	CommonResp
+	Feedback *dal.Feedback `json:"feedback"`
+}
+
+type FeedbacksResp struct {
+	CommonResp
+	Feedbacks []*dal.Feedback `json:"feedbacks"`
+}
+
+// FeedbackRecord is a line of the JSONL export, the messages end with the rated answer
+type FeedbackRecord struct {
+	Id        string          `json:"id"`
+	SessionId string          `json:"sessionId"`
+	MessageId string          `json:"messageId"`
+	ModelId   int             `json:"modelId"`
+	Model     string          `json:"model"`
+	Timestamp int64           `json:"timestamp"`
+	Rating    int             `json:"rating"`
+	Comment   string          `json:"comment,omitempty"`
+	Category  string          `json:"category,omitempty"`
+	Messages  []OpenAiMessage `json:"messages"`
+}
+
+type FeedbackStat struct {
+	ModelId int     `json:"modelId"`
+	Model   string  `json:"model"` // empty if the model has been removed
+	Up      int     `json:"up"`
+	Down    int     `json:"down"`
+	Total   int     `json:"total"`
+	UpRate  float64 `json:"upRate"`
+}
+
+type FeedbackStatsResp struct {
+	CommonResp
+	Stats []*FeedbackStat `json:"stats"`
+}
@@ -0,0 +1,58 @@
+package dto
+
+const (
+	ImportStatusImported  = "imported"
+	ImportStatusDuplicate = "duplicate"
+	ImportStatusFailed    = "failed"
+)
+
+type ImportReport struct {
+	CommonResp
+	Format     string        `json:"format"`
+	Total      int           `json:"total"`
+	Imported   int           `json:"imported"`
+	Duplicates int           `json:"duplicates"`
+	Failed     int           `json:"failed"`
+	Items      []*ImportItem `json:"items"`
+}
+
+type ImportItem struct {
+	SessionId   string `json:"sessionId"`
+	Title       string `json:"title"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+	ModelId     int    `json:"modelId"`
+	ModelMapped bool   `json:"modelMapped"` // false means the original model is unknown and a fallback is used
+}
+
+// ChatGptConversation is an element of the ChatGPT conversations.json export
+type ChatGptConversation struct {
+	Id          string                  `json:"id"`
+	Title       string                  `json:"title"`
+	CreateTime  float64                 `json:"create_time"` // second
+	UpdateTime  float64                 `json:"update_time"` // second
+	CurrentNode string                  `json:"current_node"`
+	Mapping     map[string]*ChatGptNode `json:"mapping"`
+}
+
+type ChatGptNode struct {
+	Id       string          `json:"id"`
+	Parent   string          `json:"parent"`
+	Children []string        `json:"children"`
+	Message  *ChatGptMessage `json:"message"`
+}
+
+type ChatGptMessage struct {
+	Id     string `json:"id"`
+	Author struct {
+		Role string `json:"role"`
+	} `json:"author"`
+	CreateTime float64 `json:"create_time"`
+	Content    struct {
+		ContentType string `json:"content_type"`
+		Parts       []any  `json:"parts"` // strings for text, objects for the others (e.g. images)
+	} `json:"content"`
+	Metadata struct {
+		ModelSlug string `json:"model_slug"`
+	} `json:"metadata"`
+}
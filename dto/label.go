@@ -0,0 +1,31 @@
+package dto
+
+import "github.com/zenpk/chatbone/dal"
+
+type LabelReq struct {
+	Type  string `json:"type"` // folder or tag, ignored on update
+	Name  string `json:"name"`
+	Color string `json:"color"` // optional, #rrggbb
+}
+
+type LabelResp struct {
+	CommonResp
+	Label *dal.Label `json:"label"`
+}
+
+type LabelsResp struct {
+	CommonResp
+	Labels []*dal.Label `json:"labels"`
+}
+
+type MoveSessionReq struct {
+	FolderId string `json:"folderId"` // empty to take the session out of its folder
+}
+
+type TagSessionReq struct {
+	TagIds []string `json:"tagIds"`
+}
+
+type PinSessionReq struct {
+	Pinned bool `json:"pinned"`
+}
@@ -0,0 +1,45 @@
+package dto
+
+import "github.com/zenpk/chatbone/dal"
+
+type LibraryReq struct {
+	Name string `json:"name"`
+}
+
+type LibraryResp struct {
+	CommonResp
+	Library *dal.Library `json:"library"`
+}
+
+type LibrariesResp struct {
+	CommonResp
+	Libraries []*dal.Library `json:"libraries"`
+}
+
+type DocumentResp struct {
+	CommonResp
+	Document *dal.Document `json:"document"`
+}
+
+type DocumentsResp struct {
+	CommonResp
+	Documents []*dal.Document `json:"documents"`
+}
+
+type AttachLibraryReq struct {
+	LibraryId string `json:"libraryId"` // empty to detach
+}
+
+// Citation is a retrieved chunk that's put into the prompt
+type Citation struct {
+	ChunkId    string  `json:"chunkId"`
+	DocumentId string  `json:"documentId"`
+	Filename   string  `json:"filename"`
+	Index      int     `json:"index"` // position of the chunk in the document
+	Score      float64 `json:"score"` // cosine similarity
+	Text       string  `json:"text"`
+}
+
+type CitationEvent struct {
+	Citations []*Citation `json:"citations"`
+}
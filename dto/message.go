@@ -0,0 +1,101 @@
+package dto
+
+import "github.com/zenpk/chatbone/dal"
+
+type RenameSessionReq struct {
+	Title string `json:"title"`
+}
+
+type PromoteDraftReq struct {
+	Title string `json:"title"` // optional
+}
+
+type SaveSessionReq struct {
+	Title    string          `json:"title"`
+	ModelId  int             `json:"modelId"`
+	Messages []OpenAiMessage `json:"messages"`
+}
+
+type SessionsResp struct {
+	CommonResp
+	Sessions   []*dal.Message `json:"sessions"`   // metadata only
+	NextCursor string         `json:"nextCursor"` // empty on the last page
+}
+
+type SessionResp struct {
+	CommonResp
+	Session  *dal.Message       `json:"session"`
+	Messages []*dal.ChatMessage `json:"messages"`
+}
+
+type SessionSettingsReq struct {
+	dal.SessionSettings
+	LibraryId string `json:"libraryId"` // empty to detach
+}
+
+type SessionSettingsResp struct {
+	CommonResp
+	Settings  *dal.SessionSettings `json:"settings"`
+	LibraryId string               `json:"libraryId"`
+}
+
+type SearchResult struct {
+	SessionId string         `json:"sessionId"`
+	Title     string         `json:"title"`
+	ModelId   int            `json:"modelId"`
+	Timestamp int64          `json:"timestamp"`
+	Saved     bool           `json:"saved"`
+	Shared    bool           `json:"shared"`
+	Score     float64        `json:"score"`
+	Matches   []*SearchMatch `json:"matches"`
+}
+
+// SearchMatch is a matched message, the snippet is HTML escaped with the terms wrapped in <mark>
+type SearchMatch struct {
+	Index     int    `json:"index"`
+	MessageId string `json:"messageId"`
+	Snippet   string `json:"snippet"`
+}
+
+type SearchResp struct {
+	CommonResp
+	Results []*SearchResult `json:"results"`
+}
+
+// ExportSession is the lossless JSON export format, it's also accepted by the import,
+// the messages of version 1 were in the OpenAI format
+type ExportSession struct {
+	Version   int                `json:"version"`
+	SessionId string             `json:"sessionId"`
+	Title     string             `json:"title"`
+	ModelId   int                `json:"modelId"`
+	Timestamp int64              `json:"timestamp"`
+	Saved     bool               `json:"saved"`
+	Shared    bool               `json:"shared"`
+	Messages  []*dal.ChatMessage `json:"messages"`
+	Usage     []*dal.History     `json:"usage"` // token usage of every turn
+}
+
+type EmptyTrashResp struct {
+	CommonResp
+	Count int `json:"count"`
+}
+
+type ForkSessionReq struct {
+	MessageId string `json:"messageId"` // optional, the last message to copy, all messages if empty
+	Title     string `json:"title"`     // optional, the original title if empty
+}
+
+type EditMessageReq struct {
+	Content string `json:"content"`
+}
+
+type ChatMessageResp struct {
+	CommonResp
+	Message *dal.ChatMessage `json:"message"`
+}
+
+type VersionsResp struct {
+	CommonResp
+	Versions []*dal.Version `json:"versions"`
+}
@@ -1,20 +1,45 @@
 package dto
 
+import "github.com/zenpk/chatbone/dal"
+
 type OpenAiMessage struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role          string   `json:"role"`
+	Content       string   `json:"content"`
+	AttachmentIds []string `json:"attachmentIds,omitempty"` // expanded before the request is sent
 }
 
 type OpenAiReqFromClient struct {
-	ModelId   int
-	SessionId string
-	Messages  []OpenAiMessage
+	ModelId    int
+	SessionId  string
+	Messages   []OpenAiMessage
+	Parameters dal.Parameters
+	Context    string // retrieved excerpts, sent before the last message but not saved
 }
 
 type OpenAiReqToOpenAi struct {
-	Model    string          `json:"model"`
-	Messages []OpenAiMessage `json:"messages"`
-	Stream   bool            `json:"stream"`
+	Model       string                  `json:"model"`
+	Messages    []OpenAiMessageToOpenAi `json:"messages"`
+	Stream      bool                    `json:"stream"`
+	Temperature *float64                `json:"temperature,omitempty"`
+	TopP        *float64                `json:"top_p,omitempty"`
+	MaxTokens   int                     `json:"max_tokens,omitempty"`
+}
+
+// OpenAiMessageToOpenAi is a message with the attachments expanded
+type OpenAiMessageToOpenAi struct {
+	Role    string `json:"role"`
+	Content any    `json:"content"` // a string, or []*OpenAiContentPart if the message has images
+}
+
+type OpenAiContentPart struct {
+	Type     string          `json:"type"` // text or image_url
+	Text     string          `json:"text,omitempty"`
+	ImageUrl *OpenAiImageUrl `json:"image_url,omitempty"`
+}
+
+type OpenAiImageUrl struct {
+	Url    string `json:"url"` // could be a data URL
+	Detail string `json:"detail,omitempty"`
 }
 
 type OpenAiResp struct {
@@ -32,3 +57,40 @@ type OpenAiChoice struct {
 	Logprobs     interface{}    `json:"logprobs"`
 	FinishReason string         `json:"finish_reason"`
 }
+
+// OpenAiCompletionResp is the response of a non-streaming request
+type OpenAiCompletionResp struct {
+	Id      string                    `json:"id"`
+	Object  string                    `json:"object"`
+	Created int64                     `json:"created"`
+	Model   string                    `json:"model"`
+	Choices []*OpenAiCompletionChoice `json:"choices"`
+	Usage   *OpenAiUsage              `json:"usage"`
+}
+
+type OpenAiCompletionChoice struct {
+	Index        int            `json:"index"`
+	Message      *OpenAiMessage `json:"message"`
+	FinishReason string         `json:"finish_reason"`
+}
+
+type OpenAiEmbeddingReq struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type OpenAiEmbeddingResp struct {
+	Data  []*OpenAiEmbedding `json:"data"`
+	Usage *OpenAiUsage       `json:"usage"`
+}
+
+type OpenAiEmbedding struct {
+	Index     int       `json:"index"`
+	Embedding []float64 `json:"embedding"`
+}
+
+type OpenAiUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
@@ -0,0 +1,20 @@
+package dto
+
+import "github.com/zenpk/chatbone/dal"
+
+type PersonaReq struct {
+	Name         string         `json:"name"`
+	SystemPrompt string         `json:"systemPrompt"`
+	ModelId      int            `json:"modelId"`
+	Parameters   dal.Parameters `json:"parameters"`
+}
+
+type PersonaResp struct {
+	CommonResp
+	Persona *dal.Persona `json:"persona"`
+}
+
+type PersonasResp struct {
+	CommonResp
+	Personas []*dal.Persona `json:"personas"`
+}
@@ -0,0 +1,28 @@
+package dto
+
+import "github.com/zenpk/chatbone/dal"
+
+type ShareReq struct {
+	ExpireAt int64  `json:"expireAt"` // ms timestamp, 0 means never
+	Password string `json:"password"` // optional
+	Snapshot bool   `json:"snapshot"` // if false, viewers always see the latest messages
+}
+
+type ShareResp struct {
+	CommonResp
+	Share *dal.Share `json:"share"`
+}
+
+type SharesResp struct {
+	CommonResp
+	Shares []*dal.Share `json:"shares"`
+}
+
+type SharedSessionResp struct {
+	CommonResp
+	Title     string          `json:"title"`
+	ModelId   int             `json:"modelId"`
+	Timestamp int64           `json:"timestamp"`
+	Snapshot  bool            `json:"snapshot"`
+	Messages  []OpenAiMessage `json:"messages"`
+}
@@ -0,0 +1,20 @@
+package dto
+
+import "github.com/zenpk/chatbone/dal"
+
+type TemplateReq struct {
+	Name      string                  `json:"name"`
+	Content   string                  `json:"content"`
+	Variables []*dal.TemplateVariable `json:"variables"`
+	Shared    bool                    `json:"shared"`
+}
+
+type TemplateResp struct {
+	CommonResp
+	Template *dal.Template `json:"template"`
+}
+
+type TemplatesResp struct {
+	CommonResp
+	Templates []*dal.Template `json:"templates"`
+}
@@ -0,0 +1,43 @@
+package dto
+
+import "github.com/zenpk/chatbone/dal"
+
+type UsageResp struct {
+	CommonResp
+	Usage      []*dal.History `json:"usage"`
+	NextCursor string         `json:"nextCursor"` // empty on the last page
+}
+
+type TransactionsResp struct {
+	CommonResp
+	Transactions []*dal.Ledger `json:"transactions"`
+	NextCursor   string        `json:"nextCursor"` // empty on the last page
+}
+
+// BalanceReq is an admin's change to a user's balance
+type BalanceReq struct {
+	Kind      string `json:"kind"`      // topUp, refund, grant or adjustment
+	Amount    int64  `json:"amount"`    // signed, dollar * 1000000
+	Reference string `json:"reference"` // optional, e.g. the history of a refund
+	Note      string `json:"note"`
+}
+
+type BalanceResp struct {
+	CommonResp
+	Transaction *dal.Ledger `json:"transaction"`
+}
+
+type ClipboardReq struct {
+	Clipboard string `json:"clipboard"`
+	DeviceId  string `json:"deviceId"` // optional, the device isn't notified of its own update
+}
+
+type ClipboardResp struct {
+	CommonResp
+	Clipboard string `json:"clipboard"`
+}
+
+// ClipboardEvent is the data of the clipboard SSE
+type ClipboardEvent struct {
+	Clipboard string `json:"clipboard"`
+}
@@ -7,7 +7,7 @@ require (
 	go.mongodb.org/mongo-driver v1.14.0
 )
 
-require github.com/cristalhq/jwt/v5 v5.4.0 // indirect
+require github.com/cristalhq/jwt/v5 v5.4.0
 
 require (
 	github.com/dlclark/regexp2 v1.10.0 // indirect
@@ -26,7 +26,7 @@ require (
 	github.com/xdg-go/scram v1.1.2 // indirect
 	github.com/xdg-go/stringprep v1.0.4 // indirect
 	github.com/youmark/pkcs8 v0.0.0-20181117223130-1be2e3e5546d // indirect
-	golang.org/x/crypto v0.17.0 // indirect
+	golang.org/x/crypto v0.17.0
 	golang.org/x/net v0.19.0 // indirect
 	golang.org/x/sync v0.1.0 // indirect
 	golang.org/x/sys v0.15.0 // indirect
@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/zenpk/chatbone/dto"
+)
+
+const (
+	EventArena = "arena"
+)
+
+// arena streams the replies of all the compared models in one response
+// the first event carries the arena ID for voting, the rest are replies tagged by model ID
+func (h *Handler) arena(c echo.Context) error {
+	const ChanSize = 1024
+	req := new(dto.ArenaReqFromClient)
+	if err := c.Bind(req); err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	uuid := c.Get(KeyUuid).(string)
+	arena, models, err := h.arenaService.Start(uuid, req)
+	if err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	started, err := json.Marshal(dto.ArenaStartResp{ArenaId: arena.Id, ModelIds: arena.ModelIds})
+	if err != nil {
+		c.Set(KeyErrCode, dto.ErrUnknown)
+		return err
+	}
+	// the models stop as soon as the client can't be written to
+	ctx, cancel := context.WithCancel(c.Request().Context())
+	defer cancel()
+	replyChan := make(chan dto.ArenaResp, ChanSize)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- h.arenaService.Chat(ctx, uuid, arena, models, req.Messages, replyChan)
+	}()
+	h.setStreamHeaders(c)
+	if err := h.writeArenaEvent(c, Event{Event: []byte(EventArena), Data: started}); err != nil {
+		c.Set(KeyErrCode, dto.ErrUnknown)
+		return err
+	}
+	for {
+		select {
+		case reply := <-replyChan:
+			if err := h.writeArenaReply(c, reply); err != nil {
+				c.Set(KeyErrCode, dto.ErrUnknown)
+				return err
+			}
+		case err := <-errChan:
+			// every reply is sent before the chat returns, flush the remaining ones
+			for len(replyChan) > 0 {
+				if err := h.writeArenaReply(c, <-replyChan); err != nil {
+					c.Set(KeyErrCode, dto.ErrUnknown)
+					return err
+				}
+			}
+			if err != nil {
+				// the errors are also sent to the client per model
+				h.logger.Errorf("arena error: %v", err)
+				h.setErrCode(c, err, dto.ErrUnknown)
+				return err
+			}
+			return nil
+		}
+	}
+}
+
+func (h *Handler) writeArenaReply(c echo.Context, reply dto.ArenaResp) error {
+	data, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	return h.writeArenaEvent(c, Event{Data: data})
+}
+
+func (h *Handler) writeArenaEvent(c echo.Context, event Event) error {
+	if err := event.MarshalTo(c.Response()); err != nil {
+		return err
+	}
+	c.Response().Flush()
+	return nil
+}
+
+func (h *Handler) arenaVote(c echo.Context) error {
+	req := new(dto.ArenaVoteReq)
+	if err := c.Bind(req); err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	if err := h.arenaService.Vote(c.Get(KeyUuid).(string), req); err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	return h.success(c)
+}
+
+func (h *Handler) arenaLeaderboard(c echo.Context) error {
+	ranks, err := h.arenaService.GetLeaderboard(c.QueryParam("task"))
+	if err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.ArenaLeaderboardResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Ranks:      ranks,
+	})
+}
@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"mime"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/zenpk/chatbone/dto"
+)
+
+func (h *Handler) getAttachments(c echo.Context) error {
+	attachments, used, err := h.attachmentService.GetAll(c.Get(KeyUuid).(string), c.Param("sessionId"))
+	if err != nil {
+		h.setErrCode(c, err, dto.ErrUnknown)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.AttachmentsResp{
+		CommonResp:  dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Attachments: attachments,
+		Used:        used,
+		Quota:       h.conf.AttachmentQuota,
+	})
+}
+
+// uploadAttachment accepts a multipart form with the file and the session ID
+func (h *Handler) uploadAttachment(c echo.Context) error {
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	src, err := file.Open()
+	if err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	defer src.Close()
+	attachment, err := h.attachmentService.Upload(c.Get(KeyUuid).(string), c.FormValue("sessionId"),
+		file.Filename, file.Size, src)
+	if err != nil {
+		h.setErrCode(c, err, dto.ErrInput)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.AttachmentResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Attachment: attachment,
+	})
+}
+
+func (h *Handler) getAttachment(c echo.Context) error {
+	attachment, reader, err := h.attachmentService.Open(c.Get(KeyUuid).(string), c.Param("attachmentId"))
+	if err != nil {
+		h.setErrCode(c, err, dto.ErrUnknown)
+		return err
+	}
+	defer reader.Close()
+	c.Response().Header().Set(echo.HeaderContentDisposition,
+		mime.FormatMediaType("inline", map[string]string{"filename": attachment.Filename}))
+	c.Response().Header().Set(echo.HeaderXContentTypeOptions, "nosniff")
+	return c.Stream(http.StatusOK, attachment.ContentType, reader)
+}
+
+func (h *Handler) deleteAttachment(c echo.Context) error {
+	if err := h.attachmentService.Delete(c.Get(KeyUuid).(string), c.Param("attachmentId")); err != nil {
+		h.setErrCode(c, err, dto.ErrUnknown)
+		return err
+	}
+	return h.success(c)
+}
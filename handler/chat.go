@@ -1,8 +1,10 @@
 package handler
 
 import (
+	"encoding/json"
 	"errors"
 	"net/http"
+	"strings"
 
 	"github.com/labstack/echo/v4"
 	"github.com/zenpk/chatbone/dal"
@@ -25,8 +27,44 @@ func (h *Handler) chat(c echo.Context) error {
 		return err
 	}
 	uuid := c.Get(KeyUuid).(string)
+	// a participant chats in the owner's session, the turn is saved there and billed to the participant
+	ownerId, err := h.collabService.ChatOwner(uuid, req.SessionId)
+	if err != nil {
+		h.setErrCode(c, err, dto.ErrInput)
+		return err
+	}
+	// the session's settings fill what the request omits, the session's persona belongs to the owner
+	settings, err := h.messageService.GetSettings(ownerId, req.SessionId)
+	if err != nil {
+		h.setErrCode(c, err, dto.ErrInput)
+		return err
+	}
+	if req.ModelId == 0 {
+		req.ModelId = settings.ModelId
+	}
+	req.Parameters = req.Parameters.Merge(settings.Parameters)
+	personaOwner := uuid
+	if req.PersonaId == "" {
+		req.PersonaId = settings.PersonaId
+		personaOwner = ownerId
+	}
 	replyChan := make(chan any, ChanSize)
 	errChan := make(chan error, 1)
+	if err := h.modelService.CheckParameters(&req.Parameters); err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	var persona *dal.Persona
+	if req.PersonaId != "" {
+		persona, err = h.personaService.Get(personaOwner, req.PersonaId)
+		if err != nil {
+			c.Set(KeyErrCode, dto.ErrInput)
+			return err
+		}
+		if req.ModelId == 0 {
+			req.ModelId = persona.ModelId
+		}
+	}
 	// get and check model
 	model, err := h.modelService.GetAndCheckModelById(req.ModelId)
 	if err != nil {
@@ -35,39 +73,148 @@ func (h *Handler) chat(c echo.Context) error {
 
 	switch model.Provider {
 	case dal.ProviderOpenAi:
-		convertedMessages, ok := req.Messages.([]dto.OpenAiMessage)
-		if !ok {
-			c.Set(KeyErrCode, dto.ErrInput)
-			return errors.Join(errors.New("input messages format error"), h.err)
+		// messages could be omitted if the request uses a template
+		convertedMessages := make([]dto.OpenAiMessage, 0)
+		if len(req.Messages) > 0 {
+			if err := json.Unmarshal(req.Messages, &convertedMessages); err != nil {
+				c.Set(KeyErrCode, dto.ErrInput)
+				return errors.Join(errors.New("input messages format error"), err, h.err)
+			}
+		}
+		if req.TemplateId != "" {
+			content, err := h.templateService.Render(uuid, req.TemplateId, req.TemplateValues)
+			if err != nil {
+				c.Set(KeyErrCode, dto.ErrInput)
+				return err
+			}
+			convertedMessages = append(convertedMessages, dto.OpenAiMessage{Role: "user", Content: content})
+		}
+		// a participant can't rewrite the owner's history, only the new message is taken
+		if ownerId != uuid {
+			convertedMessages, err = h.messageService.StoredTurn(ownerId, req.SessionId, convertedMessages)
+			if err != nil {
+				h.setErrCode(c, err, dto.ErrInput)
+				return err
+			}
 		}
 		convertedReq := &dto.OpenAiReqFromClient{
-			ModelId:   req.ModelId,
-			SessionId: req.SessionId,
-			Messages:  convertedMessages,
+			ModelId:    req.ModelId,
+			SessionId:  req.SessionId,
+			Messages:   convertedMessages,
+			Parameters: req.Parameters,
+		}
+		h.personaService.ApplyToOpenAi(persona, convertedReq)
+		citations, err := h.libraryService.Retrieve(uuid, ownerId, req.LibraryId, settings.RetrievalTopK, convertedReq)
+		if err != nil {
+			h.setErrCode(c, err, dto.ErrInput)
+			return err
 		}
+		// the usage is written before the error is sent
+		var usage *dto.OpenAiUsage
 		go func() {
-			errChan <- h.openAiService.Chat(uuid, model, convertedReq, replyChan)
+			var err error
+			usage, err = h.openAiService.Chat(c.Request().Context(), uuid, model, convertedReq, replyChan)
+			errChan <- err
 		}()
+		// the cost is held before the provider is called, wait for the stream to start
+		// so that a request the balance can't cover gets an error response instead of an empty stream
+		var first any
+		select {
+		case first = <-replyChan:
+		case err := <-errChan:
+			if err != nil {
+				h.logger.Errorf("chat error: %v", err)
+				h.setErrCode(c, err, dto.ErrInput)
+				return err
+			}
+			// nothing is streamed yet, the loop below finishes the turn
+			errChan <- nil
+		}
 		h.setStreamHeaders(c)
+		h.publishTurn(uuid, convertedReq)
+		if len(citations) > 0 {
+			if err := h.writeCitationEvent(c, citations); err != nil {
+				return h.publishError(uuid, req.SessionId, err)
+			}
+		}
+		answer := new(strings.Builder)
+		if first != nil {
+			if err := h.writeOpenAiReply(c, req.SessionId, first.(dto.OpenAiResp), answer); err != nil {
+				return h.publishError(uuid, req.SessionId, err)
+			}
+		}
 		for {
 			select {
 			case reply := <-replyChan:
-				convertedResp := reply.(dto.OpenAiResp)
-				event := Event{
-					Data: []byte(convertedResp.Choices[0].Delta.Content),
+				if err := h.writeOpenAiReply(c, req.SessionId, reply.(dto.OpenAiResp), answer); err != nil {
+					return h.publishError(uuid, req.SessionId, err)
 				}
-				if err := event.MarshalTo(c.Response()); err != nil {
-					return err
-				}
-				c.Response().Flush()
 			case err := <-errChan:
+				// every reply is sent before the chat returns, flush the remaining ones
+				for len(replyChan) > 0 {
+					if err := h.writeOpenAiReply(c, req.SessionId, (<-replyChan).(dto.OpenAiResp), answer); err != nil {
+						return h.publishError(uuid, req.SessionId, err)
+					}
+				}
 				if err != nil {
 					h.logger.Errorf("chat error: %v", err)
+					return h.publishError(uuid, req.SessionId, err)
 				}
-				return err
+				h.collabService.Publish(req.SessionId, dto.CollabEvent{Type: dto.CollabEventDone, UserId: uuid})
+				h.afterChat(uuid, ownerId, convertedReq, answer.String(), usage)
+				return nil
 			}
 		}
 	default:
 		return errors.Join(errors.New("model provider not supported"), h.err)
 	}
 }
+
+// writeOpenAiReply sends the delta to the client and the session's subscribers, and collects it into the answer
+func (h *Handler) writeOpenAiReply(c echo.Context, sessionId string, reply dto.OpenAiResp, answer *strings.Builder) error {
+	content := reply.Choices[0].Delta.Content
+	if content != dto.OpenAiMessageEnding {
+		answer.WriteString(content)
+		h.collabService.Publish(sessionId, dto.CollabEvent{Type: dto.CollabEventDelta, Content: content})
+	}
+	event := Event{
+		Data: []byte(content),
+	}
+	if err := event.MarshalTo(c.Response()); err != nil {
+		return err
+	}
+	c.Response().Flush()
+	return nil
+}
+
+// publishTurn tells the session's subscribers who is asking what
+func (h *Handler) publishTurn(uuid string, req *dto.OpenAiReqFromClient) {
+	if len(req.Messages) == 0 {
+		return
+	}
+	h.collabService.Publish(req.SessionId, dto.CollabEvent{
+		Type:    dto.CollabEventTurn,
+		UserId:  uuid,
+		Content: req.Messages[len(req.Messages)-1].Content,
+	})
+}
+
+// publishError tells the session's subscribers that the turn ended without an answer
+func (h *Handler) publishError(uuid, sessionId string, err error) error {
+	h.collabService.Publish(sessionId, dto.CollabEvent{Type: dto.CollabEventError, UserId: uuid})
+	return err
+}
+
+// afterChat runs the follow-up work of a finished chat turn in the background
+// the draft is saved first so that the generated title lands on the saved session,
+// the turn is saved into the owner's session, which differs from the caller when a participant chats
+func (h *Handler) afterChat(uuid, ownerId string, req *dto.OpenAiReqFromClient, answer string, usage *dto.OpenAiUsage) {
+	go func() {
+		if err := h.messageService.SaveDraft(ownerId, req.SessionId, req.ModelId, req.Messages, answer, usage); err != nil {
+			h.logger.Errorf("save draft error: %v", err)
+		}
+		if err := h.messageService.GenerateTitle(uuid, ownerId, req.SessionId, req.ModelId, req.Messages, answer); err != nil {
+			h.logger.Errorf("generate title error: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/zenpk/chatbone/dto"
+)
+
+const (
+	EventCollab             = "collab"
+	collabKeepAliveInterval = 30 * time.Second
+)
+
+func (h *Handler) getMembers(c echo.Context) error {
+	ownerId, members, err := h.collabService.GetMembers(c.Get(KeyUuid).(string), c.Param("sessionId"))
+	if err != nil {
+		h.setErrCode(c, err, dto.ErrUnknown)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.MembersResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		OwnerId:    ownerId,
+		Members:    members,
+	})
+}
+
+func (h *Handler) inviteMember(c echo.Context) error {
+	req := new(dto.MemberReq)
+	if err := c.Bind(req); err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	member, err := h.collabService.Invite(c.Get(KeyUuid).(string), c.Param("sessionId"), c.Param("userId"), req.Role)
+	if err != nil {
+		h.setErrCode(c, err, dto.ErrInput)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.MemberResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Member:     member,
+	})
+}
+
+// removeMember lets the owner remove a member, or a member leave by removing themselves
+func (h *Handler) removeMember(c echo.Context) error {
+	if err := h.collabService.Remove(c.Get(KeyUuid).(string), c.Param("sessionId"), c.Param("userId")); err != nil {
+		h.setErrCode(c, err, dto.ErrUnknown)
+		return err
+	}
+	return h.success(c)
+}
+
+// subscribeSession streams the chat turns of everyone in the session,
+// the first event is the snapshot of the messages so a reconnected client catches up
+func (h *Handler) subscribeSession(c echo.Context) error {
+	uuid := c.Get(KeyUuid).(string)
+	session, events, removed, unsubscribe, err := h.collabService.Subscribe(uuid, c.Param("sessionId"))
+	if err != nil {
+		h.setErrCode(c, err, dto.ErrUnknown)
+		return err
+	}
+	defer unsubscribe()
+	h.setStreamHeaders(c)
+	if err := h.writeCollabEvent(c, dto.CollabEvent{
+		Type:     dto.CollabEventSnapshot,
+		UserId:   session.UserId,
+		Messages: session.Messages,
+	}); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(collabKeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case event := <-events:
+			if err := h.writeCollabEvent(c, event); err != nil {
+				return err
+			}
+		case <-removed:
+			// the events queued before the removal are still sent
+			for len(events) > 0 {
+				if err := h.writeCollabEvent(c, <-events); err != nil {
+					return err
+				}
+			}
+			return h.writeCollabEvent(c, dto.CollabEvent{Type: dto.CollabEventRemoved})
+		case <-ticker.C:
+			event := Event{Comment: []byte("keep-alive")}
+			if err := event.MarshalTo(c.Response()); err != nil {
+				return err
+			}
+			c.Response().Flush()
+		}
+	}
+}
+
+func (h *Handler) writeCollabEvent(c echo.Context, collabEvent dto.CollabEvent) error {
+	data, err := json.Marshal(collabEvent)
+	if err != nil {
+		return err
+	}
+	event := Event{Event: []byte(EventCollab), Data: data}
+	if err := event.MarshalTo(c.Response()); err != nil {
+		return err
+	}
+	c.Response().Flush()
+	return nil
+}
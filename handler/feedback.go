@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/zenpk/chatbone/dal"
+	"github.com/zenpk/chatbone/dto"
+)
+
+func (h *Handler) getFeedbacks(c echo.Context) error {
+	feedbacks, err := h.feedbackService.GetAll(c.Get(KeyUuid).(string), c.Param("sessionId"))
+	if err != nil {
+		h.setErrCode(c, err, dto.ErrUnknown)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.FeedbacksResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Feedbacks:  feedbacks,
+	})
+}
+
+func (h *Handler) submitFeedback(c echo.Context) error {
+	req := new(dto.FeedbackReq)
+	if err := c.Bind(req); err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	feedback, err := h.feedbackService.Submit(c.Get(KeyUuid).(string), c.Param("sessionId"), c.Param("messageId"), req)
+	if err != nil {
+		h.setErrCode(c, err, dto.ErrInput)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.FeedbackResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Feedback:   feedback,
+	})
+}
+
+func (h *Handler) deleteFeedback(c echo.Context) error {
+	if err := h.feedbackService.Delete(c.Get(KeyUuid).(string), c.Param("sessionId"), c.Param("messageId")); err != nil {
+		h.setErrCode(c, err, dto.ErrUnknown)
+		return err
+	}
+	return h.success(c)
+}
+
+// exportFeedback streams the feedback as JSONL, it supports the filters: modelId, rating, from and to
+func (h *Handler) exportFeedback(c echo.Context) error {
+	filter, err := h.bindFeedbackFilter(c)
+	if err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	fileName := fmt.Sprintf("feedback-%v.jsonl", time.Now().UTC().Format("20060102-150405"))
+	c.Response().Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%v"`, fileName))
+	c.Response().WriteHeader(http.StatusOK)
+	// the headers are sent, errors can only be logged from now on
+	if err := h.feedbackService.Export(c.Request().Context(), filter, c.Response()); err != nil {
+		h.logger.Errorf("export feedback error: %v", err)
+	}
+	return nil
+}
+
+// getFeedbackStats supports the same filters as exportFeedback except rating
+func (h *Handler) getFeedbackStats(c echo.Context) error {
+	filter, err := h.bindFeedbackFilter(c)
+	if err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	filter.Rating = 0
+	stats, err := h.feedbackService.GetStats(filter)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.FeedbackStatsResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Stats:      stats,
+	})
+}
+
+func (h *Handler) bindFeedbackFilter(c echo.Context) (*dal.FeedbackFilter, error) {
+	filter := new(dal.FeedbackFilter)
+	if err := echo.QueryParamsBinder(c).
+		Int("modelId", &filter.ModelId).
+		Int("rating", &filter.Rating).
+		Int64("from", &filter.From).
+		Int64("to", &filter.To).
+		BindError(); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
@@ -9,21 +9,32 @@ import (
 	"fmt"
 	"math/big"
 	"net/http"
+	"slices"
 	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/zenpk/chatbone/dal"
 	"github.com/zenpk/chatbone/dto"
 	"github.com/zenpk/chatbone/service"
 	"github.com/zenpk/chatbone/util"
 )
 
 type Handler struct {
-	modelService   *service.Model
-	oAuthService   *service.OAuth
-	messageService *service.Message
-	openAiService  *service.OpenAi
-	userService    *service.User
+	modelService      *service.Model
+	oAuthService      *service.OAuth
+	messageService    *service.Message
+	openAiService     *service.OpenAi
+	userService       *service.User
+	arenaService      *service.Arena
+	personaService    *service.Persona
+	templateService   *service.Template
+	shareService      *service.Share
+	labelService      *service.Label
+	feedbackService   *service.Feedback
+	attachmentService *service.Attachment
+	libraryService    *service.Library
+	collabService     *service.Collab
 
 	e            *echo.Echo
 	conf         *util.Configuration
@@ -34,7 +45,10 @@ type Handler struct {
 
 func New(conf *util.Configuration, logger util.ILogger,
 	modelService *service.Model, oAuthService *service.OAuth, messageService *service.Message, openAiService *service.OpenAi,
-	userService *service.User,
+	userService *service.User, arenaService *service.Arena, personaService *service.Persona,
+	templateService *service.Template, shareService *service.Share, labelService *service.Label,
+	feedbackService *service.Feedback, attachmentService *service.Attachment, libraryService *service.Library,
+	collabService *service.Collab,
 ) (*Handler, error) {
 	h := new(Handler)
 	h.conf = conf
@@ -46,6 +60,15 @@ func New(conf *util.Configuration, logger util.ILogger,
 	h.messageService = messageService
 	h.openAiService = openAiService
 	h.userService = userService
+	h.arenaService = arenaService
+	h.personaService = personaService
+	h.templateService = templateService
+	h.shareService = shareService
+	h.labelService = labelService
+	h.feedbackService = feedbackService
+	h.attachmentService = attachmentService
+	h.libraryService = libraryService
+	h.collabService = collabService
 
 	// get JWK from the OAuth 2.0 endpoint
 	client := http.Client{
@@ -87,10 +110,16 @@ func New(conf *util.Configuration, logger util.ILogger,
 	h.e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
 		AllowOrigins:     h.conf.AllowOrigins,
 		AllowMethods:     []string{"*"},
-		AllowHeaders:     []string{"Origin", "X-Requested-With", "Content-Type", "Accept", "Authorization"},
+		AllowHeaders:     []string{"Origin", "X-Requested-With", "Content-Type", "Accept", "Authorization", HeaderSharePassword},
 		AllowCredentials: true,
 	}))
-	h.e.Use(middleware.BodyLimit("2M"))
+	h.e.Use(middleware.BodyLimitWithConfig(middleware.BodyLimitConfig{
+		// routes with their own limits
+		Skipper: func(c echo.Context) bool {
+			return c.Path() == "/import" || c.Path() == "/attachment" || c.Path() == "/library/:libraryId/document"
+		},
+		Limit: "2M",
+	}))
 	h.e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			c.Set(KeyUsername, "unknown user")
@@ -119,11 +148,95 @@ func New(conf *util.Configuration, logger util.ILogger,
 func (h *Handler) setRoutes() {
 	h.e.POST("/authorize", h.Authorize)
 	h.e.POST("/refresh", h.Refresh)
+	// public read-only shares
+	h.e.GET("/share/:token", h.getShared)
+	h.e.GET("/share/:token/html", h.getSharedHtml)
+	h.e.POST("/share/:token/html", h.getSharedHtml)
 
 	// auth group
 	g := h.e.Group("/")
 	g.Use(h.jwtMiddleware)
 	g.POST("chat", h.chat)
+	g.POST("arena", h.arena)
+	g.POST("arena/vote", h.arenaVote)
+	g.GET("arena/leaderboard", h.arenaLeaderboard, h.adminMiddleware)
+	g.GET("persona", h.getPersonas)
+	g.POST("persona", h.createPersona)
+	g.PUT("persona/:id", h.updatePersona)
+	g.DELETE("persona/:id", h.deletePersona)
+	g.GET("template", h.getTemplates)
+	g.POST("template", h.createTemplate)
+	g.PUT("template/:id", h.updateTemplate)
+	g.DELETE("template/:id", h.deleteTemplate)
+	g.GET("label", h.getLabels)
+	g.POST("label", h.createLabel)
+	g.PUT("label/:id", h.updateLabel)
+	g.DELETE("label/:id", h.deleteLabel)
+	g.GET("library", h.getLibraries)
+	g.POST("library", h.createLibrary)
+	g.PUT("library/:libraryId", h.renameLibrary)
+	g.DELETE("library/:libraryId", h.deleteLibrary)
+	g.GET("library/:libraryId/document", h.getDocuments)
+	g.POST("library/:libraryId/document", h.uploadDocument, middleware.BodyLimit(h.bodyLimit(h.conf.DocumentSizeLimit)))
+	g.DELETE("library/:libraryId/document/:documentId", h.deleteDocument)
+	g.GET("draft", h.getDraft)
+	g.POST("draft/save", h.promoteDraft)
+	g.GET("export", h.exportSessions)
+	g.POST("import", h.importSessions, middleware.BodyLimit(h.bodyLimit(h.conf.ImportSizeLimit)))
+	g.POST("attachment", h.uploadAttachment, middleware.BodyLimit(h.bodyLimit(h.conf.AttachmentSizeLimit)))
+	g.GET("attachment/:attachmentId", h.getAttachment)
+	g.DELETE("attachment/:attachmentId", h.deleteAttachment)
+	g.GET("search", h.searchSessions)
+	g.GET("session", h.getSessions)
+	g.GET("session/:sessionId", h.getSession)
+	g.PUT("session/:sessionId", h.saveSession)
+	g.PUT("session/:sessionId/title", h.renameSession)
+	g.PUT("session/:sessionId/folder", h.moveSession)
+	g.PUT("session/:sessionId/tags", h.tagSession)
+	g.PUT("session/:sessionId/pin", h.pinSession)
+	g.PUT("session/:sessionId/library", h.attachLibrary)
+	g.PUT("session/:sessionId/settings", h.updateSessionSettings)
+	g.POST("session/:sessionId/fork", h.forkSession)
+	g.GET("session/:sessionId/subscribe", h.subscribeSession)
+	g.GET("session/:sessionId/member", h.getMembers)
+	g.PUT("session/:sessionId/member/:userId", h.inviteMember)
+	g.DELETE("session/:sessionId/member/:userId", h.removeMember)
+	g.PUT("session/:sessionId/message/:messageId", h.editMessage)
+	g.GET("session/:sessionId/message/:messageId/version", h.getVersions)
+	g.POST("session/:sessionId/message/:messageId/version/:versionId/restore", h.restoreVersion)
+	g.GET("session/:sessionId/feedback", h.getFeedbacks)
+	g.GET("session/:sessionId/attachment", h.getAttachments)
+	g.PUT("session/:sessionId/message/:messageId/feedback", h.submitFeedback)
+	g.DELETE("session/:sessionId/message/:messageId/feedback", h.deleteFeedback)
+	g.DELETE("session/:sessionId", h.deleteSession)
+	g.GET("session/:sessionId/export", h.exportSession)
+	g.GET("session/:sessionId/share", h.getShares)
+	g.POST("session/:sessionId/share", h.createShare)
+	g.DELETE("share/:token", h.revokeShare)
+	g.POST("share/:token/fork", h.forkShared)
+	g.GET("usage", h.getUsage)
+	g.GET("transaction", h.getTransactions)
+	g.GET("clipboard", h.getClipboard)
+	g.PUT("clipboard", h.setClipboard)
+	g.GET("clipboard/subscribe", h.subscribeClipboard)
+	g.GET("trash", h.getTrash)
+	g.DELETE("trash", h.emptyTrash)
+	g.POST("trash/:sessionId/restore", h.restoreSession)
+	g.DELETE("trash/:sessionId", h.purgeSession)
+	// admin only
+	g.GET("admin/feedback/export", h.exportFeedback, h.adminMiddleware)
+	g.GET("admin/feedback/stats", h.getFeedbackStats, h.adminMiddleware)
+	g.POST("admin/user/:userId/balance", h.adjustBalance, h.adminMiddleware)
+}
+
+// adminMiddleware only lets the configured admins through, it runs after jwtMiddleware
+func (h *Handler) adminMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !slices.Contains(h.conf.AdminUuids, c.Get(KeyUuid).(string)) {
+			return c.JSON(http.StatusOK, dto.CommonResp{Code: dto.ErrForbidden, Msg: "admin only"})
+		}
+		return next(c)
+	}
 }
 
 func (h *Handler) jwtMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
@@ -168,6 +281,44 @@ func (h *Handler) success(c echo.Context) error {
 	return c.JSON(http.StatusOK, dto.CommonResp{Code: dto.ErrOk, Msg: "success"})
 }
 
+// bodyLimit falls back to the global limit if the configured one is missing
+func (h *Handler) bodyLimit(limit string) string {
+	if limit == "" {
+		return "2M"
+	}
+	return limit
+}
+
+// bindPage reads the page query params: cursor and limit
+func (h *Handler) bindPage(c echo.Context) (*dal.Page, error) {
+	page := new(dal.Page)
+	if err := echo.QueryParamsBinder(c).
+		String("cursor", &page.Cursor).
+		Int64("limit", &page.Size).
+		BindError(); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// setErrCode maps the service errors to error codes, fallback is used for the others
+func (h *Handler) setErrCode(c echo.Context, err error, fallback int) {
+	switch {
+	case errors.Is(err, service.ErrNotFound):
+		c.Set(KeyErrCode, dto.ErrNotFound)
+	case errors.Is(err, service.ErrForbidden):
+		c.Set(KeyErrCode, dto.ErrForbidden)
+	case errors.Is(err, service.ErrUnauthorized):
+		c.Set(KeyErrCode, dto.ErrUnauthorized)
+	case errors.Is(err, dal.ErrInvalidCursor):
+		c.Set(KeyErrCode, dto.ErrInput)
+	case errors.Is(err, dal.ErrInsufficientBalance):
+		c.Set(KeyErrCode, dto.ErrBalance)
+	default:
+		c.Set(KeyErrCode, fallback)
+	}
+}
+
 func (h *Handler) Shutdown(ctx context.Context) error {
 	return h.e.Shutdown(ctx)
 }
@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/zenpk/chatbone/dto"
+)
+
+// getLabels supports the type filter: folder or tag
+func (h *Handler) getLabels(c echo.Context) error {
+	labels, err := h.labelService.GetAll(c.Get(KeyUuid).(string), c.QueryParam("type"))
+	if err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.LabelsResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Labels:     labels,
+	})
+}
+
+func (h *Handler) createLabel(c echo.Context) error {
+	req := new(dto.LabelReq)
+	if err := c.Bind(req); err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	label, err := h.labelService.Create(c.Get(KeyUuid).(string), req)
+	if err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.LabelResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Label:      label,
+	})
+}
+
+func (h *Handler) updateLabel(c echo.Context) error {
+	req := new(dto.LabelReq)
+	if err := c.Bind(req); err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	label, err := h.labelService.Update(c.Get(KeyUuid).(string), c.Param("id"), req)
+	if err != nil {
+		h.setErrCode(c, err, dto.ErrInput)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.LabelResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Label:      label,
+	})
+}
+
+func (h *Handler) deleteLabel(c echo.Context) error {
+	if err := h.labelService.Delete(c.Get(KeyUuid).(string), c.Param("id")); err != nil {
+		h.setErrCode(c, err, dto.ErrInput)
+		return err
+	}
+	return h.success(c)
+}
+
+func (h *Handler) moveSession(c echo.Context) error {
+	req := new(dto.MoveSessionReq)
+	if err := c.Bind(req); err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	if err := h.labelService.Move(c.Get(KeyUuid).(string), c.Param("sessionId"), req.FolderId); err != nil {
+		h.setErrCode(c, err, dto.ErrInput)
+		return err
+	}
+	return h.success(c)
+}
+
+func (h *Handler) tagSession(c echo.Context) error {
+	req := new(dto.TagSessionReq)
+	if err := c.Bind(req); err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	if err := h.labelService.Tag(c.Get(KeyUuid).(string), c.Param("sessionId"), req.TagIds); err != nil {
+		h.setErrCode(c, err, dto.ErrInput)
+		return err
+	}
+	return h.success(c)
+}
@@ -0,0 +1,139 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/zenpk/chatbone/dto"
+)
+
+const (
+	EventCitation = "citation"
+)
+
+func (h *Handler) getLibraries(c echo.Context) error {
+	libraries, err := h.libraryService.GetAll(c.Get(KeyUuid).(string))
+	if err != nil {
+		c.Set(KeyErrCode, dto.ErrUnknown)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.LibrariesResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Libraries:  libraries,
+	})
+}
+
+func (h *Handler) createLibrary(c echo.Context) error {
+	req := new(dto.LibraryReq)
+	if err := c.Bind(req); err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	library, err := h.libraryService.Create(c.Get(KeyUuid).(string), req)
+	if err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.LibraryResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Library:    library,
+	})
+}
+
+func (h *Handler) renameLibrary(c echo.Context) error {
+	req := new(dto.LibraryReq)
+	if err := c.Bind(req); err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	library, err := h.libraryService.Rename(c.Get(KeyUuid).(string), c.Param("libraryId"), req)
+	if err != nil {
+		h.setErrCode(c, err, dto.ErrInput)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.LibraryResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Library:    library,
+	})
+}
+
+func (h *Handler) deleteLibrary(c echo.Context) error {
+	if err := h.libraryService.Delete(c.Get(KeyUuid).(string), c.Param("libraryId")); err != nil {
+		h.setErrCode(c, err, dto.ErrUnknown)
+		return err
+	}
+	return h.success(c)
+}
+
+func (h *Handler) getDocuments(c echo.Context) error {
+	documents, err := h.libraryService.GetDocuments(c.Get(KeyUuid).(string), c.Param("libraryId"))
+	if err != nil {
+		h.setErrCode(c, err, dto.ErrUnknown)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.DocumentsResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Documents:  documents,
+	})
+}
+
+// uploadDocument accepts a multipart form with the file, the embedding is done before responding
+func (h *Handler) uploadDocument(c echo.Context) error {
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	src, err := file.Open()
+	if err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	defer src.Close()
+	document, err := h.libraryService.Upload(c.Get(KeyUuid).(string), c.Param("libraryId"), file.Filename, src)
+	if err != nil {
+		h.setErrCode(c, err, dto.ErrInput)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.DocumentResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Document:   document,
+	})
+}
+
+func (h *Handler) deleteDocument(c echo.Context) error {
+	if err := h.libraryService.DeleteDocument(c.Get(KeyUuid).(string), c.Param("libraryId"),
+		c.Param("documentId")); err != nil {
+		h.setErrCode(c, err, dto.ErrUnknown)
+		return err
+	}
+	return h.success(c)
+}
+
+func (h *Handler) attachLibrary(c echo.Context) error {
+	req := new(dto.AttachLibraryReq)
+	if err := c.Bind(req); err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	if err := h.libraryService.Attach(c.Get(KeyUuid).(string), c.Param("sessionId"), req.LibraryId); err != nil {
+		h.setErrCode(c, err, dto.ErrInput)
+		return err
+	}
+	return h.success(c)
+}
+
+// writeCitationEvent sends the retrieved chunks before the reply
+func (h *Handler) writeCitationEvent(c echo.Context, citations []*dto.Citation) error {
+	data, err := json.Marshal(dto.CitationEvent{Citations: citations})
+	if err != nil {
+		return err
+	}
+	event := Event{Event: []byte(EventCitation), Data: data}
+	if err := event.MarshalTo(c.Response()); err != nil {
+		return err
+	}
+	c.Response().Flush()
+	return nil
+}
@@ -0,0 +1,281 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/zenpk/chatbone/dal"
+	"github.com/zenpk/chatbone/dto"
+	"github.com/zenpk/chatbone/service"
+)
+
+// getSessions lists a page of sessions with the pinned ones first,
+// it supports the same filters as searchSessions
+func (h *Handler) getSessions(c echo.Context) error {
+	filter, err := h.bindMessageFilter(c)
+	if err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	page, err := h.bindPage(c)
+	if err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	sessions, next, err := h.messageService.GetSessions(c.Get(KeyUuid).(string), filter, page)
+	if err != nil {
+		h.setErrCode(c, err, dto.ErrUnknown)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.SessionsResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Sessions:   sessions,
+		NextCursor: next,
+	})
+}
+
+func (h *Handler) getSession(c echo.Context) error {
+	session, err := h.messageService.GetSession(c.Get(KeyUuid).(string), c.Param("sessionId"))
+	if err != nil {
+		h.setErrCode(c, err, dto.ErrUnknown)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.SessionResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Session:    session,
+		Messages:   session.Messages,
+	})
+}
+
+func (h *Handler) updateSessionSettings(c echo.Context) error {
+	req := new(dto.SessionSettingsReq)
+	if err := c.Bind(req); err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	settings, err := h.messageService.UpdateSettings(c.Get(KeyUuid).(string), c.Param("sessionId"), req)
+	if err != nil {
+		h.setErrCode(c, err, dto.ErrInput)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.SessionSettingsResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Settings:   settings,
+		LibraryId:  req.LibraryId,
+	})
+}
+
+func (h *Handler) forkSession(c echo.Context) error {
+	req := new(dto.ForkSessionReq)
+	if err := c.Bind(req); err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	session, err := h.messageService.Fork(c.Get(KeyUuid).(string), c.Param("sessionId"), req)
+	if err != nil {
+		h.setErrCode(c, err, dto.ErrInput)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.SessionResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Session:    session,
+		Messages:   session.Messages,
+	})
+}
+
+func (h *Handler) saveSession(c echo.Context) error {
+	req := new(dto.SaveSessionReq)
+	if err := c.Bind(req); err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	session, err := h.messageService.Save(c.Get(KeyUuid).(string), c.Param("sessionId"), req)
+	if err != nil {
+		h.setErrCode(c, err, dto.ErrInput)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.SessionResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Session:    session,
+		Messages:   session.Messages,
+	})
+}
+
+func (h *Handler) renameSession(c echo.Context) error {
+	req := new(dto.RenameSessionReq)
+	if err := c.Bind(req); err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	if err := h.messageService.Rename(c.Get(KeyUuid).(string), c.Param("sessionId"), req.Title); err != nil {
+		h.setErrCode(c, err, dto.ErrInput)
+		return err
+	}
+	return h.success(c)
+}
+
+func (h *Handler) pinSession(c echo.Context) error {
+	req := new(dto.PinSessionReq)
+	if err := c.Bind(req); err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	if err := h.messageService.Pin(c.Get(KeyUuid).(string), c.Param("sessionId"), req.Pinned); err != nil {
+		h.setErrCode(c, err, dto.ErrInput)
+		return err
+	}
+	return h.success(c)
+}
+
+func (h *Handler) deleteSession(c echo.Context) error {
+	if err := h.messageService.Delete(c.Get(KeyUuid).(string), c.Param("sessionId")); err != nil {
+		h.setErrCode(c, err, dto.ErrUnknown)
+		return err
+	}
+	return h.success(c)
+}
+
+func (h *Handler) getDraft(c echo.Context) error {
+	draft, err := h.messageService.GetDraft(c.Get(KeyUuid).(string))
+	if err != nil {
+		h.setErrCode(c, err, dto.ErrUnknown)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.SessionResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Session:    draft,
+		Messages:   draft.Messages,
+	})
+}
+
+func (h *Handler) promoteDraft(c echo.Context) error {
+	req := new(dto.PromoteDraftReq)
+	if err := c.Bind(req); err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	draft, err := h.messageService.PromoteDraft(c.Get(KeyUuid).(string), req.Title)
+	if err != nil {
+		h.setErrCode(c, err, dto.ErrInput)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.SessionResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Session:    draft,
+	})
+}
+
+// searchSessions supports the same filters as getSessions
+func (h *Handler) searchSessions(c echo.Context) error {
+	filter, err := h.bindMessageFilter(c)
+	if err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	results, err := h.messageService.Search(c.Get(KeyUuid).(string), c.QueryParam("q"), filter)
+	if err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.SearchResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Results:    results,
+	})
+}
+
+// bindMessageFilter reads the filters: modelId, from, to (ms timestamps), saved, shared, folderId, tagId and pinned
+func (h *Handler) bindMessageFilter(c echo.Context) (*dal.MessageFilter, error) {
+	filter := new(dal.MessageFilter)
+	if err := echo.QueryParamsBinder(c).
+		Int("modelId", &filter.ModelId).
+		Int64("from", &filter.From).
+		Int64("to", &filter.To).
+		String("folderId", &filter.FolderId).
+		String("tagId", &filter.TagId).
+		BindError(); err != nil {
+		return nil, err
+	}
+	var err error
+	if filter.Saved, err = h.queryBool(c, "saved"); err != nil {
+		return nil, err
+	}
+	if filter.Shared, err = h.queryBool(c, "shared"); err != nil {
+		return nil, err
+	}
+	if filter.Pinned, err = h.queryBool(c, "pinned"); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// queryBool returns nil if the query param is absent
+func (h *Handler) queryBool(c echo.Context, name string) (*bool, error) {
+	param := c.QueryParam(name)
+	if param == "" {
+		return nil, nil
+	}
+	value, err := strconv.ParseBool(param)
+	if err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
+
+func (h *Handler) exportSession(c echo.Context) error {
+	format := c.QueryParam("format")
+	contentType, _, err := service.ExportContentType(format)
+	if err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	buf := new(bytes.Buffer)
+	fileName, err := h.messageService.Export(c.Get(KeyUuid).(string), c.Param("sessionId"), format, buf)
+	if err != nil {
+		h.setErrCode(c, err, dto.ErrUnknown)
+		return err
+	}
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", fileName))
+	return c.Blob(http.StatusOK, contentType, buf.Bytes())
+}
+
+// exportSessions streams all the sessions as a zip
+func (h *Handler) exportSessions(c echo.Context) error {
+	format := c.QueryParam("format")
+	if _, _, err := service.ExportContentType(format); err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	c.Response().Header().Set(echo.HeaderContentType, "application/zip")
+	c.Response().Header().Set(echo.HeaderContentDisposition,
+		fmt.Sprintf("attachment; filename=%q", "chatbone-export-"+format+".zip"))
+	c.Response().WriteHeader(http.StatusOK)
+	if err := h.messageService.ExportAll(c.Get(KeyUuid).(string), format, c.Response()); err != nil {
+		// the response is already committed, the broken zip tells the client it failed
+		h.logger.Errorf("export error: %v", err)
+	}
+	return nil
+}
+
+// importSessions accepts the file either as the multipart field "file" or as the raw body
+func (h *Handler) importSessions(c echo.Context) error {
+	reader := c.Request().Body
+	if file, err := c.FormFile("file"); err == nil {
+		src, err := file.Open()
+		if err != nil {
+			c.Set(KeyErrCode, dto.ErrInput)
+			return err
+		}
+		defer src.Close()
+		reader = src
+	}
+	report, err := h.messageService.Import(c.Get(KeyUuid).(string), reader)
+	if err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	report.CommonResp = dto.CommonResp{Code: dto.ErrOk, Msg: "success"}
+	return c.JSON(http.StatusOK, report)
+}
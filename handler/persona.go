@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/zenpk/chatbone/dto"
+)
+
+func (h *Handler) getPersonas(c echo.Context) error {
+	personas, err := h.personaService.GetAll(c.Get(KeyUuid).(string))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.PersonasResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Personas:   personas,
+	})
+}
+
+func (h *Handler) createPersona(c echo.Context) error {
+	req := new(dto.PersonaReq)
+	if err := c.Bind(req); err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	persona, err := h.personaService.Create(c.Get(KeyUuid).(string), req)
+	if err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.PersonaResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Persona:    persona,
+	})
+}
+
+func (h *Handler) updatePersona(c echo.Context) error {
+	req := new(dto.PersonaReq)
+	if err := c.Bind(req); err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	persona, err := h.personaService.Update(c.Get(KeyUuid).(string), c.Param("id"), req)
+	if err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.PersonaResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Persona:    persona,
+	})
+}
+
+func (h *Handler) deletePersona(c echo.Context) error {
+	if err := h.personaService.Delete(c.Get(KeyUuid).(string), c.Param("id")); err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	return h.success(c)
+}
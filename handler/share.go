@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/zenpk/chatbone/dto"
+)
+
+const (
+	HeaderSharePassword = "X-Share-Password"
+)
+
+func (h *Handler) createShare(c echo.Context) error {
+	req := new(dto.ShareReq)
+	if err := c.Bind(req); err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	share, err := h.shareService.Create(c.Get(KeyUuid).(string), c.Param("sessionId"), req)
+	if err != nil {
+		h.setErrCode(c, err, dto.ErrInput)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.ShareResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Share:      share,
+	})
+}
+
+func (h *Handler) getShares(c echo.Context) error {
+	shares, err := h.shareService.GetAll(c.Get(KeyUuid).(string), c.Param("sessionId"))
+	if err != nil {
+		h.setErrCode(c, err, dto.ErrUnknown)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.SharesResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Shares:     shares,
+	})
+}
+
+// forkShared copies the shared session into a new session of the user, the password is passed by the header
+func (h *Handler) forkShared(c echo.Context) error {
+	req := new(dto.ForkSessionReq)
+	if err := c.Bind(req); err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	session, err := h.shareService.Fork(c.Get(KeyUuid).(string), c.Param("token"),
+		c.Request().Header.Get(HeaderSharePassword), req)
+	if err != nil {
+		h.setErrCode(c, err, dto.ErrInput)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.SessionResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Session:    session,
+		Messages:   session.Messages,
+	})
+}
+
+func (h *Handler) revokeShare(c echo.Context) error {
+	if err := h.shareService.Revoke(c.Get(KeyUuid).(string), c.Param("token")); err != nil {
+		h.setErrCode(c, err, dto.ErrUnknown)
+		return err
+	}
+	return h.success(c)
+}
+
+// getShared is public, the password is passed by the header so that it isn't kept in URLs
+func (h *Handler) getShared(c echo.Context) error {
+	shared, err := h.shareService.GetShared(c.Param("token"), c.Request().Header.Get(HeaderSharePassword))
+	if err != nil {
+		h.setErrCode(c, err, dto.ErrUnknown)
+		return err
+	}
+	shared.CommonResp = dto.CommonResp{Code: dto.ErrOk, Msg: "success"}
+	return c.JSON(http.StatusOK, shared)
+}
+
+// getSharedHtml is public, it renders the shared session as a standalone page,
+// the password form is posted back to it, the password in the query isn't accepted
+func (h *Handler) getSharedHtml(c echo.Context) error {
+	password := ""
+	if c.Request().Method == http.MethodPost {
+		password = c.Request().PostFormValue("password")
+	}
+	buf := new(bytes.Buffer)
+	if err := h.shareService.WriteSharedHtml(buf, c.Param("token"), password); err != nil {
+		h.setErrCode(c, err, dto.ErrUnknown)
+		return err
+	}
+	header := c.Response().Header()
+	header.Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; form-action 'self'")
+	header.Set("Referrer-Policy", "no-referrer")
+	header.Set("X-Robots-Tag", "noindex")
+	header.Set(echo.HeaderCacheControl, "no-store")
+	return c.HTMLBlob(http.StatusOK, buf.Bytes())
+}
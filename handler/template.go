@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/zenpk/chatbone/dto"
+)
+
+func (h *Handler) getTemplates(c echo.Context) error {
+	templates, err := h.templateService.GetAll(c.Get(KeyUuid).(string))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.TemplatesResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Templates:  templates,
+	})
+}
+
+func (h *Handler) createTemplate(c echo.Context) error {
+	req := new(dto.TemplateReq)
+	if err := c.Bind(req); err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	template, err := h.templateService.Create(c.Get(KeyUuid).(string), req)
+	if err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.TemplateResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Template:   template,
+	})
+}
+
+func (h *Handler) updateTemplate(c echo.Context) error {
+	req := new(dto.TemplateReq)
+	if err := c.Bind(req); err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	template, err := h.templateService.Update(c.Get(KeyUuid).(string), c.Param("id"), req)
+	if err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.TemplateResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Template:   template,
+	})
+}
+
+func (h *Handler) deleteTemplate(c echo.Context) error {
+	if err := h.templateService.Delete(c.Get(KeyUuid).(string), c.Param("id")); err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	return h.success(c)
+}
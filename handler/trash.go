@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/zenpk/chatbone/dto"
+)
+
+func (h *Handler) getTrash(c echo.Context) error {
+	page, err := h.bindPage(c)
+	if err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	sessions, next, err := h.messageService.GetTrash(c.Get(KeyUuid).(string), page)
+	if err != nil {
+		h.setErrCode(c, err, dto.ErrUnknown)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.SessionsResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Sessions:   sessions,
+		NextCursor: next,
+	})
+}
+
+func (h *Handler) restoreSession(c echo.Context) error {
+	if err := h.messageService.Restore(c.Get(KeyUuid).(string), c.Param("sessionId")); err != nil {
+		h.setErrCode(c, err, dto.ErrInput)
+		return err
+	}
+	return h.success(c)
+}
+
+func (h *Handler) purgeSession(c echo.Context) error {
+	if err := h.messageService.DeletePermanently(c.Get(KeyUuid).(string), c.Param("sessionId")); err != nil {
+		h.setErrCode(c, err, dto.ErrUnknown)
+		return err
+	}
+	return h.success(c)
+}
+
+func (h *Handler) emptyTrash(c echo.Context) error {
+	count, err := h.messageService.EmptyTrash(c.Get(KeyUuid).(string))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.EmptyTrashResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Count:      count,
+	})
+}
@@ -1 +1,140 @@
 package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/zenpk/chatbone/dto"
+)
+
+const (
+	EventClipboard             = "clipboard"
+	clipboardKeepAliveInterval = 30 * time.Second
+)
+
+func (h *Handler) getUsage(c echo.Context) error {
+	page, err := h.bindPage(c)
+	if err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	usage, next, err := h.userService.GetUsage(c.Get(KeyUuid).(string), page)
+	if err != nil {
+		h.setErrCode(c, err, dto.ErrUnknown)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.UsageResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Usage:      usage,
+		NextCursor: next,
+	})
+}
+
+func (h *Handler) getTransactions(c echo.Context) error {
+	page, err := h.bindPage(c)
+	if err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	transactions, next, err := h.userService.GetTransactions(c.Get(KeyUuid).(string), page)
+	if err != nil {
+		h.setErrCode(c, err, dto.ErrUnknown)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.TransactionsResp{
+		CommonResp:   dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Transactions: transactions,
+		NextCursor:   next,
+	})
+}
+
+// adjustBalance lets an admin top up, refund, grant or adjust a user's balance
+func (h *Handler) adjustBalance(c echo.Context) error {
+	req := new(dto.BalanceReq)
+	if err := c.Bind(req); err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	transaction, err := h.userService.AdjustBalance(c.Get(KeyUuid).(string), c.Param("userId"), req)
+	if err != nil {
+		h.setErrCode(c, err, dto.ErrInput)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.BalanceResp{
+		CommonResp:  dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Transaction: transaction,
+	})
+}
+
+func (h *Handler) getClipboard(c echo.Context) error {
+	clipboard, err := h.userService.GetClipboard(c.Get(KeyUuid).(string))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.ClipboardResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Clipboard:  clipboard,
+	})
+}
+
+func (h *Handler) setClipboard(c echo.Context) error {
+	req := new(dto.ClipboardReq)
+	if err := c.Bind(req); err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	if err := h.userService.SetClipboard(c.Get(KeyUuid).(string), req.DeviceId, req.Clipboard); err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	return h.success(c)
+}
+
+// subscribeClipboard streams the clipboard updates from the user's other devices,
+// the first event is the current clipboard so a reconnected device catches up
+func (h *Handler) subscribeClipboard(c echo.Context) error {
+	uuid := c.Get(KeyUuid).(string)
+	updates, unsubscribe := h.userService.SubscribeClipboard(uuid, c.QueryParam("deviceId"))
+	defer unsubscribe()
+	clipboard, err := h.userService.GetClipboard(uuid)
+	if err != nil {
+		return err
+	}
+	h.setStreamHeaders(c)
+	if err := h.writeClipboardEvent(c, clipboard); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(clipboardKeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case clipboard := <-updates:
+			if err := h.writeClipboardEvent(c, clipboard); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			event := Event{Comment: []byte("keep-alive")}
+			if err := event.MarshalTo(c.Response()); err != nil {
+				return err
+			}
+			c.Response().Flush()
+		}
+	}
+}
+
+func (h *Handler) writeClipboardEvent(c echo.Context, clipboard string) error {
+	data, err := json.Marshal(dto.ClipboardEvent{Clipboard: clipboard})
+	if err != nil {
+		return err
+	}
+	event := Event{Event: []byte(EventClipboard), Data: data}
+	if err := event.MarshalTo(c.Response()); err != nil {
+		return err
+	}
+	c.Response().Flush()
+	return nil
+}
@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/zenpk/chatbone/dto"
+)
+
+func (h *Handler) editMessage(c echo.Context) error {
+	req := new(dto.EditMessageReq)
+	if err := c.Bind(req); err != nil {
+		c.Set(KeyErrCode, dto.ErrInput)
+		return err
+	}
+	message, err := h.messageService.EditMessage(c.Get(KeyUuid).(string), c.Param("sessionId"),
+		c.Param("messageId"), req.Content)
+	if err != nil {
+		h.setErrCode(c, err, dto.ErrInput)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.ChatMessageResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Message:    message,
+	})
+}
+
+func (h *Handler) getVersions(c echo.Context) error {
+	versions, err := h.messageService.GetVersions(c.Get(KeyUuid).(string), c.Param("sessionId"), c.Param("messageId"))
+	if err != nil {
+		h.setErrCode(c, err, dto.ErrUnknown)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.VersionsResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Versions:   versions,
+	})
+}
+
+func (h *Handler) restoreVersion(c echo.Context) error {
+	message, err := h.messageService.RestoreVersion(c.Get(KeyUuid).(string), c.Param("sessionId"),
+		c.Param("messageId"), c.Param("versionId"))
+	if err != nil {
+		h.setErrCode(c, err, dto.ErrUnknown)
+		return err
+	}
+	return c.JSON(http.StatusOK, dto.ChatMessageResp{
+		CommonResp: dto.CommonResp{Code: dto.ErrOk, Msg: "success"},
+		Message:    message,
+	})
+}
@@ -18,7 +18,10 @@ import (
 	"github.com/zenpk/chatbone/util"
 )
 
-var mode = flag.String("mode", "local", "define program mode")
+var (
+	mode    = flag.String("mode", "local", "define program mode")
+	migrate = flag.Bool("migrate", false, "convert the data stored in the old formats and exit")
+)
 
 func main() {
 	flag.Parse()
@@ -51,6 +54,22 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	if *migrate {
+		if err := db.MigrateMessages(); err != nil {
+			panic(err)
+		}
+		if err := db.MigratePinned(); err != nil {
+			panic(err)
+		}
+		if err := db.MigrateHistory(); err != nil {
+			panic(err)
+		}
+		if err := db.MigrateUsers(); err != nil {
+			panic(err)
+		}
+		log.Println("migration finished")
+		return
+	}
 	cache, err := cal.New(conf, logger, db)
 	if err != nil {
 		panic(err)
@@ -64,30 +83,81 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	messageService, err := service.NewMessage(conf, logger, db, cache)
+	attachmentService, err := service.NewAttachment(conf, logger, db)
 	if err != nil {
 		panic(err)
 	}
-	openAiService, err := service.NewOpenAi(conf, logger, db, cache)
+	openAiService, err := service.NewOpenAi(conf, logger, db, cache, attachmentService)
 	if err != nil {
 		panic(err)
 	}
-	userService, err := service.NewUser(conf, logger, db, cache)
+	messageService, err := service.NewMessage(conf, logger, db, cache, modelService, openAiService)
+	if err != nil {
+		panic(err)
+	}
+	broadcastService, err := service.NewBroadcast(conf, logger, db)
+	if err != nil {
+		panic(err)
+	}
+	userService, err := service.NewUser(conf, logger, db, cache, broadcastService)
+	if err != nil {
+		panic(err)
+	}
+	arenaService, err := service.NewArena(conf, logger, db, openAiService)
+	if err != nil {
+		panic(err)
+	}
+	personaService, err := service.NewPersona(conf, logger, db, modelService)
+	if err != nil {
+		panic(err)
+	}
+	templateService, err := service.NewTemplate(conf, logger, db)
+	if err != nil {
+		panic(err)
+	}
+	shareService, err := service.NewShare(conf, logger, db, messageService)
+	if err != nil {
+		panic(err)
+	}
+	labelService, err := service.NewLabel(conf, logger, db, messageService)
+	if err != nil {
+		panic(err)
+	}
+	feedbackService, err := service.NewFeedback(conf, logger, db, messageService)
+	if err != nil {
+		panic(err)
+	}
+	libraryService, err := service.NewLibrary(conf, logger, db, messageService, openAiService)
+	if err != nil {
+		panic(err)
+	}
+	collabService, err := service.NewCollab(conf, logger, db, messageService, broadcastService)
 	if err != nil {
 		panic(err)
 	}
 
-	hd, err := handler.New(conf, logger, modelService, oAuthService, messageService, openAiService, userService)
+	hd, err := handler.New(conf, logger, modelService, oAuthService, messageService, openAiService, userService,
+		arenaService, personaService, templateService, shareService, labelService, feedbackService, attachmentService,
+		libraryService, collabService)
 	if err != nil {
 		panic(err)
 	}
 
+	// background jobs
+	jobCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	go messageService.PurgeTrash(jobCtx)
+	go openAiService.ReleaseExpiredHolds(jobCtx)
+	go userService.Reconcile(jobCtx)
+	go broadcastService.Run(jobCtx)
+
 	// clean up
 	osSignalChan := make(chan os.Signal, 2)
 	signal.Notify(osSignalChan, os.Interrupt, syscall.SIGTERM)
 
 	go func() {
 		<-osSignalChan
+		stopJobs()
 		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 		defer cancel()
 		if err := hd.Shutdown(ctx); err != nil {
@@ -0,0 +1,184 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/zenpk/chatbone/dal"
+	"github.com/zenpk/chatbone/dto"
+	"github.com/zenpk/chatbone/util"
+)
+
+const (
+	arenaModelLimit  = 4
+	arenaTaskLimit   = 64
+	arenaTaskGeneral = "general"
+)
+
+type Arena struct {
+	conf   *util.Configuration
+	logger util.ILogger
+	err    error
+
+	arena         *dal.Arena
+	model         *dal.Model
+	openAiService *OpenAi
+}
+
+func NewArena(conf *util.Configuration, logger util.ILogger, db *dal.Database, openAiService *OpenAi) (*Arena, error) {
+	a := new(Arena)
+	a.conf = conf
+	a.logger = logger
+	a.arena = db.Arena
+	a.model = db.Model
+	a.openAiService = openAiService
+	a.err = errors.New("at Arena service")
+	return a, nil
+}
+
+// Start checks the compared models and records a new arena for the later vote
+func (a *Arena) Start(uuid string, req *dto.ArenaReqFromClient) (*dal.Arena, []*dal.Model, error) {
+	if uuid == "" || req == nil || req.SessionId == "" {
+		return nil, nil, errors.Join(errors.New("arena invalid input"), a.err)
+	}
+	if len(req.ModelIds) < 2 || len(req.ModelIds) > arenaModelLimit {
+		return nil, nil, errors.Join(fmt.Errorf("arena needs 2 to %v models", arenaModelLimit), a.err)
+	}
+	models := make([]*dal.Model, 0, len(req.ModelIds))
+	for i, id := range req.ModelIds {
+		for _, prev := range req.ModelIds[:i] {
+			if prev == id {
+				return nil, nil, errors.Join(errors.New("arena models should be distinct"), a.err)
+			}
+		}
+		model, err := a.model.SelectById(id)
+		if err != nil {
+			return nil, nil, errors.Join(err, a.err)
+		}
+		if model == nil {
+			return nil, nil, errors.Join(errors.New("model not found"), a.err)
+		}
+		if model.Provider != dal.ProviderOpenAi {
+			return nil, nil, errors.Join(errors.New("model provider not supported"), a.err)
+		}
+		models = append(models, model)
+	}
+	id, err := util.RandomString(12)
+	if err != nil {
+		return nil, nil, errors.Join(err, a.err)
+	}
+	arena := &dal.Arena{
+		Id:        id,
+		SessionId: req.SessionId,
+		UserId:    uuid,
+		Timestamp: util.GetTimestamp(),
+		ModelIds:  req.ModelIds,
+	}
+	if err := a.arena.Insert(arena); err != nil {
+		return nil, nil, errors.Join(err, a.err)
+	}
+	return arena, models, nil
+}
+
+// Chat fans the prompt out to all the models concurrently and tags every reply with its model,
+// each model is billed separately by its own provider call
+// a failed model doesn't stop the others, its error is sent as a tagged reply as well,
+// all the models are cancelled once the context is done
+func (a *Arena) Chat(ctx context.Context, uuid string, arena *dal.Arena, models []*dal.Model, messages []dto.OpenAiMessage,
+	respChan chan<- dto.ArenaResp,
+) error {
+	const ChanSize = 1024
+	if uuid == "" || arena == nil || respChan == nil {
+		return errors.Join(errors.New("arena chat invalid input"), a.err)
+	}
+	errs := make([]error, len(models))
+	var wg sync.WaitGroup
+	for i, model := range models {
+		wg.Add(1)
+		go func(i int, model *dal.Model) {
+			defer wg.Done()
+			modelChan := make(chan any, ChanSize)
+			forwarded := make(chan struct{})
+			go func() {
+				// once the client is gone, the replies are only drained
+				for reply := range modelChan {
+					select {
+					case respChan <- dto.ArenaResp{
+						ModelId: model.Id,
+						Content: reply.(dto.OpenAiResp).Choices[0].Delta.Content,
+					}:
+					case <-ctx.Done():
+					}
+				}
+				close(forwarded)
+			}()
+			_, err := a.openAiService.Chat(ctx, uuid, model, &dto.OpenAiReqFromClient{
+				ModelId:   model.Id,
+				SessionId: arena.SessionId,
+				Messages:  messages,
+			}, modelChan)
+			close(modelChan)
+			<-forwarded
+			if err != nil {
+				errs[i] = fmt.Errorf("model %v: %w", model.Id, err)
+				select {
+				case respChan <- dto.ArenaResp{ModelId: model.Id, Error: err.Error()}:
+				case <-ctx.Done():
+				}
+			}
+		}(i, model)
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return errors.Join(err, a.err)
+	}
+	return nil
+}
+
+func (a *Arena) Vote(uuid string, req *dto.ArenaVoteReq) error {
+	if uuid == "" || req == nil || req.ArenaId == "" {
+		return errors.Join(errors.New("vote invalid input"), a.err)
+	}
+	arena, err := a.arena.SelectById(req.ArenaId)
+	if err != nil {
+		return errors.Join(err, a.err)
+	}
+	if arena.UserId != uuid {
+		return errors.Join(errors.New("arena doesn't belong to the user"), a.err)
+	}
+	if req.PreferredModelId != 0 {
+		found := false
+		for _, id := range arena.ModelIds {
+			if id == req.PreferredModelId {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.Join(errors.New("preferred model is not in the arena"), a.err)
+		}
+	}
+	task := strings.ToLower(strings.TrimSpace(req.Task))
+	if task == "" {
+		task = arenaTaskGeneral
+	}
+	if len(task) > arenaTaskLimit {
+		return errors.Join(errors.New("task name too long"), a.err)
+	}
+	if err := a.arena.UpdateVote(arena.Id, req.PreferredModelId, task); err != nil {
+		return errors.Join(err, a.err)
+	}
+	return nil
+}
+
+// GetLeaderboard returns the vote results of every model, an empty task means all tasks
+func (a *Arena) GetLeaderboard(task string) ([]*dal.ArenaRank, error) {
+	ranks, err := a.arena.SelectRanks(strings.ToLower(strings.TrimSpace(task)))
+	if err != nil {
+		return nil, errors.Join(err, a.err)
+	}
+	return ranks, nil
+}
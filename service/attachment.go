@@ -0,0 +1,259 @@
+package service
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/zenpk/chatbone/dal"
+	"github.com/zenpk/chatbone/dto"
+	"github.com/zenpk/chatbone/util"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	attachmentFilenameLimit = 255 // runes
+	attachmentSniffLength   = 512 // bytes, what http.DetectContentType looks at
+	attachmentImageDetail   = "low"
+)
+
+// attachmentImageTypes are the image types the models accept
+var attachmentImageTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp"}
+
+type Attachment struct {
+	conf   *util.Configuration
+	logger util.ILogger
+	db     *dal.Database
+	err    error
+}
+
+func NewAttachment(conf *util.Configuration, logger util.ILogger, db *dal.Database) (*Attachment, error) {
+	a := new(Attachment)
+	a.conf = conf
+	a.logger = logger
+	a.db = db
+	a.err = errors.New("at Attachment service")
+	return a, nil
+}
+
+// GetAll returns the attachments uploaded to the session and the total bytes the user has uploaded
+func (a *Attachment) GetAll(uuid, sessionId string) ([]*dal.Attachment, int64, error) {
+	attachments, err := a.db.Attachment.SelectBySessionId(sessionId, uuid)
+	if err != nil {
+		return nil, 0, errors.Join(err, a.err)
+	}
+	used, err := a.db.Attachment.SumSizeByUserId(uuid)
+	if err != nil {
+		return nil, 0, errors.Join(err, a.err)
+	}
+	return attachments, used, nil
+}
+
+// Upload stores the file, the type is sniffed from the content instead of trusting the client,
+// only text and images are accepted
+func (a *Attachment) Upload(uuid, sessionId, filename string, size int64, source io.Reader) (*dal.Attachment, error) {
+	if sessionId == "" || size <= 0 {
+		return nil, errors.Join(errors.New("session ID should not be empty and the file should not be empty"), a.err)
+	}
+	if a.conf.AttachmentQuota > 0 {
+		used, err := a.db.Attachment.SumSizeByUserId(uuid)
+		if err != nil {
+			return nil, errors.Join(err, a.err)
+		}
+		if used+size > a.conf.AttachmentQuota {
+			return nil, errors.Join(errors.New("attachment quota exceeded"), a.err)
+		}
+	}
+	head := make([]byte, attachmentSniffLength)
+	n, err := io.ReadFull(source, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, errors.Join(err, a.err)
+	}
+	head = head[:n]
+	contentType, kind, err := sniffAttachment(head)
+	if err != nil {
+		return nil, errors.Join(err, a.err)
+	}
+	id, err := util.RandomString(12)
+	if err != nil {
+		return nil, errors.Join(err, a.err)
+	}
+	filename = truncate(filepath.Base(strings.ReplaceAll(filename, "\\", "/")), attachmentFilenameLimit)
+	if filename == "." || filename == "/" {
+		filename = id
+	}
+	attachment := &dal.Attachment{
+		Id:          id,
+		UserId:      uuid,
+		SessionId:   sessionId,
+		Filename:    filename,
+		ContentType: contentType,
+		Kind:        kind,
+		Size:        size,
+		Timestamp:   util.GetTimestamp(),
+	}
+	if err := a.db.Attachment.Insert(attachment, io.MultiReader(bytes.NewReader(head), source)); err != nil {
+		return nil, errors.Join(err, a.err)
+	}
+	return attachment, nil
+}
+
+// Open returns the attachment with a reader of its content, the caller should close the reader
+func (a *Attachment) Open(uuid, attachmentId string) (*dal.Attachment, io.ReadCloser, error) {
+	attachment, err := a.getOwnedAttachment(uuid, attachmentId)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := a.db.Attachment.Open(attachment.Id)
+	if err != nil {
+		return nil, nil, errors.Join(err, a.err)
+	}
+	return attachment, reader, nil
+}
+
+func (a *Attachment) Delete(uuid, attachmentId string) error {
+	attachment, err := a.getOwnedAttachment(uuid, attachmentId)
+	if err != nil {
+		return err
+	}
+	if err := a.db.Attachment.DeleteById(attachment.Id); err != nil {
+		return errors.Join(err, a.err)
+	}
+	return nil
+}
+
+// Expand converts the messages of the session for the model, text attachments are inlined into the message,
+// images are attached as image parts if the model supports them,
+// the inlined text counts towards the message length limit
+func (a *Attachment) Expand(uuid, sessionId string, model *dal.Model, messages []dto.OpenAiMessage) ([]dto.OpenAiMessageToOpenAi, error) {
+	result := make([]dto.OpenAiMessageToOpenAi, len(messages))
+	inlinedLen := 0
+	for i, message := range messages {
+		if len(message.AttachmentIds) == 0 {
+			result[i] = dto.OpenAiMessageToOpenAi{Role: message.Role, Content: message.Content}
+			continue
+		}
+		if message.Role != "user" {
+			return nil, errors.Join(errors.New("only user messages could have attachments"), a.err)
+		}
+		text := new(strings.Builder)
+		text.WriteString(message.Content)
+		images := make([]*dto.OpenAiContentPart, 0)
+		for _, attachmentId := range message.AttachmentIds {
+			attachment, content, err := a.read(uuid, sessionId, attachmentId)
+			if err != nil {
+				return nil, err
+			}
+			switch attachment.Kind {
+			case dal.AttachmentKindText:
+				inlinedLen += len(content)
+				if inlinedLen > a.conf.MessageLengthLimit {
+					return nil, errors.Join(errors.New("attachments too long"), a.err)
+				}
+				text.WriteString("\n\nFile: " + attachment.Filename + "\n```\n" +
+					strings.ToValidUTF8(string(content), string(utf8.RuneError)) + "\n```")
+			case dal.AttachmentKindImage:
+				if !model.SupportImage {
+					return nil, errors.Join(errors.New("the model doesn't support images"), a.err)
+				}
+				images = append(images, &dto.OpenAiContentPart{
+					Type: "image_url",
+					ImageUrl: &dto.OpenAiImageUrl{
+						Url:    "data:" + attachment.ContentType + ";base64," + base64.StdEncoding.EncodeToString(content),
+						Detail: attachmentImageDetail,
+					},
+				})
+			}
+		}
+		if len(images) == 0 {
+			result[i] = dto.OpenAiMessageToOpenAi{Role: message.Role, Content: text.String()}
+			continue
+		}
+		parts := make([]*dto.OpenAiContentPart, 0, len(images)+1)
+		if text.Len() > 0 {
+			parts = append(parts, &dto.OpenAiContentPart{Type: "text", Text: text.String()})
+		}
+		result[i] = dto.OpenAiMessageToOpenAi{Role: message.Role, Content: append(parts, images...)}
+	}
+	return result, nil
+}
+
+// read loads the whole content of the attachment, the attachments uploaded to the session by its owner
+// could be read by everyone with access to the session
+func (a *Attachment) read(uuid, sessionId, attachmentId string) (*dal.Attachment, []byte, error) {
+	if uuid == "" || attachmentId == "" {
+		return nil, nil, errors.Join(ErrNotFound, a.err)
+	}
+	attachment, err := a.db.Attachment.SelectById(attachmentId)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil, errors.Join(ErrNotFound, a.err)
+		}
+		return nil, nil, errors.Join(err, a.err)
+	}
+	if attachment.UserId != uuid {
+		if attachment.SessionId != sessionId && !slices.Contains(attachment.Holders, sessionId) {
+			return nil, nil, errors.Join(ErrForbidden, a.err)
+		}
+		session, _, err := sessionAccess(a.db, uuid, sessionId)
+		if err != nil {
+			return nil, nil, errors.Join(err, a.err)
+		}
+		if session.UserId != attachment.UserId {
+			return nil, nil, errors.Join(ErrForbidden, a.err)
+		}
+	}
+	reader, err := a.db.Attachment.Open(attachment.Id)
+	if err != nil {
+		return nil, nil, errors.Join(err, a.err)
+	}
+	defer reader.Close()
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, nil, errors.Join(err, a.err)
+	}
+	return attachment, content, nil
+}
+
+func (a *Attachment) getOwnedAttachment(uuid, attachmentId string) (*dal.Attachment, error) {
+	if uuid == "" || attachmentId == "" {
+		return nil, errors.Join(ErrNotFound, a.err)
+	}
+	attachment, err := a.db.Attachment.SelectById(attachmentId)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, errors.Join(ErrNotFound, a.err)
+		}
+		return nil, errors.Join(err, a.err)
+	}
+	if attachment.UserId != uuid {
+		return nil, errors.Join(ErrForbidden, a.err)
+	}
+	return attachment, nil
+}
+
+// sniffAttachment detects the content type and the kind from the beginning of the content
+func sniffAttachment(head []byte) (string, string, error) {
+	contentType := http.DetectContentType(head)
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", "", err
+	}
+	for _, imageType := range attachmentImageTypes {
+		if mediaType == imageType {
+			return mediaType, dal.AttachmentKindImage, nil
+		}
+	}
+	// HTML, XML and the like are inlined as plain text too
+	if strings.HasPrefix(mediaType, "text/") {
+		return "text/plain; charset=utf-8", dal.AttachmentKindText, nil
+	}
+	return "", "", errors.New("unsupported file type: " + mediaType)
+}
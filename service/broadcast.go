@@ -0,0 +1,70 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/zenpk/chatbone/dal"
+	"github.com/zenpk/chatbone/util"
+)
+
+// Broadcast passes the live events between the instances, every instance tails the shared events
+// and hands each of them to the handler of its topic, including the events it published itself
+type Broadcast struct {
+	conf   *util.Configuration
+	logger util.ILogger
+	db     *dal.Database
+	err    error
+
+	mutex    *sync.RWMutex
+	handlers map[string]func(key string, data []byte) // topic -> handler
+}
+
+func NewBroadcast(conf *util.Configuration, logger util.ILogger, db *dal.Database) (*Broadcast, error) {
+	b := new(Broadcast)
+	b.conf = conf
+	b.logger = logger
+	b.db = db
+	b.mutex = new(sync.RWMutex)
+	b.handlers = make(map[string]func(key string, data []byte))
+	b.err = errors.New("at Broadcast service")
+	return b, nil
+}
+
+// Handle sets the handler of the topic, it's called from a single goroutine in the order of the events
+func (b *Broadcast) Handle(topic string, handler func(key string, data []byte)) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.handlers[topic] = handler
+}
+
+// Publish sends the payload as JSON to the handlers of the topic on every instance
+func (b *Broadcast) Publish(topic, key string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return errors.Join(err, b.err)
+	}
+	if err := b.db.Broadcast.Insert(&dal.Broadcast{
+		Topic:     topic,
+		Key:       key,
+		Data:      data,
+		Timestamp: util.GetTimestamp(),
+	}); err != nil {
+		return errors.Join(err, b.err)
+	}
+	return nil
+}
+
+// Run delivers the events to the handlers, it blocks until the context is done
+func (b *Broadcast) Run(ctx context.Context) {
+	b.db.Broadcast.Tail(ctx, func(broadcast *dal.Broadcast) {
+		b.mutex.RLock()
+		handler, ok := b.handlers[broadcast.Topic]
+		b.mutex.RUnlock()
+		if ok {
+			handler(broadcast.Key, broadcast.Data)
+		}
+	})
+}
@@ -2,6 +2,7 @@ package service
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -19,13 +20,14 @@ type Chatter interface {
 }
 
 // chat must follow the correct processing order
-// which is read body -> check data validity -> parse json
-func chat(chatter Chatter, resp *http.Response, respChan chan<- any) ([]any, error) {
+// which is read body -> check data validity -> parse json,
+// the replies already sent are still returned along with an error, it stops once the context is done
+func chat(ctx context.Context, chatter Chatter, resp *http.Response, respChan chan<- any) ([]any, error) {
 	responseArr := make([]any, 0)
 	for {
 		errReadBody := chatter.ReadBody(resp)
 		if errReadBody != nil && !errors.Is(errReadBody, io.EOF) {
-			return nil, errReadBody
+			return responseArr, errReadBody
 		}
 		if !chatter.CanProcess() {
 			if errors.Is(errReadBody, io.EOF) || chatter.IsFinished() {
@@ -38,10 +40,14 @@ func chat(chatter Chatter, resp *http.Response, respChan chan<- any) ([]any, err
 			if errors.Is(err, ErrIncompleteJson) {
 				continue
 			}
-			return nil, err
+			return responseArr, err
 		}
 		if parsed != nil {
-			respChan <- parsed
+			select {
+			case respChan <- parsed:
+			case <-ctx.Done():
+				return responseArr, ctx.Err()
+			}
 			responseArr = append(responseArr, parsed)
 		}
 	}
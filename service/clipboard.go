@@ -0,0 +1,106 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/zenpk/chatbone/dal"
+)
+
+const (
+	clipboardSizeDefault = 64 * 1024 // bytes
+	clipboardChanSize    = 8
+)
+
+type clipboardSubscriber struct {
+	deviceId string
+	updates  chan string
+}
+
+// clipboardUpdate is passed to the user's devices on every instance
+type clipboardUpdate struct {
+	DeviceId  string `json:"deviceId"`
+	Clipboard string `json:"clipboard"`
+}
+
+func (u *User) GetClipboard(uuid string) (string, error) {
+	user, err := u.user.SelectByIdInsertIfNotExists(uuid)
+	if err != nil {
+		return "", errors.Join(err, u.err)
+	}
+	return user.Clipboard, nil
+}
+
+// SetClipboard saves the clipboard and pushes it to the user's other devices on every instance,
+// the device that set it is identified by the device ID and skipped
+func (u *User) SetClipboard(uuid, deviceId, clipboard string) error {
+	limit := u.conf.ClipboardSizeLimit
+	if limit <= 0 {
+		limit = clipboardSizeDefault
+	}
+	if len(clipboard) > limit {
+		return errors.Join(errors.New("clipboard too large"), u.err)
+	}
+	if err := u.user.UpdateClipboard(uuid, clipboard); err != nil {
+		return errors.Join(err, u.err)
+	}
+	update := clipboardUpdate{DeviceId: deviceId, Clipboard: clipboard}
+	if err := u.broadcastService.Publish(dal.BroadcastTopicClipboard, uuid, update); err != nil {
+		return errors.Join(err, u.err)
+	}
+	return nil
+}
+
+// deliverClipboard pushes the clipboard update to the user's devices subscribed on this instance
+func (u *User) deliverClipboard(uuid string, data []byte) {
+	update := new(clipboardUpdate)
+	if err := json.Unmarshal(data, update); err != nil {
+		u.logger.Warnln(errors.Join(err, u.err))
+		return
+	}
+	deviceId, clipboard := update.DeviceId, update.Clipboard
+	u.clipboardMutex.Lock()
+	defer u.clipboardMutex.Unlock()
+	for subscriber := range u.clipboardSubscribers[uuid] {
+		if deviceId != "" && subscriber.deviceId == deviceId {
+			continue
+		}
+		select {
+		case subscriber.updates <- clipboard:
+		default:
+			// the device is too slow, only the latest clipboard matters so the oldest one is dropped
+			select {
+			case <-subscriber.updates:
+			default:
+			}
+			select {
+			case subscriber.updates <- clipboard:
+			default:
+			}
+		}
+	}
+}
+
+// SubscribeClipboard returns the channel of the clipboard updates from the user's other devices,
+// unsubscribe must be called once the device is gone
+func (u *User) SubscribeClipboard(uuid, deviceId string) (<-chan string, func()) {
+	subscriber := &clipboardSubscriber{
+		deviceId: deviceId,
+		updates:  make(chan string, clipboardChanSize),
+	}
+	u.clipboardMutex.Lock()
+	defer u.clipboardMutex.Unlock()
+	if u.clipboardSubscribers[uuid] == nil {
+		u.clipboardSubscribers[uuid] = make(map[*clipboardSubscriber]struct{})
+	}
+	u.clipboardSubscribers[uuid][subscriber] = struct{}{}
+	unsubscribe := func() {
+		u.clipboardMutex.Lock()
+		defer u.clipboardMutex.Unlock()
+		delete(u.clipboardSubscribers[uuid], subscriber)
+		if len(u.clipboardSubscribers[uuid]) == 0 {
+			delete(u.clipboardSubscribers, uuid)
+		}
+	}
+	return subscriber.updates, unsubscribe
+}
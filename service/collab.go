@@ -0,0 +1,319 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/zenpk/chatbone/dal"
+	"github.com/zenpk/chatbone/dto"
+	"github.com/zenpk/chatbone/util"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	memberLimit             = 20 // per session
+	collabChanSize          = 1024
+	collabRoleOwner         = "owner"
+	presenceRefreshInterval = 30 * time.Second
+	presenceExpiry          = 3 * presenceRefreshInterval
+)
+
+type collabSubscriber struct {
+	id        string
+	sessionId string
+	userId    string
+	events    chan dto.CollabEvent
+	removed   chan struct{} // closed if the user lost the access or can't keep up
+}
+
+// Collab lets the session owner invite other users to watch or chat in the session live,
+// the events go through the broadcast so the subscribers on every instance get them,
+// the subscribers themselves are kept by the instance they're connected to
+type Collab struct {
+	conf   *util.Configuration
+	logger util.ILogger
+	db     *dal.Database
+	err    error
+
+	messageService   *Message
+	broadcastService *Broadcast
+
+	mutex       *sync.Mutex
+	subscribers map[string]map[*collabSubscriber]struct{} // session ID to subscribers on this instance
+}
+
+func NewCollab(conf *util.Configuration, logger util.ILogger, db *dal.Database, messageService *Message,
+	broadcastService *Broadcast,
+) (*Collab, error) {
+	c := new(Collab)
+	c.conf = conf
+	c.logger = logger
+	c.db = db
+	c.messageService = messageService
+	c.broadcastService = broadcastService
+	c.mutex = new(sync.Mutex)
+	c.subscribers = make(map[string]map[*collabSubscriber]struct{})
+	c.err = errors.New("at Collab service")
+	broadcastService.Handle(dal.BroadcastTopicCollab, c.deliver)
+	return c, nil
+}
+
+// GetMembers returns the owner and the members, everyone with access could see them
+func (c *Collab) GetMembers(uuid, sessionId string) (string, []*dal.Member, error) {
+	session, _, err := c.access(uuid, sessionId)
+	if err != nil {
+		return "", nil, err
+	}
+	members, err := c.db.Member.SelectBySessionId(sessionId)
+	if err != nil {
+		return "", nil, errors.Join(err, c.err)
+	}
+	return session.UserId, members, nil
+}
+
+// Invite adds the user to the session or changes the role, only the owner could invite
+func (c *Collab) Invite(uuid, sessionId, memberId, role string) (*dal.Member, error) {
+	if role != dal.MemberRoleViewer && role != dal.MemberRoleParticipant {
+		return nil, errors.Join(errors.New("unknown member role"), c.err)
+	}
+	if memberId == "" || memberId == uuid {
+		return nil, errors.Join(errors.New("the owner can't be a member"), c.err)
+	}
+	if _, err := c.messageService.getOwnedSession(uuid, sessionId); err != nil {
+		return nil, err
+	}
+	if _, err := c.db.Member.SelectOne(sessionId, memberId); errors.Is(err, mongo.ErrNoDocuments) {
+		count, err := c.db.Member.CountBySessionId(sessionId)
+		if err != nil {
+			return nil, errors.Join(err, c.err)
+		}
+		if count >= memberLimit {
+			return nil, errors.Join(errors.New("too many members"), c.err)
+		}
+	} else if err != nil {
+		return nil, errors.Join(err, c.err)
+	}
+	member := &dal.Member{
+		SessionId: sessionId,
+		UserId:    memberId,
+		Role:      role,
+		Timestamp: util.GetTimestamp(),
+	}
+	if err := c.db.Member.Upsert(member); err != nil {
+		return nil, errors.Join(err, c.err)
+	}
+	return member, nil
+}
+
+// Remove takes the member out of the session, the owner could remove anyone and a member could leave,
+// the member's live subscriptions are ended on every instance
+func (c *Collab) Remove(uuid, sessionId, memberId string) error {
+	if uuid != memberId {
+		if _, err := c.messageService.getOwnedSession(uuid, sessionId); err != nil {
+			return err
+		}
+	}
+	if err := c.db.Member.Delete(sessionId, memberId); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return errors.Join(ErrNotFound, c.err)
+		}
+		return errors.Join(err, c.err)
+	}
+	// the removal isn't sent to the clients, the instances end the member's subscriptions on it
+	if err := c.broadcastService.Publish(dal.BroadcastTopicCollab, sessionId,
+		dto.CollabEvent{Type: dto.CollabEventRemoved, UserId: memberId}); err != nil {
+		return errors.Join(err, c.err)
+	}
+	return nil
+}
+
+// ChatOwner returns the owner to save the chat turn of the user into,
+// the user could chat in their own or new sessions, or as a participant
+func (c *Collab) ChatOwner(uuid, sessionId string) (string, error) {
+	session, role, err := c.access(uuid, sessionId)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return uuid, nil
+		}
+		return "", err
+	}
+	if role == dal.MemberRoleViewer {
+		return "", errors.Join(ErrForbidden, c.err)
+	}
+	return session.UserId, nil
+}
+
+// Subscribe returns the current session and the channel of its live events,
+// removed is closed when the stream should end, unsubscribe must be called once the user is gone
+func (c *Collab) Subscribe(uuid, sessionId string) (*dal.Message, <-chan dto.CollabEvent, <-chan struct{}, func(), error) {
+	session, _, err := c.access(uuid, sessionId)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	id, err := util.RandomString(12)
+	if err != nil {
+		return nil, nil, nil, nil, errors.Join(err, c.err)
+	}
+	subscriber := &collabSubscriber{
+		id:        id,
+		sessionId: sessionId,
+		userId:    uuid,
+		events:    make(chan dto.CollabEvent, collabChanSize),
+		removed:   make(chan struct{}),
+	}
+	if err := c.refreshPresence(subscriber); err != nil {
+		return nil, nil, nil, nil, errors.Join(err, c.err)
+	}
+	c.mutex.Lock()
+	if c.subscribers[sessionId] == nil {
+		c.subscribers[sessionId] = make(map[*collabSubscriber]struct{})
+	}
+	c.subscribers[sessionId][subscriber] = struct{}{}
+	c.mutex.Unlock()
+	go c.keepPresence(subscriber)
+	c.publishPresence(sessionId)
+	unsubscribe := func() {
+		c.mutex.Lock()
+		_, subscribed := c.subscribers[sessionId][subscriber]
+		if subscribed {
+			c.removeSubscriber(subscriber)
+		}
+		c.mutex.Unlock()
+		if subscribed {
+			c.leave(sessionId, subscriber)
+		}
+	}
+	return session, subscriber.events, subscriber.removed, unsubscribe, nil
+}
+
+// Publish sends the event to everyone subscribed to the session on any instance
+func (c *Collab) Publish(sessionId string, event dto.CollabEvent) {
+	if err := c.broadcastService.Publish(dal.BroadcastTopicCollab, sessionId, event); err != nil {
+		c.logger.Warnln(errors.Join(err, c.err))
+	}
+}
+
+// deliver hands the broadcast event to the subscribers on this instance,
+// a subscriber that can't keep up is removed so it could reconnect and catch up from the snapshot
+func (c *Collab) deliver(sessionId string, data []byte) {
+	event := dto.CollabEvent{}
+	if err := json.Unmarshal(data, &event); err != nil {
+		c.logger.Warnln(errors.Join(err, c.err))
+		return
+	}
+	removed := make([]*collabSubscriber, 0)
+	c.mutex.Lock()
+	for subscriber := range c.subscribers[sessionId] {
+		if event.Type == dto.CollabEventRemoved {
+			if subscriber.userId == event.UserId {
+				c.removeSubscriber(subscriber)
+				removed = append(removed, subscriber)
+			}
+			continue
+		}
+		select {
+		case subscriber.events <- event:
+		default:
+			c.logger.Warnf("collab subscriber of session %v is too slow, removed", sessionId)
+			c.removeSubscriber(subscriber)
+			removed = append(removed, subscriber)
+		}
+	}
+	c.mutex.Unlock()
+	if len(removed) > 0 {
+		c.leave(sessionId, removed...)
+	}
+}
+
+// publishPresence sends the distinct users online on every instance
+func (c *Collab) publishPresence(sessionId string) {
+	online, err := c.db.Presence.SelectUserIdsBySessionId(sessionId)
+	if err != nil {
+		c.logger.Warnln(errors.Join(err, c.err))
+		return
+	}
+	slices.Sort(online)
+	c.Publish(sessionId, dto.CollabEvent{Type: dto.CollabEventPresence, Online: online})
+}
+
+// leave takes the subscribers off the presence, they must be removed already
+func (c *Collab) leave(sessionId string, subscribers ...*collabSubscriber) {
+	for _, subscriber := range subscribers {
+		if err := c.db.Presence.DeleteById(subscriber.id); err != nil {
+			c.logger.Warnln(errors.Join(err, c.err))
+		}
+	}
+	c.publishPresence(sessionId)
+}
+
+// keepPresence refreshes the presence of the subscriber until it's removed,
+// the presence of an instance that crashed expires by itself
+func (c *Collab) keepPresence(subscriber *collabSubscriber) {
+	ticker := time.NewTicker(presenceRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-subscriber.removed:
+			return
+		case <-ticker.C:
+			if err := c.refreshPresence(subscriber); err != nil {
+				c.logger.Warnln(errors.Join(err, c.err))
+			}
+		}
+	}
+}
+
+func (c *Collab) refreshPresence(subscriber *collabSubscriber) error {
+	return c.db.Presence.Upsert(&dal.Presence{
+		Id:        subscriber.id,
+		SessionId: subscriber.sessionId,
+		UserId:    subscriber.userId,
+		ExpireAt:  time.Now().Add(presenceExpiry),
+	})
+}
+
+// removeSubscriber should be called with the lock held
+func (c *Collab) removeSubscriber(subscriber *collabSubscriber) {
+	delete(c.subscribers[subscriber.sessionId], subscriber)
+	if len(c.subscribers[subscriber.sessionId]) == 0 {
+		delete(c.subscribers, subscriber.sessionId)
+	}
+	close(subscriber.removed)
+}
+
+// access returns the session with the role of the user: owner, participant or viewer
+func (c *Collab) access(uuid, sessionId string) (*dal.Message, string, error) {
+	session, role, err := sessionAccess(c.db, uuid, sessionId)
+	if err != nil {
+		return nil, "", errors.Join(err, c.err)
+	}
+	return session, role, nil
+}
+
+// sessionAccess is the rule of who could see a session, it's shared by the services reading others' sessions
+func sessionAccess(db *dal.Database, uuid, sessionId string) (*dal.Message, string, error) {
+	if uuid == "" || sessionId == "" {
+		return nil, "", ErrNotFound
+	}
+	session, err := db.Message.SelectBySessionId(sessionId)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, "", ErrNotFound
+		}
+		return nil, "", err
+	}
+	if session.UserId == uuid {
+		return session, collabRoleOwner, nil
+	}
+	member, err := db.Member.SelectOne(sessionId, uuid)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, "", ErrForbidden
+		}
+		return nil, "", err
+	}
+	return session, member.Role, nil
+}
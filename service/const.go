@@ -2,4 +2,9 @@ package service
 
 import "errors"
 
-var ErrIncompleteJson = errors.New("incomplete json")
+var (
+	ErrIncompleteJson = errors.New("incomplete json")
+	ErrNotFound       = errors.New("not found")
+	ErrForbidden      = errors.New("permission denied")
+	ErrUnauthorized   = errors.New("unauthorized")
+)
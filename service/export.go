@@ -0,0 +1,168 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/zenpk/chatbone/dal"
+	"github.com/zenpk/chatbone/dto"
+)
+
+const (
+	ExportFormatMarkdown = "markdown"
+	ExportFormatHtml     = "html"
+	ExportFormatJson     = "json"
+	exportVersion        = 2
+	exportFileNameLimit  = 48 // runes of the title
+)
+
+var exportFileNameUnsafe = regexp.MustCompile(`[^\p{L}\p{N}_-]+`)
+
+// ExportContentType returns the content type and the file extension of the export format
+func ExportContentType(format string) (string, string, error) {
+	switch format {
+	case ExportFormatMarkdown:
+		return "text/markdown; charset=utf-8", "md", nil
+	case ExportFormatHtml:
+		return "text/html; charset=utf-8", "html", nil
+	case ExportFormatJson:
+		return "application/json; charset=utf-8", "json", nil
+	default:
+		return "", "", errors.New("unsupported export format")
+	}
+}
+
+// Export writes one session in the format and returns its file name
+func (m *Message) Export(uuid, sessionId, format string, w io.Writer) (string, error) {
+	_, extension, err := ExportContentType(format)
+	if err != nil {
+		return "", errors.Join(err, m.err)
+	}
+	session, err := m.GetSession(uuid, sessionId)
+	if err != nil {
+		return "", err
+	}
+	if err := m.writeExport(session, format, w); err != nil {
+		return "", err
+	}
+	return ExportFileName(session, extension), nil
+}
+
+// ExportAll streams every session of the user as a zip, one file per session
+// sessions are loaded one by one so a large account doesn't hit the database timeout
+func (m *Message) ExportAll(uuid, format string, w io.Writer) error {
+	_, extension, err := ExportContentType(format)
+	if err != nil {
+		return errors.Join(err, m.err)
+	}
+	archive := zip.NewWriter(w)
+	page := &dal.Page{Size: dal.PageSizeMax}
+	for {
+		sessions, next, err := m.GetSessions(uuid, nil, page)
+		if err != nil {
+			return err
+		}
+		for _, meta := range sessions {
+			session, err := m.GetSession(uuid, meta.SessionId)
+			if err != nil {
+				if errors.Is(err, ErrNotFound) {
+					// deleted in the meantime
+					continue
+				}
+				return err
+			}
+			file, err := archive.CreateHeader(&zip.FileHeader{
+				Name:     ExportFileName(session, extension),
+				Method:   zip.Deflate,
+				Modified: time.UnixMilli(session.Timestamp),
+			})
+			if err != nil {
+				return errors.Join(err, m.err)
+			}
+			if err := m.writeExport(session, format, file); err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			break
+		}
+		page.Cursor = next
+	}
+	if err := archive.Close(); err != nil {
+		return errors.Join(err, m.err)
+	}
+	return nil
+}
+
+// ExportFileName is made of the title and the session ID which keeps it unique
+func ExportFileName(session *dal.Message, extension string) string {
+	name := strings.Trim(exportFileNameUnsafe.ReplaceAllString(session.Title, "-"), "-")
+	name = truncate(name, exportFileNameLimit)
+	id := exportFileNameUnsafe.ReplaceAllString(session.SessionId, "-")
+	if name == "" {
+		return fmt.Sprintf("%v.%v", id, extension)
+	}
+	return fmt.Sprintf("%v-%v.%v", name, id, extension)
+}
+
+// writeExport renders the text of the session for reading, the JSON keeps the stored messages as they are
+func (m *Message) writeExport(session *dal.Message, format string, w io.Writer) error {
+	var err error
+	switch format {
+	case ExportFormatMarkdown:
+		err = renderSessionMarkdown(w, session.Title, session.Timestamp, openAiMessages(session.Messages))
+	case ExportFormatHtml:
+		err = renderSessionHtml(w, session.Title, session.Timestamp, openAiMessages(session.Messages))
+	case ExportFormatJson:
+		var usage []*dal.History
+		usage, err = m.db.History.SelectBySessionId(session.SessionId)
+		if err != nil {
+			break
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(&dto.ExportSession{
+			Version:   exportVersion,
+			SessionId: session.SessionId,
+			Title:     session.Title,
+			ModelId:   session.ModelId,
+			Timestamp: session.Timestamp,
+			Saved:     session.Saved,
+			Shared:    session.Shared,
+			Messages:  session.Messages,
+			Usage:     usage,
+		})
+	}
+	if err != nil {
+		return errors.Join(err, m.err)
+	}
+	return nil
+}
+
+// renderSessionMarkdown writes every message under its role heading
+func renderSessionMarkdown(w io.Writer, title string, timestamp int64, messages []dto.OpenAiMessage) error {
+	buf := new(bytes.Buffer)
+	if title == "" {
+		title = "Untitled conversation"
+	}
+	fmt.Fprintf(buf, "# %v\n\n", title)
+	if timestamp > 0 {
+		fmt.Fprintf(buf, "_%v_\n\n", time.UnixMilli(timestamp).UTC().Format(renderTimeFormat))
+	}
+	for _, message := range messages {
+		role := message.Role
+		if role != "" {
+			role = strings.ToUpper(role[:1]) + role[1:]
+		}
+		fmt.Fprintf(buf, "## %v\n\n%v\n\n", role, strings.TrimSpace(message.Content))
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,191 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/zenpk/chatbone/dal"
+	"github.com/zenpk/chatbone/dto"
+	"github.com/zenpk/chatbone/util"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const feedbackCommentLimit = 2000
+
+var feedbackCategories = map[string]bool{
+	"inaccurate": true,
+	"unhelpful":  true,
+	"harmful":    true,
+	"formatting": true,
+	"other":      true,
+}
+
+type Feedback struct {
+	conf   *util.Configuration
+	logger util.ILogger
+	db     *dal.Database
+	err    error
+
+	messageService *Message
+}
+
+func NewFeedback(conf *util.Configuration, logger util.ILogger, db *dal.Database, messageService *Message) (*Feedback, error) {
+	f := new(Feedback)
+	f.conf = conf
+	f.logger = logger
+	f.db = db
+	f.messageService = messageService
+	f.err = errors.New("at Feedback service")
+	return f, nil
+}
+
+// GetAll returns the user's feedback on the session's messages
+func (f *Feedback) GetAll(uuid, sessionId string) ([]*dal.Feedback, error) {
+	if _, err := f.messageService.getOwnedSession(uuid, sessionId); err != nil {
+		return nil, err
+	}
+	feedbacks, err := f.db.Feedback.SelectBySessionId(sessionId, uuid)
+	if err != nil {
+		return nil, errors.Join(err, f.err)
+	}
+	return feedbacks, nil
+}
+
+// Submit rates the assistant message, the messages before it are kept as the prompt,
+// a second submit replaces the previous feedback
+func (f *Feedback) Submit(uuid, sessionId, messageId string, req *dto.FeedbackReq) (*dal.Feedback, error) {
+	if err := f.checkFeedbackReq(req); err != nil {
+		return nil, errors.Join(err, f.err)
+	}
+	session, err := f.messageService.getOwnedSession(uuid, sessionId)
+	if err != nil {
+		return nil, err
+	}
+	index := -1
+	for i, message := range session.Messages {
+		if message.Id == messageId {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return nil, errors.Join(ErrNotFound, f.err)
+	}
+	answer := session.Messages[index]
+	if answer.Role != "assistant" {
+		return nil, errors.Join(errors.New("only assistant messages can be rated"), f.err)
+	}
+	modelId := answer.ModelId
+	if modelId == 0 {
+		// saved by the client, not answered in this session
+		modelId = session.ModelId
+	}
+	id, err := util.RandomString(12)
+	if err != nil {
+		return nil, errors.Join(err, f.err)
+	}
+	feedback := &dal.Feedback{
+		Id:        id,
+		UserId:    uuid,
+		SessionId: sessionId,
+		MessageId: messageId,
+		ModelId:   modelId,
+		Timestamp: util.GetTimestamp(),
+		Rating:    req.Rating,
+		Comment:   strings.TrimSpace(req.Comment),
+		Category:  req.Category,
+		Prompt:    session.Messages[:index],
+		Answer:    answer,
+	}
+	if err := f.db.Feedback.Upsert(feedback); err != nil {
+		return nil, errors.Join(err, f.err)
+	}
+	return feedback, nil
+}
+
+func (f *Feedback) Delete(uuid, sessionId, messageId string) error {
+	if _, err := f.messageService.getOwnedSession(uuid, sessionId); err != nil {
+		return err
+	}
+	if err := f.db.Feedback.DeleteByMessageId(sessionId, messageId, uuid); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return errors.Join(ErrNotFound, f.err)
+		}
+		return errors.Join(err, f.err)
+	}
+	return nil
+}
+
+// Export writes the feedback as JSONL, one record per line with the prompt and the rated answer
+// in the OpenAI format, so it can be used as an evaluation dataset directly
+func (f *Feedback) Export(ctx context.Context, filter *dal.FeedbackFilter, w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	if err := f.db.Feedback.Each(ctx, filter, func(feedback *dal.Feedback) error {
+		record := &dto.FeedbackRecord{
+			Id:        feedback.Id,
+			SessionId: feedback.SessionId,
+			MessageId: feedback.MessageId,
+			ModelId:   feedback.ModelId,
+			Model:     f.modelName(feedback.ModelId),
+			Timestamp: feedback.Timestamp,
+			Rating:    feedback.Rating,
+			Comment:   feedback.Comment,
+			Category:  feedback.Category,
+			Messages:  openAiMessages(append(feedback.Prompt, feedback.Answer)),
+		}
+		return encoder.Encode(record)
+	}); err != nil {
+		return errors.Join(err, f.err)
+	}
+	return nil
+}
+
+// GetStats returns the feedback rates per model
+func (f *Feedback) GetStats(filter *dal.FeedbackFilter) ([]*dto.FeedbackStat, error) {
+	counts, err := f.db.Feedback.SelectStats(filter)
+	if err != nil {
+		return nil, errors.Join(err, f.err)
+	}
+	stats := make([]*dto.FeedbackStat, 0, len(counts))
+	for _, count := range counts {
+		stat := &dto.FeedbackStat{
+			ModelId: count.ModelId,
+			Model:   f.modelName(count.ModelId),
+			Up:      count.Up,
+			Down:    count.Down,
+			Total:   count.Up + count.Down,
+		}
+		if stat.Total > 0 {
+			stat.UpRate = float64(stat.Up) / float64(stat.Total)
+		}
+		stats = append(stats, stat)
+	}
+	return stats, nil
+}
+
+func (f *Feedback) modelName(id int) string {
+	model, err := f.db.Model.SelectById(id)
+	if err != nil || model == nil {
+		return ""
+	}
+	return model.Name
+}
+
+func (f *Feedback) checkFeedbackReq(req *dto.FeedbackReq) error {
+	if req == nil {
+		return errors.New("request body should not be nil")
+	}
+	if req.Rating != dal.FeedbackRatingUp && req.Rating != dal.FeedbackRatingDown {
+		return errors.New("rating should be 1 or -1")
+	}
+	if len(req.Comment) > feedbackCommentLimit {
+		return errors.New("comment too long")
+	}
+	if req.Category != "" && !feedbackCategories[req.Category] {
+		return errors.New("unknown feedback category")
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/zenpk/chatbone/dal"
+	"github.com/zenpk/chatbone/dto"
+	"github.com/zenpk/chatbone/util"
+)
+
+// Fork copies the user's session up to the message into a new session, the original is left as it is
+func (m *Message) Fork(uuid, sessionId string, req *dto.ForkSessionReq) (*dal.Message, error) {
+	session, err := m.getOwnedSession(uuid, sessionId)
+	if err != nil {
+		return nil, err
+	}
+	return m.fork(uuid, session, req, &dal.ForkedFrom{
+		SessionId: session.SessionId,
+		UserId:    session.UserId,
+	})
+}
+
+// fork inserts a saved copy of the session's messages up to the requested one,
+// the copy holds the attachments of the user's own session, so they outlive the original,
+// the attachments of someone else's session are left out as they can't be read by the user
+func (m *Message) fork(uuid string, source *dal.Message, req *dto.ForkSessionReq, forkedFrom *dal.ForkedFrom) (*dal.Message, error) {
+	if req == nil {
+		req = new(dto.ForkSessionReq)
+	}
+	title := strings.TrimSpace(req.Title)
+	if utf8.RuneCountInString(title) > titleLimit {
+		return nil, errors.Join(errors.New("title too long"), m.err)
+	}
+	if title == "" {
+		title = source.Title
+	}
+	end := len(source.Messages)
+	if req.MessageId != "" {
+		end = -1
+		for i, message := range source.Messages {
+			if message.Id == req.MessageId {
+				end = i + 1
+				break
+			}
+		}
+		if end < 0 {
+			return nil, errors.Join(ErrNotFound, m.err)
+		}
+	}
+	if end == 0 {
+		return nil, errors.Join(errors.New("the session has no messages to fork"), m.err)
+	}
+	sameOwner := source.UserId == uuid
+	messages := make([]*dal.ChatMessage, 0, end)
+	attachmentIds := make([]string, 0)
+	for _, message := range source.Messages[:end] {
+		copied := *message
+		copied.Content = make([]*dal.ContentPart, 0, len(message.Content))
+		for _, part := range message.Content {
+			if part.Type == dal.ContentTypeAttachment {
+				if !sameOwner {
+					continue
+				}
+				attachmentIds = append(attachmentIds, part.AttachmentId)
+			}
+			copiedPart := *part
+			copied.Content = append(copied.Content, &copiedPart)
+		}
+		messages = append(messages, &copied)
+	}
+	id, err := util.RandomString(12)
+	if err != nil {
+		return nil, errors.Join(err, m.err)
+	}
+	now := util.GetTimestamp()
+	forkedFrom.MessageId = messages[len(messages)-1].Id
+	forkedFrom.Timestamp = now
+	session := &dal.Message{
+		SessionId:  id,
+		UserId:     uuid,
+		Timestamp:  now,
+		Title:      title,
+		Messages:   messages,
+		ModelId:    source.ModelId,
+		Saved:      true,
+		ForkedFrom: forkedFrom,
+	}
+	// the library and the persona can't be used by someone else
+	if sameOwner {
+		session.LibraryId = source.LibraryId
+		session.Settings = source.Settings
+	} else if source.Settings != nil {
+		settings := *source.Settings
+		settings.PersonaId = ""
+		session.Settings = &settings
+	}
+	if err := m.db.Attachment.AddHolder(attachmentIds, uuid, id); err != nil {
+		return nil, errors.Join(err, m.err)
+	}
+	if err := m.db.Message.Insert(session); err != nil {
+		return nil, errors.Join(err, m.db.Attachment.ReleaseBySessionId(id), m.err)
+	}
+	return session, nil
+}
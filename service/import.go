@@ -0,0 +1,345 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/zenpk/chatbone/dal"
+	"github.com/zenpk/chatbone/dto"
+	"github.com/zenpk/chatbone/util"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	ImportFormatChatGpt    = "chatgpt"
+	ImportFormatJson       = "json"
+	chatGptSessionIdPrefix = "chatgpt-"
+)
+
+// Import inserts the sessions of a ChatGPT conversations.json or our own JSON export,
+// sessions already imported by the user are reported as duplicates
+func (m *Message) Import(uuid string, r io.Reader) (*dto.ImportReport, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, errors.Join(err, m.err)
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, errors.Join(errors.New("import file is empty"), m.err)
+	}
+	var sessions []*dto.ExportSession
+	report := &dto.ImportReport{Items: make([]*dto.ImportItem, 0)}
+	switch data[0] {
+	case '{':
+		session, err := decodeExportSession(data)
+		if err != nil {
+			return nil, errors.Join(err, m.err)
+		}
+		sessions = []*dto.ExportSession{session}
+		report.Format = ImportFormatJson
+	case '[':
+		var elements []json.RawMessage
+		if err := json.Unmarshal(data, &elements); err != nil {
+			return nil, errors.Join(err, m.err)
+		}
+		if len(elements) > 0 && bytes.Contains(elements[0], []byte(`"mapping"`)) {
+			report.Format = ImportFormatChatGpt
+			sessions, err = m.convertChatGpt(elements, report)
+		} else {
+			report.Format = ImportFormatJson
+			sessions = make([]*dto.ExportSession, len(elements))
+			for i, element := range elements {
+				if sessions[i], err = decodeExportSession(element); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			return nil, errors.Join(err, m.err)
+		}
+	default:
+		return nil, errors.Join(errors.New("unsupported import format"), m.err)
+	}
+	seen := make(map[string]bool, len(sessions))
+	for _, session := range sessions {
+		if session == nil {
+			continue
+		}
+		item := m.importSession(uuid, session, seen)
+		report.Items = append(report.Items, item)
+	}
+	for _, item := range report.Items {
+		switch item.Status {
+		case dto.ImportStatusImported:
+			report.Imported++
+		case dto.ImportStatusDuplicate:
+			report.Duplicates++
+		case dto.ImportStatusFailed:
+			report.Failed++
+		}
+	}
+	report.Total = len(report.Items)
+	return report, nil
+}
+
+// convertChatGpt flattens every conversation to the chosen path, which ends at its current node
+// conversations that can't be converted are reported as failed right away
+func (m *Message) convertChatGpt(elements []json.RawMessage, report *dto.ImportReport) ([]*dto.ExportSession, error) {
+	sessions := make([]*dto.ExportSession, 0, len(elements))
+	for _, element := range elements {
+		conversation := new(dto.ChatGptConversation)
+		if err := json.Unmarshal(element, conversation); err != nil {
+			report.Items = append(report.Items, &dto.ImportItem{
+				Status: dto.ImportStatusFailed,
+				Error:  "malformed conversation",
+			})
+			continue
+		}
+		session := &dto.ExportSession{
+			Title:     conversation.Title,
+			Timestamp: secondToMs(conversation.UpdateTime),
+			Saved:     true,
+		}
+		// a conversation without an ID is given a new one when it's imported
+		if conversation.Id != "" {
+			session.SessionId = chatGptSessionIdPrefix + conversation.Id
+		}
+		if session.Timestamp <= 0 {
+			session.Timestamp = secondToMs(conversation.CreateTime)
+		}
+		modelSlug := ""
+		messages := make([]dto.OpenAiMessage, 0)
+		for _, node := range chatGptPath(conversation) {
+			message := node.Message
+			if message == nil || (message.Author.Role != "user" && message.Author.Role != "assistant" &&
+				message.Author.Role != "system") {
+				continue
+			}
+			parts := make([]string, 0, len(message.Content.Parts))
+			for _, part := range message.Content.Parts {
+				// non-text parts (e.g. images) are dropped
+				if text, ok := part.(string); ok && text != "" {
+					parts = append(parts, text)
+				}
+			}
+			if len(parts) == 0 {
+				continue
+			}
+			messages = append(messages, dto.OpenAiMessage{
+				Role:    message.Author.Role,
+				Content: strings.Join(parts, "\n"),
+			})
+			if message.Metadata.ModelSlug != "" {
+				modelSlug = message.Metadata.ModelSlug
+			}
+		}
+		if model, err := m.modelService.MatchByName(modelSlug); err == nil && model != nil {
+			session.ModelId = model.Id
+		}
+		var err error
+		if session.Messages, _, err = chatMessages(nil, messages); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+// decodeExportSession reads a session of our JSON export, the OpenAI format messages of version 1 are converted
+func decodeExportSession(data []byte) (*dto.ExportSession, error) {
+	session := new(dto.ExportSession)
+	version := new(struct {
+		Version int `json:"version"`
+	})
+	if err := json.Unmarshal(data, version); err != nil {
+		return nil, err
+	}
+	if version.Version >= 2 {
+		if err := json.Unmarshal(data, session); err != nil {
+			return nil, err
+		}
+		return session, nil
+	}
+	legacy := &struct {
+		*dto.ExportSession
+		Messages []dto.OpenAiMessage `json:"messages"`
+	}{ExportSession: session}
+	if err := json.Unmarshal(data, legacy); err != nil {
+		return nil, err
+	}
+	var err error
+	if session.Messages, _, err = chatMessages(nil, legacy.Messages); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// importMessages checks the messages of the imported session, they keep their IDs, models and token usage,
+// the attachments are not part of the export so the references to them are dropped
+func importMessages(messages []*dal.ChatMessage, timestamp int64) ([]*dal.ChatMessage, error) {
+	result := make([]*dal.ChatMessage, 0, len(messages))
+	ids := make(map[string]bool, len(messages))
+	for _, message := range messages {
+		if message == nil {
+			continue
+		}
+		if message.Role != "user" && message.Role != "assistant" && message.Role != "system" {
+			return nil, errors.New("unsupported message role")
+		}
+		content := make([]*dal.ContentPart, 0, len(message.Content))
+		for _, part := range message.Content {
+			if part != nil && part.Type == dal.ContentTypeText && part.Text != "" {
+				content = append(content, &dal.ContentPart{Type: dal.ContentTypeText, Text: part.Text})
+			}
+		}
+		if len(content) == 0 {
+			continue
+		}
+		imported := *message
+		imported.Content = content
+		if imported.Id == "" || ids[imported.Id] {
+			id, err := util.RandomString(12)
+			if err != nil {
+				return nil, err
+			}
+			imported.Id = id
+		}
+		ids[imported.Id] = true
+		if imported.Timestamp <= 0 {
+			imported.Timestamp = timestamp
+		}
+		result = append(result, &imported)
+	}
+	if len(result) == 0 {
+		return nil, errors.New("session doesn't have any messages")
+	}
+	return result, nil
+}
+
+// chatGptPath walks from the current node up to the root,
+// the last child is followed from the root if the current node is missing
+func chatGptPath(conversation *dto.ChatGptConversation) []*dto.ChatGptNode {
+	path := make([]*dto.ChatGptNode, 0)
+	current := conversation.CurrentNode
+	if _, ok := conversation.Mapping[current]; !ok {
+		current = ""
+		for id, node := range conversation.Mapping {
+			if node != nil && node.Parent == "" {
+				current = id
+				break
+			}
+		}
+		for node := conversation.Mapping[current]; node != nil && len(node.Children) > 0; node = conversation.Mapping[current] {
+			current = node.Children[len(node.Children)-1]
+		}
+	}
+	for node := conversation.Mapping[current]; node != nil; node = conversation.Mapping[node.Parent] {
+		path = append(path, node)
+		// guard against malformed cycles
+		if len(path) > len(conversation.Mapping) {
+			break
+		}
+	}
+	slices.Reverse(path)
+	return path
+}
+
+func (m *Message) importSession(uuid string, session *dto.ExportSession, seen map[string]bool) *dto.ImportItem {
+	item := &dto.ImportItem{
+		SessionId:   session.SessionId,
+		Title:       session.Title,
+		ModelId:     session.ModelId,
+		ModelMapped: true,
+	}
+	fail := func(err error) *dto.ImportItem {
+		item.Status = dto.ImportStatusFailed
+		item.Error = err.Error()
+		return item
+	}
+	if len(session.Messages) == 0 {
+		return fail(errors.New("session doesn't have any messages"))
+	}
+	if _, err := m.modelService.GetAndCheckModelById(session.ModelId); err != nil {
+		model, err := m.modelService.GetCheapest()
+		if err != nil {
+			return fail(err)
+		}
+		item.ModelId = model.Id
+		item.ModelMapped = false
+	}
+	if session.SessionId == "" {
+		id, err := util.RandomString(12)
+		if err != nil {
+			return fail(err)
+		}
+		item.SessionId = id
+	} else {
+		if seen[session.SessionId] {
+			item.Status = dto.ImportStatusDuplicate
+			return item
+		}
+		seen[session.SessionId] = true
+		owner, err := m.sessionOwner(session.SessionId)
+		switch {
+		case err != nil:
+			return fail(err)
+		case owner == uuid:
+			// also when the session is in the user's trash, it could be restored from there
+			item.Status = dto.ImportStatusDuplicate
+			return item
+		case owner != "":
+			// the ID is taken by someone else, e.g. importing a colleague's export
+			id, err := util.RandomString(12)
+			if err != nil {
+				return fail(err)
+			}
+			item.SessionId = id
+		}
+	}
+	timestamp := util.CheckTimestamp(session.Timestamp)
+	if session.Timestamp <= 0 {
+		timestamp = util.GetTimestamp()
+	}
+	messages, err := importMessages(session.Messages, timestamp)
+	if err != nil {
+		return fail(err)
+	}
+	if err := m.db.Message.Insert(&dal.Message{
+		SessionId: item.SessionId,
+		UserId:    uuid,
+		Timestamp: timestamp,
+		Title:     truncate(strings.TrimSpace(session.Title), titleLimit),
+		Messages:  messages,
+		ModelId:   item.ModelId,
+		Saved:     true,
+	}); err != nil {
+		return fail(err)
+	}
+	item.Status = dto.ImportStatusImported
+	return item
+}
+
+// sessionOwner returns the owner of the session whether it's in the trash or not,
+// an empty owner means the ID is free
+func (m *Message) sessionOwner(sessionId string) (string, error) {
+	session, err := m.db.Message.SelectBySessionId(sessionId)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		session, err = m.db.Message.SelectDeletedBySessionId(sessionId)
+	}
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return "", nil
+		}
+		return "", errors.Join(err, m.err)
+	}
+	return session.UserId, nil
+}
+
+func secondToMs(second float64) int64 {
+	return int64(math.Round(second * 1000))
+}
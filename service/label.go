@@ -0,0 +1,187 @@
+package service
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/zenpk/chatbone/dal"
+	"github.com/zenpk/chatbone/dto"
+	"github.com/zenpk/chatbone/util"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	labelLimit     = 200 // folders and tags together
+	labelNameLimit = 64
+)
+
+var labelColor = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+type Label struct {
+	conf   *util.Configuration
+	logger util.ILogger
+	db     *dal.Database
+	err    error
+
+	messageService *Message
+}
+
+func NewLabel(conf *util.Configuration, logger util.ILogger, db *dal.Database, messageService *Message) (*Label, error) {
+	l := new(Label)
+	l.conf = conf
+	l.logger = logger
+	l.db = db
+	l.messageService = messageService
+	l.err = errors.New("at Label service")
+	return l, nil
+}
+
+// GetAll returns the user's labels of the type, an empty type means folders and tags
+func (l *Label) GetAll(uuid, labelType string) ([]*dal.Label, error) {
+	if labelType != "" && labelType != dal.LabelTypeFolder && labelType != dal.LabelTypeTag {
+		return nil, errors.Join(errors.New("unknown label type"), l.err)
+	}
+	labels, err := l.db.Label.SelectByUserId(uuid, labelType)
+	if err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	return labels, nil
+}
+
+func (l *Label) Create(uuid string, req *dto.LabelReq) (*dal.Label, error) {
+	if err := l.checkLabelReq(req); err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	if req.Type != dal.LabelTypeFolder && req.Type != dal.LabelTypeTag {
+		return nil, errors.Join(errors.New("unknown label type"), l.err)
+	}
+	count, err := l.db.Label.CountByUserId(uuid)
+	if err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	if count >= labelLimit {
+		return nil, errors.Join(errors.New("too many folders and tags"), l.err)
+	}
+	id, err := util.RandomString(12)
+	if err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	label := &dal.Label{
+		Id:        id,
+		UserId:    uuid,
+		Type:      req.Type,
+		Name:      strings.TrimSpace(req.Name),
+		Color:     req.Color,
+		Timestamp: util.GetTimestamp(),
+	}
+	if err := l.db.Label.Insert(label); err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	return label, nil
+}
+
+// Update renames or recolors the label, the sessions only refer to its ID so they're left untouched
+func (l *Label) Update(uuid, id string, req *dto.LabelReq) (*dal.Label, error) {
+	if err := l.checkLabelReq(req); err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	label, err := l.getOwnedLabel(uuid, id, "")
+	if err != nil {
+		return nil, err
+	}
+	label.Name = strings.TrimSpace(req.Name)
+	label.Color = req.Color
+	if err := l.db.Label.UpdateById(id, uuid, label.Name, label.Color); err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	return label, nil
+}
+
+// Delete removes the label and takes it off the user's sessions, the sessions themselves are kept
+func (l *Label) Delete(uuid, id string) error {
+	if _, err := l.getOwnedLabel(uuid, id, ""); err != nil {
+		return err
+	}
+	if err := l.db.Label.DeleteById(id, uuid); err != nil {
+		return errors.Join(err, l.err)
+	}
+	if err := l.db.Message.RemoveLabel(uuid, id); err != nil {
+		return errors.Join(err, l.err)
+	}
+	return nil
+}
+
+// Move puts the session into the folder, an empty folder ID takes it out of its folder
+func (l *Label) Move(uuid, sessionId, folderId string) error {
+	if _, err := l.messageService.getOwnedSession(uuid, sessionId); err != nil {
+		return err
+	}
+	if folderId != "" {
+		if _, err := l.getOwnedLabel(uuid, folderId, dal.LabelTypeFolder); err != nil {
+			return err
+		}
+	}
+	if err := l.db.Message.UpdateFolder(sessionId, uuid, folderId); err != nil {
+		return errors.Join(err, l.err)
+	}
+	return nil
+}
+
+// Tag replaces the tags of the session
+func (l *Label) Tag(uuid, sessionId string, tagIds []string) error {
+	if _, err := l.messageService.getOwnedSession(uuid, sessionId); err != nil {
+		return err
+	}
+	unique := make([]string, 0, len(tagIds))
+	seen := make(map[string]bool)
+	for _, tagId := range tagIds {
+		if seen[tagId] {
+			continue
+		}
+		if _, err := l.getOwnedLabel(uuid, tagId, dal.LabelTypeTag); err != nil {
+			return err
+		}
+		seen[tagId] = true
+		unique = append(unique, tagId)
+	}
+	if err := l.db.Message.UpdateTags(sessionId, uuid, unique); err != nil {
+		return errors.Join(err, l.err)
+	}
+	return nil
+}
+
+// getOwnedLabel returns the label owned by the user, an empty type matches any type
+func (l *Label) getOwnedLabel(uuid, id, labelType string) (*dal.Label, error) {
+	if id == "" {
+		return nil, errors.Join(ErrNotFound, l.err)
+	}
+	label, err := l.db.Label.SelectById(id)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, errors.Join(ErrNotFound, l.err)
+		}
+		return nil, errors.Join(err, l.err)
+	}
+	if label.UserId != uuid {
+		return nil, errors.Join(ErrForbidden, l.err)
+	}
+	if labelType != "" && label.Type != labelType {
+		return nil, errors.Join(errors.New("label is not a "+labelType), l.err)
+	}
+	return label, nil
+}
+
+func (l *Label) checkLabelReq(req *dto.LabelReq) error {
+	if req == nil {
+		return errors.New("request body should not be nil")
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > labelNameLimit {
+		return errors.New("label name should not be empty or too long")
+	}
+	if req.Color != "" && !labelColor.MatchString(req.Color) {
+		return errors.New("label color should be like #rrggbb")
+	}
+	return nil
+}
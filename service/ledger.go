@@ -0,0 +1,183 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/zenpk/chatbone/dal"
+	"github.com/zenpk/chatbone/dto"
+	"github.com/zenpk/chatbone/util"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	reconcileInterval  = time.Hour
+	reconcileLease     = reconcileInterval + reconcileInterval/2 // extended every run, taken over if the holder is gone
+	reconcileLeaseName = "reconcile"
+	reconcileRetry     = 3 // reads of a balance that keeps changing
+)
+
+// balanceMismatch is what the reconciliation saw for a user whose balance isn't the sum of the ledger
+type balanceMismatch struct {
+	balance int64
+	sum     int64
+	count   int64
+}
+
+// GetTransactions returns a page of the user's ledger entries, the most recent first
+func (u *User) GetTransactions(uuid string, page *dal.Page) ([]*dal.Ledger, string, error) {
+	transactions, next, err := u.ledger.SelectByUserId(uuid, page)
+	if err != nil {
+		return nil, "", errors.Join(err, u.err)
+	}
+	return transactions, next, nil
+}
+
+// AdjustBalance changes the user's balance by an admin, the admin is recorded in the entry
+func (u *User) AdjustBalance(adminId, userId string, req *dto.BalanceReq) (*dal.Ledger, error) {
+	if userId == "" {
+		return nil, errors.Join(ErrNotFound, u.err)
+	}
+	switch req.Kind {
+	case dal.LedgerKindTopUp, dal.LedgerKindRefund, dal.LedgerKindGrant:
+		if req.Amount <= 0 {
+			return nil, errors.Join(errors.New("the amount should be positive"), u.err)
+		}
+	case dal.LedgerKindAdjustment:
+		if req.Amount == 0 {
+			return nil, errors.Join(errors.New("the amount should not be zero"), u.err)
+		}
+	default:
+		return nil, errors.Join(errors.New("unknown balance change kind"), u.err)
+	}
+	if req.Reference == dal.LedgerReferenceOpening {
+		return nil, errors.Join(errors.New("the opening reference is reserved"), u.err)
+	}
+	entry := &dal.Ledger{
+		UserId:    userId,
+		Kind:      req.Kind,
+		Amount:    req.Amount,
+		Reference: req.Reference,
+		AdminId:   adminId,
+		Note:      req.Note,
+	}
+	if err := u.user.AdjustBalance(entry); err != nil {
+		return nil, errors.Join(err, u.err)
+	}
+	return entry, nil
+}
+
+// Reconcile checks every user's balance against the sum of the ledger, it blocks until the context is done,
+// only the instance holding the lease reconciles
+func (u *User) Reconcile(ctx context.Context) {
+	holder, err := util.RandomString(12)
+	if err != nil {
+		u.logger.Warnln(errors.Join(err, u.err))
+		return
+	}
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+	mismatches := make(map[string]balanceMismatch)
+	for {
+		leader, err := u.lease.Acquire(reconcileLeaseName, holder, reconcileLease)
+		switch {
+		case err != nil:
+			u.logger.Warnln(errors.Join(err, u.err))
+		case leader:
+			mismatches = u.reconcile(mismatches)
+		default:
+			// the mismatches seen before another instance took over are stale
+			mismatches = make(map[string]balanceMismatch)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reconcile fixes only the mismatches that are the same as in the previous run,
+// a balance change in progress has a short gap between the update and its entry, which doesn't last a run,
+// the users from before the ledger without any entry get their balance recorded as the opening entry,
+// otherwise the ledger wins and the balance is set to the sum, but only if the ledger starts with the opening entry,
+// a sum without it misses the balance from before the ledger
+func (u *User) reconcile(previous map[string]balanceMismatch) map[string]balanceMismatch {
+	mismatches := make(map[string]balanceMismatch)
+	users, err := u.users.SelectAll()
+	if err != nil {
+		u.logger.Warnln(errors.Join(err, u.err))
+		return previous
+	}
+	for _, user := range users {
+		mismatch, stable, err := u.observe(user)
+		if err != nil {
+			u.logger.Warnln(err)
+			return previous
+		}
+		if !stable {
+			// busy, it's checked again in the next run
+			continue
+		}
+		if mismatch.sum == mismatch.balance {
+			continue
+		}
+		user.Balance = mismatch.balance
+		sum, count := mismatch.sum, mismatch.count
+		if previous[user.Id] != mismatch {
+			mismatches[user.Id] = mismatch
+			continue
+		}
+		if count == 0 {
+			if err := u.ledger.Insert(&dal.Ledger{
+				UserId:    user.Id,
+				Kind:      dal.LedgerKindAdjustment,
+				Amount:    user.Balance,
+				Balance:   user.Balance,
+				Reference: dal.LedgerReferenceOpening,
+				Note:      "opening balance",
+				Timestamp: util.GetTimestamp(),
+			}); err != nil && !mongo.IsDuplicateKeyError(err) {
+				u.logger.Warnln(errors.Join(err, u.err))
+			}
+			continue
+		}
+		opened, err := u.ledger.HasOpening(user.Id)
+		if err != nil {
+			u.logger.Warnln(errors.Join(err, u.err))
+			continue
+		}
+		if !opened {
+			u.logger.Warnf("balance of user %v is %v but the ledger sums to %v without the opening entry, left as it is",
+				user.Id, user.Balance, sum)
+			continue
+		}
+		u.logger.Warnf("balance of user %v is %v but the ledger sums to %v, set to the ledger", user.Id, user.Balance, sum)
+		if err := u.user.ReconcileBalance(user.Id, user.Balance, sum); err != nil {
+			u.logger.Warnln(err)
+		}
+	}
+	return mismatches
+}
+
+// observe sums the user's ledger between two reads of the balance, so the sum isn't compared with a stale balance,
+// it's read again if the balance changed in between, and it's not stable if the balance keeps changing
+func (u *User) observe(user *dal.User) (balanceMismatch, bool, error) {
+	balance := user.Balance
+	for i := 0; i < reconcileRetry; i++ {
+		sum, count, err := u.ledger.SumByUserId(user.Id)
+		if err != nil {
+			return balanceMismatch{}, false, errors.Join(err, u.err)
+		}
+		current, err := u.users.SelectById(user.Id)
+		if err != nil {
+			return balanceMismatch{}, false, errors.Join(err, u.err)
+		}
+		if current.Balance == balance {
+			return balanceMismatch{balance: balance, sum: sum, count: count}, true, nil
+		}
+		balance = current.Balance
+	}
+	return balanceMismatch{}, false, nil
+}
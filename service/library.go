@@ -0,0 +1,453 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/zenpk/chatbone/dal"
+	"github.com/zenpk/chatbone/dto"
+	"github.com/zenpk/chatbone/util"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	libraryLimit          = 50
+	libraryNameLimit      = 64
+	chunkSize             = 1000 // runes
+	chunkOverlap          = 200  // runes shared with the previous chunk
+	retrievalTopKDefault  = 4
+	retrievalContextStart = "Answer with the help of the following excerpts from the user's documents " +
+		"when they are relevant. Each excerpt starts with its ID in square brackets, cite the IDs you use."
+)
+
+type Library struct {
+	conf   *util.Configuration
+	logger util.ILogger
+	db     *dal.Database
+	err    error
+
+	messageService *Message
+	openAiService  *OpenAi
+}
+
+func NewLibrary(conf *util.Configuration, logger util.ILogger, db *dal.Database, messageService *Message,
+	openAiService *OpenAi,
+) (*Library, error) {
+	l := new(Library)
+	l.conf = conf
+	l.logger = logger
+	l.db = db
+	l.messageService = messageService
+	l.openAiService = openAiService
+	l.err = errors.New("at Library service")
+	return l, nil
+}
+
+func (l *Library) GetAll(uuid string) ([]*dal.Library, error) {
+	libraries, err := l.db.Library.SelectByUserId(uuid)
+	if err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	return libraries, nil
+}
+
+func (l *Library) Create(uuid string, req *dto.LibraryReq) (*dal.Library, error) {
+	name, err := checkLibraryName(req)
+	if err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	count, err := l.db.Library.CountByUserId(uuid)
+	if err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	if count >= libraryLimit {
+		return nil, errors.Join(errors.New("too many libraries"), l.err)
+	}
+	id, err := util.RandomString(12)
+	if err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	library := &dal.Library{
+		Id:        id,
+		UserId:    uuid,
+		Name:      name,
+		Timestamp: util.GetTimestamp(),
+	}
+	if err := l.db.Library.Insert(library); err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	return library, nil
+}
+
+func (l *Library) Rename(uuid, libraryId string, req *dto.LibraryReq) (*dal.Library, error) {
+	name, err := checkLibraryName(req)
+	if err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	library, err := l.getOwnedLibrary(uuid, libraryId)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.db.Library.UpdateById(library.Id, uuid, name); err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	library.Name = name
+	return library, nil
+}
+
+// Delete removes the library with its documents and detaches it from the sessions
+func (l *Library) Delete(uuid, libraryId string) error {
+	library, err := l.getOwnedLibrary(uuid, libraryId)
+	if err != nil {
+		return err
+	}
+	if err := l.db.Chunk.DeleteByLibraryId(library.Id); err != nil {
+		return errors.Join(err, l.err)
+	}
+	if err := l.db.Document.DeleteByLibraryId(library.Id); err != nil {
+		return errors.Join(err, l.err)
+	}
+	if err := l.db.Message.RemoveLibrary(uuid, library.Id); err != nil {
+		return errors.Join(err, l.err)
+	}
+	if err := l.db.Library.DeleteById(library.Id, uuid); err != nil {
+		return errors.Join(err, l.err)
+	}
+	return nil
+}
+
+func (l *Library) GetDocuments(uuid, libraryId string) ([]*dal.Document, error) {
+	library, err := l.getOwnedLibrary(uuid, libraryId)
+	if err != nil {
+		return nil, err
+	}
+	documents, err := l.db.Document.SelectByLibraryId(library.Id)
+	if err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	return documents, nil
+}
+
+// Upload chunks and embeds the text or PDF file into the library, the embedding is billed to the library
+func (l *Library) Upload(uuid, libraryId, filename string, source io.Reader) (*dal.Document, error) {
+	model, err := l.embeddingModel()
+	if err != nil {
+		return nil, err
+	}
+	library, err := l.getOwnedLibrary(uuid, libraryId)
+	if err != nil {
+		return nil, err
+	}
+	// the size is bounded by the body limit
+	data, err := io.ReadAll(source)
+	if err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	contentType, text, err := documentText(data)
+	if err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	texts := chunkText(text, chunkSize, chunkOverlap)
+	if len(texts) == 0 {
+		return nil, errors.Join(errors.New("the document has no text"), l.err)
+	}
+	count, err := l.db.Chunk.CountByLibraryId(library.Id)
+	if err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	if l.conf.LibraryChunkLimit > 0 && int(count)+len(texts) > l.conf.LibraryChunkLimit {
+		return nil, errors.Join(errors.New("the library is full"), l.err)
+	}
+	embeddings, err := l.openAiService.Embed(uuid, "", library.Id, model, texts)
+	if err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	documentId, err := util.RandomString(12)
+	if err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	chunks := make([]*dal.Chunk, len(texts))
+	for i, text := range texts {
+		chunkId, err := util.RandomString(12)
+		if err != nil {
+			return nil, errors.Join(err, l.err)
+		}
+		chunks[i] = &dal.Chunk{
+			Id:         chunkId,
+			LibraryId:  library.Id,
+			DocumentId: documentId,
+			Index:      i,
+			Text:       text,
+			Embedding:  embeddings[i],
+		}
+	}
+	document := &dal.Document{
+		Id:          documentId,
+		LibraryId:   library.Id,
+		UserId:      uuid,
+		Filename:    truncate(filepath.Base(strings.ReplaceAll(filename, "\\", "/")), attachmentFilenameLimit),
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		ChunkCount:  len(chunks),
+		Timestamp:   util.GetTimestamp(),
+	}
+	if err := l.db.Chunk.InsertMany(chunks); err != nil {
+		return nil, errors.Join(err, l.db.Chunk.DeleteByDocumentId(documentId), l.err)
+	}
+	if err := l.db.Document.Insert(document); err != nil {
+		return nil, errors.Join(err, l.db.Chunk.DeleteByDocumentId(documentId), l.err)
+	}
+	return document, nil
+}
+
+func (l *Library) DeleteDocument(uuid, libraryId, documentId string) error {
+	library, err := l.getOwnedLibrary(uuid, libraryId)
+	if err != nil {
+		return err
+	}
+	document, err := l.db.Document.SelectById(documentId)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return errors.Join(ErrNotFound, l.err)
+		}
+		return errors.Join(err, l.err)
+	}
+	if document.LibraryId != library.Id {
+		return errors.Join(ErrNotFound, l.err)
+	}
+	if err := l.db.Chunk.DeleteByDocumentId(document.Id); err != nil {
+		return errors.Join(err, l.err)
+	}
+	if err := l.db.Document.DeleteById(document.Id); err != nil {
+		return errors.Join(err, l.err)
+	}
+	return nil
+}
+
+// Attach sets the library the session retrieves from, an empty library ID detaches it
+func (l *Library) Attach(uuid, sessionId, libraryId string) error {
+	if _, err := l.messageService.getOwnedSession(uuid, sessionId); err != nil {
+		return err
+	}
+	if libraryId != "" {
+		if _, err := l.getOwnedLibrary(uuid, libraryId); err != nil {
+			return err
+		}
+	}
+	if err := l.db.Message.UpdateLibrary(sessionId, uuid, libraryId); err != nil {
+		return errors.Join(err, l.err)
+	}
+	return nil
+}
+
+// Retrieve finds the chunks most relevant to the last user message and sets them as the request context,
+// the library of the request is used if set, otherwise the session's, the query embedding is billed to the session,
+// ownerId owns the session, which differs from the user when a participant chats in someone else's session,
+// topK is the number of chunks from the session's settings, 0 means the configured one
+func (l *Library) Retrieve(uuid, ownerId, libraryId string, topK int, req *dto.OpenAiReqFromClient) ([]*dto.Citation, error) {
+	libraryOwner := uuid
+	if libraryId == "" {
+		session, err := l.messageService.getOwnedSession(ownerId, req.SessionId)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		libraryId = session.LibraryId
+		libraryOwner = ownerId
+	}
+	if libraryId == "" || len(req.Messages) == 0 {
+		return nil, nil
+	}
+	query := req.Messages[len(req.Messages)-1]
+	if query.Role != "user" || strings.TrimSpace(query.Content) == "" {
+		return nil, nil
+	}
+	model, err := l.embeddingModel()
+	if err != nil {
+		return nil, err
+	}
+	library, err := l.getOwnedLibrary(libraryOwner, libraryId)
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := l.db.Chunk.SelectByLibraryId(library.Id)
+	if err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	if len(chunks) == 0 {
+		return nil, nil
+	}
+	embeddings, err := l.openAiService.Embed(uuid, req.SessionId, "", model, []string{query.Content})
+	if err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	scores := make(map[*dal.Chunk]float64, len(chunks))
+	for _, chunk := range chunks {
+		scores[chunk] = cosine(embeddings[0], chunk.Embedding)
+	}
+	sort.SliceStable(chunks, func(i, j int) bool {
+		return scores[chunks[i]] > scores[chunks[j]]
+	})
+	if topK <= 0 {
+		topK = l.conf.RetrievalTopK
+	}
+	if topK <= 0 {
+		topK = retrievalTopKDefault
+	}
+	chunks = chunks[:min(topK, len(chunks))]
+	documents, err := l.db.Document.SelectByLibraryId(library.Id)
+	if err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	filenames := make(map[string]string, len(documents))
+	for _, document := range documents {
+		filenames[document.Id] = document.Filename
+	}
+	citations := make([]*dto.Citation, len(chunks))
+	context := new(strings.Builder)
+	context.WriteString(retrievalContextStart)
+	for i, chunk := range chunks {
+		citations[i] = &dto.Citation{
+			ChunkId:    chunk.Id,
+			DocumentId: chunk.DocumentId,
+			Filename:   filenames[chunk.DocumentId],
+			Index:      chunk.Index,
+			Score:      scores[chunk],
+			Text:       chunk.Text,
+		}
+		context.WriteString("\n\n[" + chunk.Id + "] " + filenames[chunk.DocumentId] + "\n" + chunk.Text)
+	}
+	req.Context = context.String()
+	return citations, nil
+}
+
+func (l *Library) embeddingModel() (*dal.Model, error) {
+	if l.conf.EmbeddingModelId == 0 {
+		return nil, errors.Join(errors.New("document libraries are disabled"), l.err)
+	}
+	model, err := l.db.Model.SelectById(l.conf.EmbeddingModelId)
+	if err != nil {
+		return nil, errors.Join(err, l.err)
+	}
+	if model == nil || !model.Embedding {
+		return nil, errors.Join(errors.New("embedding model not found"), l.err)
+	}
+	return model, nil
+}
+
+func (l *Library) getOwnedLibrary(uuid, libraryId string) (*dal.Library, error) {
+	if uuid == "" || libraryId == "" {
+		return nil, errors.Join(ErrNotFound, l.err)
+	}
+	library, err := l.db.Library.SelectById(libraryId)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, errors.Join(ErrNotFound, l.err)
+		}
+		return nil, errors.Join(err, l.err)
+	}
+	if library.UserId != uuid {
+		return nil, errors.Join(ErrForbidden, l.err)
+	}
+	return library, nil
+}
+
+func checkLibraryName(req *dto.LibraryReq) (string, error) {
+	if req == nil {
+		return "", errors.New("library name should not be empty")
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" || utf8.RuneCountInString(name) > libraryNameLimit {
+		return "", errors.New("library name should not be empty or too long")
+	}
+	return name, nil
+}
+
+// documentText sniffs the file and returns its text, only text files and PDFs are accepted
+func documentText(data []byte) (string, string, error) {
+	contentType := http.DetectContentType(data)
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", "", err
+	}
+	switch {
+	case mediaType == "application/pdf":
+		text, err := extractPdfText(data)
+		return mediaType, text, err
+	case strings.HasPrefix(mediaType, "text/"):
+		return "text/plain; charset=utf-8", strings.ToValidUTF8(string(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))),
+			string(utf8.RuneError)), nil
+	}
+	return "", "", errors.New("unsupported file type: " + mediaType)
+}
+
+// chunkText splits the text into overlapping chunks of at most size runes,
+// a chunk prefers to end at a paragraph or a space in its last fifth
+func chunkText(text string, size, overlap int) []string {
+	runes := []rune(text)
+	result := make([]string, 0)
+	for start := 0; start < len(runes); {
+		end := min(start+size, len(runes))
+		if end < len(runes) {
+			end = chunkEnd(runes, start, end, size/5)
+		}
+		if chunk := strings.TrimSpace(string(runes[start:end])); chunk != "" {
+			result = append(result, chunk)
+		}
+		if end == len(runes) {
+			break
+		}
+		// the overlap starts at a word
+		next := end - overlap
+		for next > start && next < end && !unicode.IsSpace(runes[next-1]) {
+			next++
+		}
+		if next <= start {
+			next = end
+		}
+		start = next
+	}
+	return result
+}
+
+func chunkEnd(runes []rune, start, end, window int) int {
+	lowest := max(start+1, end-window)
+	for i := end; i > lowest; i-- {
+		if runes[i-1] == '\n' && runes[i-2] == '\n' {
+			return i
+		}
+	}
+	for i := end; i > lowest; i-- {
+		if unicode.IsSpace(runes[i-1]) {
+			return i
+		}
+	}
+	return end
+}
+
+func cosine(a, b []float64) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += a[i] * b[i]
+		normA += a[i] * a[i]
+		normB += b[i] * b[i]
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
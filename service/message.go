@@ -1,25 +1,397 @@
 package service
 
 import (
+	"errors"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
 	"github.com/zenpk/chatbone/cal"
 	"github.com/zenpk/chatbone/dal"
+	"github.com/zenpk/chatbone/dto"
 	"github.com/zenpk/chatbone/util"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	titleLimit        = 64 // runes
+	titleContextLimit = 1000
+	titlePrompt       = "Write a short title of at most 6 words for the following conversation. " +
+		"Reply with the title only, without quotes or punctuation at the end."
 )
 
 type Message struct {
 	conf   *util.Configuration
 	logger util.ILogger
 	db     *dal.Database
+	err    error
+
+	modelService  *Model
+	openAiService *OpenAi
 }
 
-func NewMessage(conf *util.Configuration, logger util.ILogger, db *dal.Database, cache *cal.Cache) (*Message, error) {
+func NewMessage(conf *util.Configuration, logger util.ILogger, db *dal.Database, cache *cal.Cache,
+	modelService *Model, openAiService *OpenAi,
+) (*Message, error) {
 	m := new(Message)
 	m.conf = conf
 	m.logger = logger
 	m.db = db
+	m.modelService = modelService
+	m.openAiService = openAiService
+	m.err = errors.New("at Message service")
 	return m, nil
 }
 
-func (m *Message) GetMessages(userId int64) error {
+// GetSessions returns a page of the metadata of the user's sessions and the cursor to the next page,
+// a nil filter means all of them
+func (m *Message) GetSessions(uuid string, filter *dal.MessageFilter, page *dal.Page) ([]*dal.Message, string, error) {
+	sessions, next, err := m.db.Message.SelectByUserId(uuid, filter, page)
+	if err != nil {
+		return nil, "", errors.Join(err, m.err)
+	}
+	return sessions, next, nil
+}
+
+func (m *Message) GetSession(uuid, sessionId string) (*dal.Message, error) {
+	return m.getOwnedSession(uuid, sessionId)
+}
+
+// Save creates or replaces the session and marks it as saved
+func (m *Message) Save(uuid, sessionId string, req *dto.SaveSessionReq) (*dal.Message, error) {
+	if sessionId == "" || req == nil || len(req.Messages) == 0 {
+		return nil, errors.Join(errors.New("save session invalid input"), m.err)
+	}
+	if _, err := m.modelService.GetAndCheckModelById(req.ModelId); err != nil {
+		return nil, errors.Join(err, m.err)
+	}
+	if err := m.openAiService.checkChatRequestBody(&dto.OpenAiReqFromClient{Messages: req.Messages}); err != nil {
+		return nil, errors.Join(err, m.err)
+	}
+	title := strings.TrimSpace(req.Title)
+	if utf8.RuneCountInString(title) > titleLimit {
+		return nil, errors.Join(errors.New("title too long"), m.err)
+	}
+	existing, err := m.getOwnedSession(uuid, sessionId)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	var stored []*dal.ChatMessage
+	if existing != nil {
+		stored = existing.Messages
+	}
+	messages, replaced, err := chatMessages(stored, req.Messages)
+	if err != nil {
+		return nil, errors.Join(err, m.err)
+	}
+	if err := m.archive(uuid, sessionId, replaced); err != nil {
+		return nil, err
+	}
+	session := &dal.Message{
+		SessionId: sessionId,
+		UserId:    uuid,
+		Timestamp: util.GetTimestamp(),
+		Title:     title,
+		Messages:  messages,
+		ModelId:   req.ModelId,
+		Saved:     true,
+	}
+	if existing == nil {
+		if err := m.db.Message.Insert(session); err != nil {
+			return nil, errors.Join(err, m.err)
+		}
+		return session, nil
+	}
+	if session.Title == "" {
+		session.Title = existing.Title
+	}
+	session.Shared = existing.Shared
+	session.FolderId = existing.FolderId
+	session.TagIds = existing.TagIds
+	session.Pinned = existing.Pinned
+	session.LibraryId = existing.LibraryId
+	session.ForkedFrom = existing.ForkedFrom
+	session.Settings = existing.Settings
+	if err := m.db.Message.ReplaceBySessionId(session); err != nil {
+		return nil, errors.Join(err, m.err)
+	}
+	return session, nil
+}
+
+func (m *Message) Pin(uuid, sessionId string, pinned bool) error {
+	if _, err := m.getOwnedSession(uuid, sessionId); err != nil {
+		return err
+	}
+	if err := m.db.Message.UpdatePinned(sessionId, uuid, pinned); err != nil {
+		return errors.Join(err, m.err)
+	}
+	return nil
+}
+
+// Delete moves the session into the trash
+func (m *Message) Delete(uuid, sessionId string) error {
+	if _, err := m.getOwnedSession(uuid, sessionId); err != nil {
+		return err
+	}
+	if err := m.db.Message.DeleteBySessionId(sessionId, uuid, util.GetTimestamp()); err != nil {
+		return errors.Join(err, m.err)
+	}
+	return nil
+}
+
+// SaveDraft automatically saves the finished chat turn as the user's last session,
+// the answer keeps the model and the token usage of the turn,
+// a saved session only gets the new turn appended, its history is never taken from the client
+func (m *Message) SaveDraft(uuid, sessionId string, modelId int, messages []dto.OpenAiMessage, answer string,
+	usage *dto.OpenAiUsage,
+) error {
+	if sessionId == "" || answer == "" {
+		return nil
+	}
+	existing, err := m.getOwnedSession(uuid, sessionId)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	var stored []*dal.ChatMessage
+	if existing != nil {
+		stored = existing.Messages
+	}
+	saved := existing != nil && existing.Saved
+	if saved {
+		if len(messages) == 0 || messages[len(messages)-1].Role != "user" {
+			return errors.Join(errors.New("the turn should end with a user message"), m.err)
+		}
+		messages = append(openAiMessages(stored), messages[len(messages)-1])
+	}
+	messages = append(messages[:len(messages):len(messages)], dto.OpenAiMessage{Role: "assistant", Content: answer})
+	converted, replaced, err := chatMessages(stored, messages)
+	if err != nil {
+		return errors.Join(err, m.err)
+	}
+	if err := m.archive(uuid, sessionId, replaced); err != nil {
+		return err
+	}
+	reply := converted[len(converted)-1]
+	reply.ModelId = modelId
+	if usage != nil {
+		reply.InTokenCount = usage.PromptTokens
+		reply.OutTokenCount = usage.CompletionTokens
+	}
+	if saved {
+		if err := m.db.Message.UpdateMessages(sessionId, uuid, converted, util.GetTimestamp(), modelId); err != nil {
+			return errors.Join(err, m.err)
+		}
+		return nil
+	}
+	// the replaced draft is moved into the trash and left to the scheduled purge
+	if err := m.db.Message.UpsertDraft(&dal.Message{
+		SessionId: sessionId,
+		UserId:    uuid,
+		Timestamp: util.GetTimestamp(),
+		Messages:  converted,
+		ModelId:   modelId,
+	}); err != nil {
+		return errors.Join(err, m.err)
+	}
+	return nil
+}
+
+// GetDraft returns the user's last unsaved session
+func (m *Message) GetDraft(uuid string) (*dal.Message, error) {
+	draft, err := m.db.Message.SelectLastByUserId(uuid)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, errors.Join(ErrNotFound, m.err)
+		}
+		return nil, errors.Join(err, m.err)
+	}
+	return draft, nil
+}
+
+// PromoteDraft turns the user's last unsaved session into a saved one
+func (m *Message) PromoteDraft(uuid, title string) (*dal.Message, error) {
+	title = strings.TrimSpace(title)
+	if utf8.RuneCountInString(title) > titleLimit {
+		return nil, errors.Join(errors.New("title too long"), m.err)
+	}
+	draft, err := m.GetDraft(uuid)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.db.Message.UpdateSaved(draft.SessionId, uuid, title); err != nil {
+		return nil, errors.Join(err, m.err)
+	}
+	draft.Saved = true
+	if title != "" {
+		draft.Title = title
+	}
+	return draft, nil
+}
+
+// GenerateTitle titles the owner's new session after its first exchange
+// with the cheapest model of the session model's provider, the user who chatted is billed at that model's rates
+func (m *Message) GenerateTitle(uuid, ownerId, sessionId string, modelId int, messages []dto.OpenAiMessage, answer string) error {
+	question := ""
+	for _, message := range messages {
+		if message.Role != "user" {
+			continue
+		}
+		if question != "" {
+			// not the first exchange
+			return nil
+		}
+		question = message.Content
+	}
+	if sessionId == "" || question == "" || answer == "" {
+		return nil
+	}
+	session, err := m.db.Message.SelectBySessionId(sessionId)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return errors.Join(err, m.err)
+	}
+	if err == nil && (session.UserId != ownerId || session.Title != "") {
+		return nil
+	}
+	sessionModel, err := m.modelService.GetAndCheckModelById(modelId)
+	if err != nil {
+		return err
+	}
+	model, err := m.modelService.GetCheapestByProvider(sessionModel.Provider)
+	if err != nil {
+		return errors.Join(err, m.err)
+	}
+	content, err := m.openAiService.Complete(uuid, model, &dto.OpenAiReqFromClient{
+		ModelId:   model.Id,
+		SessionId: sessionId,
+		Messages: []dto.OpenAiMessage{
+			{Role: "system", Content: titlePrompt},
+			{Role: "user", Content: "User: " + truncate(question, titleContextLimit) +
+				"\n\nAssistant: " + truncate(answer, titleContextLimit)},
+		},
+		Parameters: dal.Parameters{MaxTokens: 20},
+	})
+	if err != nil {
+		return errors.Join(err, m.err)
+	}
+	title := truncate(strings.Trim(strings.TrimSpace(content), `"'.`), titleLimit)
+	if title == "" {
+		return errors.Join(errors.New("generated title is empty"), m.err)
+	}
+	if err := m.db.Message.UpsertTitle(&dal.Message{
+		SessionId: sessionId,
+		UserId:    ownerId,
+		Timestamp: util.GetTimestamp(),
+		Title:     title,
+		ModelId:   modelId,
+	}); err != nil {
+		return errors.Join(err, m.err)
+	}
+	return nil
+}
+
+// StoredTurn builds the messages of a turn in the owner's session from the stored history,
+// only the new message, the last one sent by the client, is taken from the client
+func (m *Message) StoredTurn(ownerId, sessionId string, messages []dto.OpenAiMessage) ([]dto.OpenAiMessage, error) {
+	if len(messages) == 0 || messages[len(messages)-1].Role != "user" {
+		return nil, errors.Join(errors.New("the turn should end with a user message"), m.err)
+	}
+	session, err := m.getOwnedSession(ownerId, sessionId)
+	if err != nil {
+		return nil, err
+	}
+	return append(openAiMessages(session.Messages), messages[len(messages)-1]), nil
+}
+
+func (m *Message) Rename(uuid, sessionId, title string) error {
+	title = strings.TrimSpace(title)
+	if title == "" || utf8.RuneCountInString(title) > titleLimit {
+		return errors.Join(errors.New("title should not be empty or too long"), m.err)
+	}
+	if _, err := m.getOwnedSession(uuid, sessionId); err != nil {
+		return err
+	}
+	if err := m.db.Message.UpdateTitle(sessionId, uuid, title); err != nil {
+		return errors.Join(err, m.err)
+	}
 	return nil
 }
+
+// getOwnedSession returns ErrNotFound if the session doesn't exist
+// and ErrForbidden if it's not owned by the user
+func (m *Message) getOwnedSession(uuid, sessionId string) (*dal.Message, error) {
+	if uuid == "" || sessionId == "" {
+		return nil, errors.Join(ErrNotFound, m.err)
+	}
+	session, err := m.db.Message.SelectBySessionId(sessionId)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, errors.Join(ErrNotFound, m.err)
+		}
+		return nil, errors.Join(err, m.err)
+	}
+	if session.UserId != uuid {
+		return nil, errors.Join(ErrForbidden, m.err)
+	}
+	return session, nil
+}
+
+// chatMessages converts the messages from the client, a message with the same role at the same position
+// is the same message, so it keeps the stored ID, and the metadata too if it's unchanged,
+// the stored messages that are edited, regenerated or removed are returned to be archived
+func chatMessages(stored []*dal.ChatMessage, messages []dto.OpenAiMessage) ([]*dal.ChatMessage, []*dal.ChatMessage, error) {
+	now := util.GetTimestamp()
+	result := make([]*dal.ChatMessage, 0, len(messages))
+	replaced := make([]*dal.ChatMessage, 0)
+	for i, message := range messages {
+		if i < len(stored) && stored[i].Role == message.Role {
+			if stored[i].Text() == message.Content && slices.Equal(stored[i].AttachmentIds(), message.AttachmentIds) {
+				result = append(result, stored[i])
+				continue
+			}
+			replaced = append(replaced, stored[i])
+			result = append(result, chatMessage(stored[i].Id, message, now))
+			continue
+		}
+		if i < len(stored) {
+			replaced = append(replaced, stored[i])
+		}
+		id, err := util.RandomString(12)
+		if err != nil {
+			return nil, nil, err
+		}
+		result = append(result, chatMessage(id, message, now))
+	}
+	if len(stored) > len(messages) {
+		replaced = append(replaced, stored[len(messages):]...)
+	}
+	return result, replaced, nil
+}
+
+// chatMessage builds a message with the text and the attachments referenced
+func chatMessage(id string, message dto.OpenAiMessage, timestamp int64) *dal.ChatMessage {
+	result := dal.TextMessage(id, message.Role, message.Content, timestamp)
+	for _, attachmentId := range message.AttachmentIds {
+		result.Content = append(result.Content, &dal.ContentPart{Type: dal.ContentTypeAttachment, AttachmentId: attachmentId})
+	}
+	return result
+}
+
+// openAiMessages converts the stored messages into the OpenAI format
+func openAiMessages(messages []*dal.ChatMessage) []dto.OpenAiMessage {
+	result := make([]dto.OpenAiMessage, len(messages))
+	for i, message := range messages {
+		result[i] = dto.OpenAiMessage{Role: message.Role, Content: message.Text()}
+		if ids := message.AttachmentIds(); len(ids) > 0 {
+			result[i].AttachmentIds = ids
+		}
+	}
+	return result
+}
+
+// truncate cuts the string to at most limit runes
+func truncate(str string, limit int) string {
+	if utf8.RuneCountInString(str) <= limit {
+		return str
+	}
+	return string([]rune(str)[:limit])
+}
@@ -2,6 +2,7 @@ package service
 
 import (
 	"errors"
+	"strings"
 
 	"github.com/zenpk/chatbone/dal"
 	"github.com/zenpk/chatbone/util"
@@ -33,8 +34,75 @@ func (m *Model) GetAndCheckModelById(id int) (*dal.Model, error) {
 	if err != nil {
 		return nil, errors.Join(err, m.err)
 	}
-	if model == nil {
+	if model == nil || model.Embedding {
 		return nil, errors.Join(errors.New("model not found"), m.err)
 	}
 	return model, nil
 }
+
+func (m *Model) CheckParameters(parameters *dal.Parameters) error {
+	if parameters == nil {
+		return nil
+	}
+	if parameters.Temperature != nil && (*parameters.Temperature < 0 || *parameters.Temperature > 2) {
+		return errors.Join(errors.New("temperature should be between 0 and 2"), m.err)
+	}
+	if parameters.TopP != nil && (*parameters.TopP < 0 || *parameters.TopP > 1) {
+		return errors.Join(errors.New("top p should be between 0 and 1"), m.err)
+	}
+	if parameters.MaxTokens < 0 {
+		return errors.Join(errors.New("max tokens should not be negative"), m.err)
+	}
+	return nil
+}
+
+// GetCheapest returns the model with the lowest combined input and output rate
+func (m *Model) GetCheapest() (*dal.Model, error) {
+	return m.GetCheapestByProvider("")
+}
+
+// GetCheapestByProvider returns the cheapest model of the provider, of any provider if it's empty
+func (m *Model) GetCheapestByProvider(provider string) (*dal.Model, error) {
+	models, err := m.model.SelectAll()
+	if err != nil {
+		return nil, errors.Join(err, m.err)
+	}
+	var cheapest *dal.Model
+	for _, model := range models {
+		if provider != "" && model.Provider != provider {
+			continue
+		}
+		if cheapest == nil || model.InRate+model.OutRate < cheapest.InRate+cheapest.OutRate {
+			cheapest = model
+		}
+	}
+	if cheapest == nil {
+		return nil, errors.Join(errors.New("no model is configured"), m.err)
+	}
+	return cheapest, nil
+}
+
+// MatchByName maps an external model name to the configured model,
+// the exact name is preferred, then the longest matching family (e.g. gpt-4o to gpt-4)
+func (m *Model) MatchByName(name string) (*dal.Model, error) {
+	models, err := m.model.SelectAll()
+	if err != nil {
+		return nil, errors.Join(err, m.err)
+	}
+	var matched *dal.Model
+	matchedLen := 0
+	for _, model := range models {
+		if model.Name == name {
+			return model, nil
+		}
+		family := model.Name
+		if parts := strings.SplitN(model.Name, "-", 3); len(parts) == 3 {
+			family = parts[0] + "-" + parts[1]
+		}
+		if strings.HasPrefix(name, family) && len(family) > matchedLen {
+			matched = model
+			matchedLen = len(family)
+		}
+	}
+	return matched, nil
+}
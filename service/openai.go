@@ -2,8 +2,10 @@ package service
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"time"
 
@@ -12,6 +14,16 @@ import (
 	"github.com/zenpk/chatbone/dal"
 	"github.com/zenpk/chatbone/dto"
 	"github.com/zenpk/chatbone/util"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	imageTokens         = 85 // the cost of a low detail image
+	embeddingBatchSize  = 100
+	holdExpiry          = time.Hour // far longer than any request could take
+	holdReleaseInterval = 10 * time.Minute
+	holdReleaseBatch    = 100
 )
 
 type OpenAi struct {
@@ -21,45 +33,74 @@ type OpenAi struct {
 
 	model   *dal.Model
 	history *dal.History
-	user    dal.IUser
+	hold    *dal.Hold
+	user    cal.IUser
+
+	attachmentService *Attachment
 }
 
-func NewOpenAi(conf *util.Configuration, logger util.ILogger, db *dal.Database, cache *cal.Cache) (*OpenAi, error) {
+func NewOpenAi(conf *util.Configuration, logger util.ILogger, db *dal.Database, cache *cal.Cache,
+	attachmentService *Attachment,
+) (*OpenAi, error) {
 	o := new(OpenAi)
 	o.conf = conf
 	o.logger = logger
 	o.model = db.Model
 	o.history = db.History
+	o.hold = db.Hold
 	o.user = cache.User
+	o.attachmentService = attachmentService
 	o.err = errors.New("at OpenAi service")
 	return o, nil
 }
 
-func (o *OpenAi) Chat(uuid string, model *dal.Model, reqBody *dto.OpenAiReqFromClient, respChan chan<- any) error {
+// Chat streams the replies into the channel and returns the token usage it's billed for,
+// the request is cancelled once the context is done, e.g. the client is gone
+func (o *OpenAi) Chat(ctx context.Context, uuid string, model *dal.Model, reqBody *dto.OpenAiReqFromClient,
+	respChan chan<- any,
+) (*dto.OpenAiUsage, error) {
 	if uuid == "" || reqBody == nil || respChan == nil {
-		return errors.Join(errors.New("chat invalid input"), o.err)
+		return nil, errors.Join(errors.New("chat invalid input"), o.err)
+	}
+	if err := o.checkChatRequestBody(reqBody); err != nil {
+		return nil, errors.Join(err, o.err)
 	}
-	user, err := o.user.SelectByIdInsertIfNotExists(uuid)
+	messages, err := o.attachmentService.Expand(uuid, reqBody.SessionId, model, reqBody.Messages)
 	if err != nil {
-		return errors.Join(err, o.err)
+		return nil, errors.Join(err, o.err)
 	}
-	if user.Balance <= 0 {
-		return errors.Join(errors.New("user doesn't have enough balance"), o.err)
+	messages = withContext(messages, reqBody.Context)
+	inToken, err := o.countTokensFromMessages(messages, model)
+	if err != nil {
+		return nil, errors.Join(err, o.err)
 	}
-	if err := o.checkChatRequestBody(reqBody); err != nil {
-		return errors.Join(err, o.err)
+	hold, err := o.reserve(uuid, model, inToken, reqBody.Parameters.MaxTokens)
+	if err != nil {
+		return nil, errors.Join(err, o.err)
 	}
+	// a failed request isn't billed, the hold is given back in full
+	settled := false
+	defer func() {
+		if !settled {
+			if err := o.release(hold, 0, ""); err != nil {
+				o.logger.Warnf("release hold failed: %v", err)
+			}
+		}
+	}()
 	reqByte, err := json.Marshal(dto.OpenAiReqToOpenAi{
-		Model:    model.Name,
-		Messages: reqBody.Messages,
-		Stream:   true, // always stream
+		Model:       model.Name,
+		Messages:    messages,
+		Stream:      true, // always stream
+		Temperature: reqBody.Parameters.Temperature,
+		TopP:        reqBody.Parameters.TopP,
+		MaxTokens:   reqBody.Parameters.MaxTokens,
 	})
 	if err != nil {
-		return errors.Join(err, o.err)
+		return nil, errors.Join(err, o.err)
 	}
-	req, err := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(reqByte))
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(reqByte))
 	if err != nil {
-		return errors.Join(err, o.err)
+		return nil, errors.Join(err, o.err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+o.conf.OpenAiApiKey)
@@ -68,41 +109,358 @@ func (o *OpenAi) Chat(uuid string, model *dal.Model, reqBody *dto.OpenAiReqFromC
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		return errors.Join(err, o.err)
+		return nil, errors.Join(err, o.err)
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Join(fmt.Errorf("OpenAI request failed, error code: %v", resp.StatusCode), o.err)
+	}
 	openAiChatter := newOpenAiChatter(8192, "data: ", dto.OpenAiMessageEnding)
-	responseAny, nil := chat(openAiChatter, resp, respChan)
-	responseMessages := make([]dto.OpenAiMessage, len(responseAny))
+	responseAny, streamErr := chat(ctx, openAiChatter, resp, respChan)
+	if streamErr != nil && len(responseAny) == 0 {
+		return nil, errors.Join(streamErr, o.err)
+	}
+	responseMessages := make([]dto.OpenAiMessageToOpenAi, len(responseAny))
 	for i, message := range responseAny {
 		// the response is guaranteed to have valid choices and delta
-		responseMessages[i] = *(message.(dto.OpenAiResp).Choices[0].Delta)
-	}
-	// update the history
-	inToken, err := o.countTokensFromMessages(reqBody.Messages, model)
-	if err != nil {
-		return errors.Join(err, o.err)
+		delta := message.(dto.OpenAiResp).Choices[0].Delta
+		responseMessages[i] = dto.OpenAiMessageToOpenAi{Role: delta.Role, Content: delta.Content}
 	}
+	// update the history, the output already delivered is billed even if the stream failed partway
 	outToken, err := o.countTokensFromMessages(responseMessages, model)
 	if err != nil {
-		return errors.Join(err, o.err)
+		return nil, errors.Join(err, o.err)
 	}
-	o.user.ReduceBalance(user.Id, int64(inToken)*int64(model.InRate*dal.BalanceMultipleFactor)+
-		int64(outToken)*int64(model.OutRate*dal.BalanceMultipleFactor))
-	if err := o.history.Insert(&dal.History{
+	settled = true
+	if err := o.settle(hold, &dal.History{
 		SessionId:     reqBody.SessionId,
-		Timestamp:     util.GetTimestamp(),
-		UserId:        user.Id,
-		ModelId:       reqBody.ModelId,
+		UserId:        uuid,
 		InTokenCount:  inToken,
 		OutTokenCount: outToken,
+	}, model); err != nil {
+		return nil, errors.Join(err, o.err)
+	}
+	if streamErr != nil {
+		return nil, errors.Join(streamErr, o.err)
+	}
+	return &dto.OpenAiUsage{PromptTokens: inToken, CompletionTokens: outToken, TotalTokens: inToken + outToken}, nil
+}
+
+// Complete sends a non-streaming request and returns the reply content, the user is billed by the reported usage
+func (o *OpenAi) Complete(uuid string, model *dal.Model, reqBody *dto.OpenAiReqFromClient) (string, error) {
+	if uuid == "" || reqBody == nil {
+		return "", errors.Join(errors.New("complete invalid input"), o.err)
+	}
+	if err := o.checkChatRequestBody(reqBody); err != nil {
+		return "", errors.Join(err, o.err)
+	}
+	messages, err := o.attachmentService.Expand(uuid, reqBody.SessionId, model, reqBody.Messages)
+	if err != nil {
+		return "", errors.Join(err, o.err)
+	}
+	messages = withContext(messages, reqBody.Context)
+	inToken, err := o.countTokensFromMessages(messages, model)
+	if err != nil {
+		return "", errors.Join(err, o.err)
+	}
+	hold, err := o.reserve(uuid, model, inToken, reqBody.Parameters.MaxTokens)
+	if err != nil {
+		return "", errors.Join(err, o.err)
+	}
+	settled := false
+	defer func() {
+		if !settled {
+			if err := o.release(hold, 0, ""); err != nil {
+				o.logger.Warnf("release hold failed: %v", err)
+			}
+		}
+	}()
+	reqByte, err := json.Marshal(dto.OpenAiReqToOpenAi{
+		Model:       model.Name,
+		Messages:    messages,
+		Stream:      false,
+		Temperature: reqBody.Parameters.Temperature,
+		TopP:        reqBody.Parameters.TopP,
+		MaxTokens:   reqBody.Parameters.MaxTokens,
+	})
+	if err != nil {
+		return "", errors.Join(err, o.err)
+	}
+	req, err := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(reqByte))
+	if err != nil {
+		return "", errors.Join(err, o.err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+o.conf.OpenAiApiKey)
+	client := http.Client{
+		Timeout: time.Duration(o.conf.TimeoutSecond) * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", errors.Join(err, o.err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Join(fmt.Errorf("OpenAI request failed, error code: %v", resp.StatusCode), o.err)
+	}
+	respBody := new(dto.OpenAiCompletionResp)
+	if err := json.NewDecoder(resp.Body).Decode(respBody); err != nil {
+		return "", errors.Join(err, o.err)
+	}
+	if len(respBody.Choices) == 0 || respBody.Choices[0] == nil || respBody.Choices[0].Message == nil ||
+		respBody.Usage == nil {
+		return "", errors.Join(errors.New("OpenAI response is malformed"), o.err)
+	}
+	settled = true
+	if err := o.settle(hold, &dal.History{
+		SessionId:     reqBody.SessionId,
+		UserId:        uuid,
+		InTokenCount:  respBody.Usage.PromptTokens,
+		OutTokenCount: respBody.Usage.CompletionTokens,
+	}, model); err != nil {
+		return "", errors.Join(err, o.err)
+	}
+	return respBody.Choices[0].Message.Content, nil
+}
+
+// Embed returns the embeddings of the inputs in order, the tokens are billed to the session or the library,
+// every batch is held before the request like a chat, so the user must be able to cover it
+func (o *OpenAi) Embed(uuid, sessionId, libraryId string, model *dal.Model, inputs []string) ([][]float64, error) {
+	if uuid == "" || model == nil || !model.Embedding {
+		return nil, errors.Join(errors.New("embed invalid input"), o.err)
+	}
+	tke, err := tiktoken.GetEncoding(model.Encoding)
+	if err != nil {
+		return nil, errors.Join(err, o.err)
+	}
+	result := make([][]float64, 0, len(inputs))
+	for start := 0; start < len(inputs); start += embeddingBatchSize {
+		batch := inputs[start:min(start+embeddingBatchSize, len(inputs))]
+		inToken := 0
+		for _, input := range batch {
+			inToken += len(tke.Encode(input, nil, nil))
+		}
+		hold, err := o.reserve(uuid, model, inToken, 0)
+		if err != nil {
+			return nil, errors.Join(err, o.err)
+		}
+		respBody, err := o.embed(model, batch)
+		if err != nil {
+			// a failed request isn't billed, the hold is given back in full
+			if err := o.release(hold, 0, ""); err != nil {
+				o.logger.Warnf("release hold failed: %v", err)
+			}
+			return nil, errors.Join(err, o.err)
+		}
+		if err := o.settle(hold, &dal.History{
+			SessionId:    sessionId,
+			LibraryId:    libraryId,
+			UserId:       uuid,
+			InTokenCount: respBody.Usage.PromptTokens,
+		}, model); err != nil {
+			return nil, errors.Join(err, o.err)
+		}
+		embeddings := make([][]float64, len(batch))
+		for _, data := range respBody.Data {
+			if data == nil || data.Index < 0 || data.Index >= len(batch) {
+				return nil, errors.Join(errors.New("OpenAI response is malformed"), o.err)
+			}
+			embeddings[data.Index] = data.Embedding
+		}
+		for _, embedding := range embeddings {
+			if len(embedding) == 0 {
+				return nil, errors.Join(errors.New("OpenAI response is malformed"), o.err)
+			}
+		}
+		result = append(result, embeddings...)
+	}
+	return result, nil
+}
+
+func (o *OpenAi) embed(model *dal.Model, inputs []string) (*dto.OpenAiEmbeddingResp, error) {
+	reqByte, err := json.Marshal(dto.OpenAiEmbeddingReq{
+		Model: model.Name,
+		Input: inputs,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", "https://api.openai.com/v1/embeddings", bytes.NewBuffer(reqByte))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+o.conf.OpenAiApiKey)
+	client := http.Client{
+		Timeout: time.Duration(o.conf.TimeoutSecond) * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OpenAI request failed, error code: %v", resp.StatusCode)
+	}
+	respBody := new(dto.OpenAiEmbeddingResp)
+	if err := json.NewDecoder(resp.Body).Decode(respBody); err != nil {
+		return nil, err
+	}
+	if len(respBody.Data) != len(inputs) || respBody.Usage == nil {
+		return nil, errors.New("OpenAI response is malformed")
+	}
+	return respBody, nil
+}
+
+// withContext puts the retrieved context as a system message right before the last message
+func withContext(messages []dto.OpenAiMessageToOpenAi, context string) []dto.OpenAiMessageToOpenAi {
+	if context == "" || len(messages) == 0 {
+		return messages
+	}
+	result := make([]dto.OpenAiMessageToOpenAi, 0, len(messages)+1)
+	result = append(result, messages[:len(messages)-1]...)
+	result = append(result, dto.OpenAiMessageToOpenAi{Role: "system", Content: context})
+	return append(result, messages[len(messages)-1])
+}
+
+// reserve holds the maximum cost of the request before the provider is called:
+// the input at full price plus the most output tokens the request could get,
+// a request the balance can't cover is rejected with dal.ErrInsufficientBalance
+func (o *OpenAi) reserve(uuid string, model *dal.Model, inToken, maxTokens int) (*dal.Hold, error) {
+	outToken := model.MaxOutTokens
+	if maxTokens > 0 && (outToken == 0 || maxTokens < outToken) {
+		outToken = maxTokens
+	}
+	id, err := util.RandomString(12)
+	if err != nil {
+		return nil, err
+	}
+	hold := &dal.Hold{
+		Id:        id,
+		UserId:    uuid,
+		Amount:    max(cost(model, inToken, outToken), 1),
+		Timestamp: util.GetTimestamp(),
+	}
+	// the balance is taken first, a hold without it would be given back by the release job
+	if err := o.user.ReduceBalance(&dal.Ledger{
+		UserId:    uuid,
+		Kind:      dal.LedgerKindHold,
+		Amount:    -hold.Amount,
+		Reference: hold.Id,
 	}); err != nil {
-		return errors.Join(err, o.err)
+		return nil, err
 	}
-	return nil
+	if err := o.hold.Insert(hold); err != nil {
+		if err := o.user.AdjustBalance(&dal.Ledger{
+			UserId:    uuid,
+			Kind:      dal.LedgerKindRelease,
+			Amount:    hold.Amount,
+			Reference: hold.Id,
+		}); err != nil {
+			o.logger.Warnf("give back balance failed: %v", err)
+		}
+		return nil, err
+	}
+	return hold, nil
 }
 
-func (o *OpenAi) countTokensFromMessages(messages []dto.OpenAiMessage, model *dal.Model) (int, error) {
+// settle records the history and gives back the part of the hold that isn't spent,
+// the estimate could fall short of the actual tokens, then the difference is taken on top
+func (o *OpenAi) settle(hold *dal.Hold, history *dal.History, model *dal.Model) error {
+	// the ID is set beforehand so that the ledger could reference it
+	history.Id = primitive.NewObjectID()
+	spent := cost(model, history.InTokenCount, history.OutTokenCount)
+	if err := o.release(hold, spent, history.Id.Hex()); err != nil {
+		o.logger.Warnf("settle hold failed: %v", err)
+	}
+	history.Timestamp = util.GetTimestamp()
+	history.ModelId = model.Id
+	return o.history.Insert(history)
+}
+
+// release ends the hold, gives it back and charges the spent amount referencing the history in one update,
+// the hold is deleted first so that only one of the request and the release job gives the balance back,
+// what the hold doesn't cover is only charged if the balance could still afford it
+func (o *OpenAi) release(hold *dal.Hold, spent int64, historyId string) error {
+	spent = max(spent, 0)
+	extra := spent
+	if err := o.hold.DeleteById(hold.Id); err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			return err
+		}
+		// the release job has already given back all of it
+	} else {
+		covered := min(spent, hold.Amount)
+		extra = spent - covered
+		if err := o.user.SettleBalance(&dal.Ledger{
+			UserId:    hold.UserId,
+			Kind:      dal.LedgerKindRelease,
+			Amount:    hold.Amount,
+			Reference: hold.Id,
+		}, &dal.Ledger{
+			UserId:    hold.UserId,
+			Kind:      dal.LedgerKindCharge,
+			Amount:    -covered,
+			Reference: historyId,
+		}); err != nil {
+			return err
+		}
+	}
+	if extra <= 0 {
+		return nil
+	}
+	return o.user.ReduceBalance(&dal.Ledger{
+		UserId:    hold.UserId,
+		Kind:      dal.LedgerKindCharge,
+		Amount:    -extra,
+		Reference: historyId,
+	})
+}
+
+// ReleaseExpiredHolds gives back the holds left by the requests that never ended, e.g. when the instance crashed,
+// it blocks until the context is done
+func (o *OpenAi) ReleaseExpiredHolds(ctx context.Context) {
+	ticker := time.NewTicker(holdReleaseInterval)
+	defer ticker.Stop()
+	for {
+		o.releaseExpired()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (o *OpenAi) releaseExpired() {
+	before := util.GetTimestamp() - holdExpiry.Milliseconds()
+	for {
+		holds, err := o.hold.SelectBefore(before, holdReleaseBatch)
+		if err != nil {
+			o.logger.Warnln(errors.Join(err, o.err))
+			return
+		}
+		for _, hold := range holds {
+			if err := o.release(hold, 0, ""); err != nil {
+				o.logger.Warnln(errors.Join(err, o.err))
+				return
+			}
+		}
+		if len(holds) < holdReleaseBatch {
+			return
+		}
+	}
+}
+
+// cost converts the tokens into the balance, the rates are multiplied by the tokens first
+// so that the rates below one balance unit per token aren't rounded down to zero
+func cost(model *dal.Model, inToken, outToken int) int64 {
+	return int64(float64(inToken)*model.InRate*dal.BalanceMultipleFactor +
+		float64(outToken)*model.OutRate*dal.BalanceMultipleFactor)
+}
+
+// countTokensFromMessages counts the text with the model encoding, an image costs a flat amount at low detail
+func (o *OpenAi) countTokensFromMessages(messages []dto.OpenAiMessageToOpenAi, model *dal.Model) (int, error) {
 	tke, err := tiktoken.GetEncoding(model.Encoding)
 	if err != nil {
 		return 0, err
@@ -119,7 +477,18 @@ func (o *OpenAi) countTokensFromMessages(messages []dto.OpenAiMessage, model *da
 	numTokens := 0
 	for _, message := range messages {
 		numTokens += tokensPerMessage
-		numTokens += len(tke.Encode(message.Content, nil, nil))
+		switch content := message.Content.(type) {
+		case string:
+			numTokens += len(tke.Encode(content, nil, nil))
+		case []*dto.OpenAiContentPart:
+			for _, part := range content {
+				if part.ImageUrl != nil {
+					numTokens += imageTokens
+					continue
+				}
+				numTokens += len(tke.Encode(part.Text, nil, nil))
+			}
+		}
 		numTokens += len(tke.Encode(message.Role, nil, nil))
 	}
 	numTokens += 3 // every reply is primed with <|start|>assistant<|message|>
@@ -136,7 +505,7 @@ func (o *OpenAi) checkChatRequestBody(req *dto.OpenAiReqFromClient) error {
 		if message.Role != "user" && message.Role != "assistant" && message.Role != "system" {
 			return errors.New("unsupported message role")
 		}
-		if message.Content == "" {
+		if message.Content == "" && len(message.AttachmentIds) == 0 {
 			return errors.New("message content should not be empty")
 		}
 		messageLen += len(message.Content)
@@ -0,0 +1,246 @@
+package service
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// pdfStreamRegexp matches the dictionary right before a stream, the dictionary tells the filters
+var pdfStreamRegexp = regexp.MustCompile(`(?s)<<((?:[^<>]|<[^<]|>[^>])*)>>\s*stream\r?\n`)
+
+// extractPdfText pulls the text out of the content streams,
+// it covers the common text operators of uncompressed and Flate streams,
+// fonts with custom encodings, scanned and encrypted files aren't supported
+func extractPdfText(data []byte) (string, error) {
+	text := new(strings.Builder)
+	for _, match := range pdfStreamRegexp.FindAllSubmatchIndex(data, -1) {
+		dict := data[match[2]:match[3]]
+		start := match[1]
+		end := bytes.Index(data[start:], []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		stream := data[start : start+end]
+		switch {
+		case bytes.Contains(dict, []byte("/FlateDecode")):
+			reader, err := zlib.NewReader(bytes.NewReader(stream))
+			if err != nil {
+				continue
+			}
+			// a truncated stream still has its text up to the damage
+			decoded, _ := io.ReadAll(reader)
+			stream = decoded
+		case bytes.Contains(dict, []byte("/Filter")):
+			// images and the other filters don't carry text
+			continue
+		}
+		pdfContentText(stream, text)
+	}
+	result := strings.TrimSpace(text.String())
+	if result == "" {
+		return "", errors.New("no text found in the PDF")
+	}
+	return result, nil
+}
+
+// pdfContentText writes the strings shown by the text operators of the content stream
+func pdfContentText(content []byte, text *strings.Builder) {
+	operands := make([]any, 0) // string or float64
+	inText := false
+	for i := 0; i < len(content); {
+		c := content[i]
+		switch {
+		case isPdfWhitespace(c):
+			i++
+		case c == '%':
+			for i < len(content) && content[i] != '\n' && content[i] != '\r' {
+				i++
+			}
+		case c == '(':
+			str, next := readPdfLiteral(content, i)
+			operands = append(operands, str)
+			i = next
+		case c == '<' && i+1 < len(content) && content[i+1] == '<', c == '>' && i+1 < len(content) && content[i+1] == '>':
+			i += 2
+		case c == '<':
+			str, next := readPdfHex(content, i)
+			operands = append(operands, str)
+			i = next
+		case c == '[' || c == ']' || c == '{' || c == '}' || c == '>':
+			i++
+		default:
+			start := i
+			for i < len(content) && !isPdfWhitespace(content[i]) && !isPdfDelimiter(content[i]) {
+				i++
+			}
+			if i == start {
+				i++
+				continue
+			}
+			token := string(content[start:i])
+			if number, err := strconv.ParseFloat(token, 64); err == nil {
+				operands = append(operands, number)
+				continue
+			}
+			if token[0] == '/' {
+				continue
+			}
+			switch token {
+			case "BT":
+				inText = true
+			case "ET":
+				inText = false
+				text.WriteString("\n")
+			case "Tj", "TJ":
+				if inText {
+					writePdfOperands(operands, text)
+				}
+			case "'", "\"":
+				if inText {
+					text.WriteString("\n")
+					writePdfOperands(operands, text)
+				}
+			case "T*":
+				text.WriteString("\n")
+			case "Td", "TD":
+				// a vertical move starts a new line
+				if len(operands) >= 2 {
+					if y, ok := operands[len(operands)-1].(float64); ok && y != 0 {
+						text.WriteString("\n")
+					} else {
+						text.WriteString(" ")
+					}
+				}
+			}
+			operands = operands[:0]
+		}
+	}
+}
+
+// writePdfOperands joins the strings, a large negative kerning in TJ arrays is a word gap
+func writePdfOperands(operands []any, text *strings.Builder) {
+	for _, operand := range operands {
+		switch v := operand.(type) {
+		case string:
+			text.WriteString(v)
+		case float64:
+			if v <= -200 {
+				text.WriteString(" ")
+			}
+		}
+	}
+}
+
+func readPdfLiteral(content []byte, i int) (string, int) {
+	raw := make([]byte, 0)
+	depth := 0
+	for i++; i < len(content); i++ {
+		c := content[i]
+		switch c {
+		case '\\':
+			i++
+			if i >= len(content) {
+				break
+			}
+			switch e := content[i]; e {
+			case 'n':
+				raw = append(raw, '\n')
+			case 'r':
+				raw = append(raw, '\r')
+			case 't':
+				raw = append(raw, '\t')
+			case 'b':
+				raw = append(raw, '\b')
+			case 'f':
+				raw = append(raw, '\f')
+			case '\r', '\n':
+				// line continuation
+				if e == '\r' && i+1 < len(content) && content[i+1] == '\n' {
+					i++
+				}
+			default:
+				if e >= '0' && e <= '7' {
+					value := 0
+					for n := 0; n < 3 && i < len(content) && content[i] >= '0' && content[i] <= '7'; n++ {
+						value = value*8 + int(content[i]-'0')
+						i++
+					}
+					i--
+					raw = append(raw, byte(value))
+					continue
+				}
+				raw = append(raw, e)
+			}
+		case '(':
+			depth++
+			raw = append(raw, c)
+		case ')':
+			if depth == 0 {
+				return decodePdfString(raw), i + 1
+			}
+			depth--
+			raw = append(raw, c)
+		default:
+			raw = append(raw, c)
+		}
+	}
+	return decodePdfString(raw), i
+}
+
+func readPdfHex(content []byte, i int) (string, int) {
+	end := bytes.IndexByte(content[i:], '>')
+	if end < 0 {
+		return "", len(content)
+	}
+	digits := make([]byte, 0, end)
+	for _, c := range content[i+1 : i+end] {
+		if !isPdfWhitespace(c) {
+			digits = append(digits, c)
+		}
+	}
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	raw := make([]byte, 0, len(digits)/2)
+	for j := 0; j < len(digits); j += 2 {
+		value, err := strconv.ParseUint(string(digits[j:j+2]), 16, 8)
+		if err != nil {
+			return "", i + end + 1
+		}
+		raw = append(raw, byte(value))
+	}
+	return decodePdfString(raw), i + end + 1
+}
+
+// decodePdfString reads UTF-16 with the byte order mark, otherwise the bytes are taken as Latin-1
+func decodePdfString(raw []byte) string {
+	if len(raw) >= 2 && raw[0] == 0xfe && raw[1] == 0xff {
+		units := make([]uint16, 0, len(raw)/2)
+		for j := 2; j+1 < len(raw); j += 2 {
+			units = append(units, uint16(raw[j])<<8|uint16(raw[j+1]))
+		}
+		return string(utf16.Decode(units))
+	}
+	runes := make([]rune, 0, len(raw))
+	for _, b := range raw {
+		if b < 0x20 && b != '\n' && b != '\t' {
+			continue
+		}
+		runes = append(runes, rune(b))
+	}
+	return string(runes)
+}
+
+func isPdfWhitespace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f' || c == 0
+}
+
+func isPdfDelimiter(c byte) bool {
+	return c == '(' || c == ')' || c == '<' || c == '>' || c == '[' || c == ']' || c == '{' || c == '}' || c == '%'
+}
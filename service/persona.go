@@ -0,0 +1,152 @@
+package service
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/zenpk/chatbone/dal"
+	"github.com/zenpk/chatbone/dto"
+	"github.com/zenpk/chatbone/util"
+)
+
+const (
+	personaLimit     = 100
+	personaNameLimit = 64
+)
+
+type Persona struct {
+	conf   *util.Configuration
+	logger util.ILogger
+	err    error
+
+	persona      *dal.Persona
+	message      *dal.Message
+	modelService *Model
+}
+
+func NewPersona(conf *util.Configuration, logger util.ILogger, db *dal.Database, modelService *Model) (*Persona, error) {
+	p := new(Persona)
+	p.conf = conf
+	p.logger = logger
+	p.persona = db.Persona
+	p.message = db.Message
+	p.modelService = modelService
+	p.err = errors.New("at Persona service")
+	return p, nil
+}
+
+func (p *Persona) GetAll(uuid string) ([]*dal.Persona, error) {
+	personas, err := p.persona.SelectByUserId(uuid)
+	if err != nil {
+		return nil, errors.Join(err, p.err)
+	}
+	return personas, nil
+}
+
+// Get returns the persona only if it's owned by the user
+func (p *Persona) Get(uuid, id string) (*dal.Persona, error) {
+	persona, err := p.persona.SelectById(id)
+	if err != nil {
+		return nil, errors.Join(err, p.err)
+	}
+	if persona.UserId != uuid {
+		return nil, errors.Join(errors.New("persona doesn't belong to the user"), p.err)
+	}
+	return persona, nil
+}
+
+func (p *Persona) Create(uuid string, req *dto.PersonaReq) (*dal.Persona, error) {
+	if err := p.checkPersonaReq(req); err != nil {
+		return nil, errors.Join(err, p.err)
+	}
+	count, err := p.persona.CountByUserId(uuid)
+	if err != nil {
+		return nil, errors.Join(err, p.err)
+	}
+	if count >= personaLimit {
+		return nil, errors.Join(errors.New("too many personas"), p.err)
+	}
+	id, err := util.RandomString(12)
+	if err != nil {
+		return nil, errors.Join(err, p.err)
+	}
+	persona := &dal.Persona{
+		Id:           id,
+		UserId:       uuid,
+		Timestamp:    util.GetTimestamp(),
+		Name:         strings.TrimSpace(req.Name),
+		SystemPrompt: req.SystemPrompt,
+		ModelId:      req.ModelId,
+		Parameters:   req.Parameters,
+	}
+	if err := p.persona.Insert(persona); err != nil {
+		return nil, errors.Join(err, p.err)
+	}
+	return persona, nil
+}
+
+func (p *Persona) Update(uuid, id string, req *dto.PersonaReq) (*dal.Persona, error) {
+	if err := p.checkPersonaReq(req); err != nil {
+		return nil, errors.Join(err, p.err)
+	}
+	persona := &dal.Persona{
+		Id:           id,
+		UserId:       uuid,
+		Timestamp:    util.GetTimestamp(),
+		Name:         strings.TrimSpace(req.Name),
+		SystemPrompt: req.SystemPrompt,
+		ModelId:      req.ModelId,
+		Parameters:   req.Parameters,
+	}
+	if err := p.persona.ReplaceById(persona); err != nil {
+		return nil, errors.Join(err, p.err)
+	}
+	return persona, nil
+}
+
+func (p *Persona) Delete(uuid, id string) error {
+	if err := p.persona.DeleteById(id, uuid); err != nil {
+		return errors.Join(err, p.err)
+	}
+	if err := p.message.RemovePersona(uuid, id); err != nil {
+		return errors.Join(err, p.err)
+	}
+	return nil
+}
+
+// ApplyToOpenAi injects the persona as the leading system message
+// and fills the parameters the request didn't set
+func (p *Persona) ApplyToOpenAi(persona *dal.Persona, req *dto.OpenAiReqFromClient) {
+	if persona == nil || req == nil {
+		return
+	}
+	system := dto.OpenAiMessage{Role: "system", Content: persona.SystemPrompt}
+	if len(req.Messages) > 0 && req.Messages[0].Role == "system" {
+		req.Messages[0] = system
+	} else {
+		req.Messages = append([]dto.OpenAiMessage{system}, req.Messages...)
+	}
+	req.Parameters = req.Parameters.Merge(persona.Parameters)
+}
+
+func (p *Persona) checkPersonaReq(req *dto.PersonaReq) error {
+	if req == nil {
+		return errors.New("request body should not be nil")
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > personaNameLimit {
+		return errors.New("persona name should not be empty or too long")
+	}
+	if req.SystemPrompt == "" {
+		return errors.New("system prompt should not be empty")
+	}
+	if len(req.SystemPrompt) > p.conf.MessageLengthLimit {
+		return errors.New("system prompt too long")
+	}
+	if req.ModelId != 0 {
+		if _, err := p.modelService.GetAndCheckModelById(req.ModelId); err != nil {
+			return err
+		}
+	}
+	return p.modelService.CheckParameters(&req.Parameters)
+}
@@ -0,0 +1,104 @@
+package service
+
+import (
+	"embed"
+	"html/template"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/zenpk/chatbone/dto"
+)
+
+//go:embed html/*.html
+var htmlFs embed.FS
+
+const renderTimeFormat = "2006-01-02 15:04 UTC"
+
+var (
+	htmlTemplates    = template.Must(template.ParseFS(htmlFs, "html/*.html"))
+	codeLanguageName = regexp.MustCompile(`^[\w+#.-]+$`)
+)
+
+type renderedSession struct {
+	Title    string
+	Time     string
+	Messages []*renderedMessage
+}
+
+type renderedMessage struct {
+	Role   string
+	Blocks []*renderedBlock
+}
+
+// renderedBlock is either a paragraph or a fenced code block
+type renderedBlock struct {
+	Code     bool
+	Language string
+	Text     string
+}
+
+// renderSessionHtml writes the session as a standalone HTML page,
+// fenced code blocks get the language-* classes used by the common highlighters
+func renderSessionHtml(w io.Writer, title string, timestamp int64, messages []dto.OpenAiMessage) error {
+	session := &renderedSession{
+		Title:    title,
+		Messages: make([]*renderedMessage, 0, len(messages)),
+	}
+	if session.Title == "" {
+		session.Title = "Untitled conversation"
+	}
+	if timestamp > 0 {
+		session.Time = time.UnixMilli(timestamp).UTC().Format(renderTimeFormat)
+	}
+	for _, message := range messages {
+		session.Messages = append(session.Messages, &renderedMessage{
+			Role:   message.Role,
+			Blocks: splitCodeBlocks(message.Content),
+		})
+	}
+	return htmlTemplates.ExecuteTemplate(w, "session.html", session)
+}
+
+func renderPasswordHtml(w io.Writer, wrong bool) error {
+	return htmlTemplates.ExecuteTemplate(w, "password.html", struct{ Wrong bool }{wrong})
+}
+
+// splitCodeBlocks splits the markdown content by the ``` fences
+func splitCodeBlocks(content string) []*renderedBlock {
+	blocks := make([]*renderedBlock, 0)
+	var current *renderedBlock
+	lines := make([]string, 0)
+	flush := func() {
+		text := strings.Join(lines, "\n")
+		if current.Code || strings.TrimSpace(text) != "" {
+			if !current.Code {
+				text = strings.Trim(text, "\n")
+			}
+			current.Text = text
+			blocks = append(blocks, current)
+		}
+		lines = lines[:0]
+	}
+	current = new(renderedBlock)
+	for _, line := range strings.Split(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, "```") {
+			lines = append(lines, line)
+			continue
+		}
+		flush()
+		if current.Code {
+			current = new(renderedBlock)
+			continue
+		}
+		current = &renderedBlock{Code: true}
+		if language := strings.TrimPrefix(trimmed, "```"); codeLanguageName.MatchString(language) {
+			current.Language = strings.ToLower(language)
+		}
+	}
+	// an unclosed fence is kept as code
+	flush()
+	return blocks
+}
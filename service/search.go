@@ -0,0 +1,143 @@
+package service
+
+import (
+	"errors"
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/zenpk/chatbone/dal"
+	"github.com/zenpk/chatbone/dto"
+)
+
+const (
+	searchQueryLimit   = 256
+	searchResultLimit  = 50
+	searchMatchLimit   = 3  // per session
+	searchSnippetRunes = 80 // around the first matched term
+)
+
+var searchTerm = regexp.MustCompile(`"([^"]+)"|(\S+)`)
+
+// Search runs the full-text search over the user's sessions,
+// every result comes with the matched message indexes and their highlighted snippets
+func (m *Message) Search(uuid, query string, filter *dal.MessageFilter) ([]*dto.SearchResult, error) {
+	query = strings.TrimSpace(query)
+	if query == "" || len(query) > searchQueryLimit {
+		return nil, errors.Join(errors.New("search query should not be empty or too long"), m.err)
+	}
+	sessions, err := m.db.Message.SearchByUserId(uuid, query, filter, searchResultLimit)
+	if err != nil {
+		return nil, errors.Join(err, m.err)
+	}
+	terms := searchTerms(query)
+	results := make([]*dto.SearchResult, 0, len(sessions))
+	for _, session := range sessions {
+		result := &dto.SearchResult{
+			SessionId: session.SessionId,
+			Title:     session.Title,
+			ModelId:   session.ModelId,
+			Timestamp: session.Timestamp,
+			Saved:     session.Saved,
+			Shared:    session.Shared,
+			Score:     session.Score,
+			Matches:   make([]*dto.SearchMatch, 0),
+		}
+		for i, message := range session.Messages {
+			if len(result.Matches) >= searchMatchLimit {
+				break
+			}
+			if snippet, ok := highlightSnippet(message.Text(), terms); ok {
+				result.Matches = append(result.Matches, &dto.SearchMatch{Index: i, MessageId: message.Id, Snippet: snippet})
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// searchTerms returns the lower-cased words and phrases of the query, negated ones are skipped
+func searchTerms(query string) [][]rune {
+	terms := make([][]rune, 0)
+	for _, match := range searchTerm.FindAllStringSubmatch(query, -1) {
+		term := match[1]
+		if term == "" {
+			if strings.HasPrefix(match[2], "-") {
+				continue
+			}
+			term = match[2]
+		}
+		terms = append(terms, lowerRunes(term))
+	}
+	return terms
+}
+
+// highlightSnippet cuts the text around the first matched term
+// and wraps every matched term in <mark>, the rest is HTML escaped
+func highlightSnippet(text string, terms [][]rune) (string, bool) {
+	runes := []rune(text)
+	lower := lowerRunes(text)
+	first := -1
+	for _, term := range terms {
+		if pos := indexRunes(lower, term); pos != -1 && (first == -1 || pos < first) {
+			first = pos
+		}
+	}
+	if first == -1 {
+		return "", false
+	}
+	start := max(first-searchSnippetRunes/2, 0)
+	end := min(start+searchSnippetRunes, len(runes))
+	builder := new(strings.Builder)
+	if start > 0 {
+		builder.WriteString("…")
+	}
+	for pos := start; pos < end; {
+		matched := 0
+		for _, term := range terms {
+			if len(term) > matched && pos+len(term) <= end && indexRunes(lower[pos:pos+len(term)], term) == 0 {
+				matched = len(term)
+			}
+		}
+		if matched == 0 {
+			builder.WriteString(html.EscapeString(string(runes[pos])))
+			pos++
+			continue
+		}
+		builder.WriteString("<mark>" + html.EscapeString(string(runes[pos:pos+matched])) + "</mark>")
+		pos += matched
+	}
+	if end < len(runes) {
+		builder.WriteString("…")
+	}
+	return builder.String(), true
+}
+
+// lowerRunes lowers every rune individually so the indexes stay the same as the original text
+func lowerRunes(str string) []rune {
+	runes := []rune(str)
+	for i, r := range runes {
+		runes[i] = unicode.ToLower(r)
+	}
+	return runes
+}
+
+func indexRunes(runes, sub []rune) int {
+	if len(sub) == 0 {
+		return -1
+	}
+	for i := 0; i+len(sub) <= len(runes); i++ {
+		found := true
+		for j := range sub {
+			if runes[i+j] != sub[j] {
+				found = false
+				break
+			}
+		}
+		if found {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,74 @@
+package service
+
+import (
+	"errors"
+
+	"github.com/zenpk/chatbone/dal"
+	"github.com/zenpk/chatbone/dto"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const retrievalTopKLimit = 20
+
+// GetSettings returns the settings of the session, a new session has the empty ones
+func (m *Message) GetSettings(uuid, sessionId string) (*dal.SessionSettings, error) {
+	session, err := m.getOwnedSession(uuid, sessionId)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return new(dal.SessionSettings), nil
+		}
+		return nil, err
+	}
+	if session.Settings == nil {
+		return new(dal.SessionSettings), nil
+	}
+	return session.Settings, nil
+}
+
+// UpdateSettings validates and replaces the settings of the user's session,
+// the omitted fields are cleared so the chat uses the defaults
+func (m *Message) UpdateSettings(uuid, sessionId string, req *dto.SessionSettingsReq) (*dal.SessionSettings, error) {
+	if _, err := m.getOwnedSession(uuid, sessionId); err != nil {
+		return nil, err
+	}
+	settings := req.SessionSettings
+	if settings.ModelId != 0 {
+		if _, err := m.modelService.GetAndCheckModelById(settings.ModelId); err != nil {
+			return nil, err
+		}
+	}
+	if err := m.modelService.CheckParameters(&settings.Parameters); err != nil {
+		return nil, err
+	}
+	if settings.RetrievalTopK < 0 || settings.RetrievalTopK > retrievalTopKLimit {
+		return nil, errors.Join(errors.New("retrieval top k should be between 0 and 20"), m.err)
+	}
+	if settings.PersonaId != "" {
+		persona, err := m.db.Persona.SelectById(settings.PersonaId)
+		if err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				return nil, errors.Join(ErrNotFound, m.err)
+			}
+			return nil, errors.Join(err, m.err)
+		}
+		if persona.UserId != uuid {
+			return nil, errors.Join(ErrForbidden, m.err)
+		}
+	}
+	if req.LibraryId != "" {
+		library, err := m.db.Library.SelectById(req.LibraryId)
+		if err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				return nil, errors.Join(ErrNotFound, m.err)
+			}
+			return nil, errors.Join(err, m.err)
+		}
+		if library.UserId != uuid {
+			return nil, errors.Join(ErrForbidden, m.err)
+		}
+	}
+	if err := m.db.Message.UpdateSettings(sessionId, uuid, req.LibraryId, &settings); err != nil {
+		return nil, errors.Join(err, m.err)
+	}
+	return &settings, nil
+}
@@ -0,0 +1,209 @@
+package service
+
+import (
+	"errors"
+	"io"
+
+	"github.com/zenpk/chatbone/dal"
+	"github.com/zenpk/chatbone/dto"
+	"github.com/zenpk/chatbone/util"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	shareTokenBytes    = 24
+	sharePasswordLimit = 72 // bcrypt limit
+)
+
+type Share struct {
+	conf   *util.Configuration
+	logger util.ILogger
+	err    error
+
+	db             *dal.Database
+	messageService *Message
+}
+
+func NewShare(conf *util.Configuration, logger util.ILogger, db *dal.Database, messageService *Message) (*Share, error) {
+	s := new(Share)
+	s.conf = conf
+	s.logger = logger
+	s.db = db
+	s.messageService = messageService
+	s.err = errors.New("at Share service")
+	return s, nil
+}
+
+// Create makes an unguessable share token of the user's session
+// a snapshot share copies the current messages, otherwise the live session is shown
+func (s *Share) Create(uuid, sessionId string, req *dto.ShareReq) (*dal.Share, error) {
+	if req == nil {
+		return nil, errors.Join(errors.New("share invalid input"), s.err)
+	}
+	session, err := s.messageService.getOwnedSession(uuid, sessionId)
+	if err != nil {
+		return nil, err
+	}
+	if len(session.Messages) == 0 {
+		return nil, errors.Join(errors.New("session doesn't have any messages"), s.err)
+	}
+	now := util.GetTimestamp()
+	if req.ExpireAt != 0 {
+		req.ExpireAt = util.CheckTimestamp(req.ExpireAt)
+		if req.ExpireAt <= now {
+			return nil, errors.Join(errors.New("expire time should be in the future"), s.err)
+		}
+	}
+	token, err := util.RandomString(shareTokenBytes)
+	if err != nil {
+		return nil, errors.Join(err, s.err)
+	}
+	share := &dal.Share{
+		Token:     token,
+		SessionId: sessionId,
+		UserId:    uuid,
+		Timestamp: now,
+		ExpireAt:  req.ExpireAt,
+		Snapshot:  req.Snapshot,
+	}
+	if req.Password != "" {
+		if len(req.Password) > sharePasswordLimit {
+			return nil, errors.Join(errors.New("password too long"), s.err)
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, errors.Join(err, s.err)
+		}
+		share.PasswordHash = string(hash)
+	}
+	if req.Snapshot {
+		share.Title = session.Title
+		share.ModelId = session.ModelId
+		share.Messages = session.Messages
+	}
+	if err := s.db.Share.Insert(share); err != nil {
+		return nil, errors.Join(err, s.err)
+	}
+	if err := s.db.Message.UpdateShared(sessionId, uuid, true); err != nil {
+		return nil, errors.Join(err, s.err)
+	}
+	return share, nil
+}
+
+func (s *Share) GetAll(uuid, sessionId string) ([]*dal.Share, error) {
+	if _, err := s.messageService.getOwnedSession(uuid, sessionId); err != nil {
+		return nil, err
+	}
+	shares, err := s.db.Share.SelectBySessionId(sessionId)
+	if err != nil {
+		return nil, errors.Join(err, s.err)
+	}
+	return shares, nil
+}
+
+// Revoke deletes the share, the session is no longer marked as shared after its last share is revoked
+func (s *Share) Revoke(uuid, token string) error {
+	share, err := s.db.Share.SelectByToken(token)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return errors.Join(ErrNotFound, s.err)
+		}
+		return errors.Join(err, s.err)
+	}
+	if share.UserId != uuid {
+		return errors.Join(ErrForbidden, s.err)
+	}
+	if err := s.db.Share.DeleteByToken(token, uuid); err != nil {
+		return errors.Join(err, s.err)
+	}
+	count, err := s.db.Share.CountBySessionId(share.SessionId)
+	if err != nil {
+		return errors.Join(err, s.err)
+	}
+	if count == 0 {
+		if err := s.db.Message.UpdateShared(share.SessionId, uuid, false); err != nil {
+			return errors.Join(err, s.err)
+		}
+	}
+	return nil
+}
+
+// GetShared returns the shared session without authentication,
+// ErrUnauthorized means the password is missing or wrong
+func (s *Share) GetShared(token, password string) (*dto.SharedSessionResp, error) {
+	share, session, err := s.getSharedSession(token, password)
+	if err != nil {
+		return nil, err
+	}
+	return &dto.SharedSessionResp{
+		Title:     session.Title,
+		ModelId:   session.ModelId,
+		Timestamp: session.Timestamp,
+		Snapshot:  share.Snapshot,
+		Messages:  openAiMessages(session.Messages),
+	}, nil
+}
+
+// Fork copies the shared session into a new session of the user, the share token is recorded as the provenance
+func (s *Share) Fork(uuid, token, password string, req *dto.ForkSessionReq) (*dal.Message, error) {
+	share, session, err := s.getSharedSession(token, password)
+	if err != nil {
+		return nil, err
+	}
+	return s.messageService.fork(uuid, session, req, &dal.ForkedFrom{
+		SessionId:  share.SessionId,
+		UserId:     share.UserId,
+		ShareToken: share.Token,
+	})
+}
+
+// getSharedSession checks the share and returns the session it shows,
+// the session of a snapshot share is built from the snapshot
+func (s *Share) getSharedSession(token, password string) (*dal.Share, *dal.Message, error) {
+	share, err := s.db.Share.SelectByToken(token)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil, errors.Join(ErrNotFound, s.err)
+		}
+		return nil, nil, errors.Join(err, s.err)
+	}
+	if share.ExpireAt != 0 && share.ExpireAt <= util.GetTimestamp() {
+		return nil, nil, errors.Join(ErrNotFound, s.err)
+	}
+	if share.PasswordHash != "" &&
+		bcrypt.CompareHashAndPassword([]byte(share.PasswordHash), []byte(password)) != nil {
+		return nil, nil, errors.Join(ErrUnauthorized, s.err)
+	}
+	if !share.Snapshot {
+		session, err := s.messageService.getOwnedSession(share.UserId, share.SessionId)
+		if err != nil {
+			return nil, nil, err
+		}
+		return share, session, nil
+	}
+	return share, &dal.Message{
+		SessionId: share.SessionId,
+		UserId:    share.UserId,
+		Timestamp: share.Timestamp,
+		Title:     share.Title,
+		Messages:  share.Messages,
+		ModelId:   share.ModelId,
+	}, nil
+}
+
+// WriteSharedHtml renders the shared session as a standalone page,
+// a password form is rendered instead if the password is missing or wrong
+func (s *Share) WriteSharedHtml(w io.Writer, token, password string) error {
+	shared, err := s.GetShared(token, password)
+	if err != nil {
+		if errors.Is(err, ErrUnauthorized) {
+			return renderPasswordHtml(w, password != "")
+		}
+		return err
+	}
+	if err := renderSessionHtml(w, shared.Title, shared.Timestamp, shared.Messages); err != nil {
+		return errors.Join(err, s.err)
+	}
+	return nil
+}
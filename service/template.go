@@ -0,0 +1,229 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/zenpk/chatbone/dal"
+	"github.com/zenpk/chatbone/dto"
+	"github.com/zenpk/chatbone/util"
+)
+
+const (
+	templateLimit         = 100
+	templateNameLimit     = 64
+	templateVariableLimit = 32
+)
+
+var (
+	templatePlaceholder  = regexp.MustCompile(`\{\{\s*(\w+)\s*\}\}`)
+	templateVariableName = regexp.MustCompile(`^\w+$`)
+)
+
+type Template struct {
+	conf   *util.Configuration
+	logger util.ILogger
+	err    error
+
+	template *dal.Template
+}
+
+func NewTemplate(conf *util.Configuration, logger util.ILogger, db *dal.Database) (*Template, error) {
+	t := new(Template)
+	t.conf = conf
+	t.logger = logger
+	t.template = db.Template
+	t.err = errors.New("at Template service")
+	return t, nil
+}
+
+// GetAll returns the user's own templates and the ones shared with the organization
+func (t *Template) GetAll(uuid string) ([]*dal.Template, error) {
+	templates, err := t.template.SelectVisibleByUserId(uuid)
+	if err != nil {
+		return nil, errors.Join(err, t.err)
+	}
+	return templates, nil
+}
+
+func (t *Template) Create(uuid string, req *dto.TemplateReq) (*dal.Template, error) {
+	if err := t.checkTemplateReq(req); err != nil {
+		return nil, errors.Join(err, t.err)
+	}
+	count, err := t.template.CountByUserId(uuid)
+	if err != nil {
+		return nil, errors.Join(err, t.err)
+	}
+	if count >= templateLimit {
+		return nil, errors.Join(errors.New("too many templates"), t.err)
+	}
+	id, err := util.RandomString(12)
+	if err != nil {
+		return nil, errors.Join(err, t.err)
+	}
+	template := &dal.Template{
+		Id:        id,
+		UserId:    uuid,
+		Timestamp: util.GetTimestamp(),
+		Name:      strings.TrimSpace(req.Name),
+		Content:   req.Content,
+		Variables: req.Variables,
+		Shared:    req.Shared,
+	}
+	if err := t.template.Insert(template); err != nil {
+		return nil, errors.Join(err, t.err)
+	}
+	return template, nil
+}
+
+func (t *Template) Update(uuid, id string, req *dto.TemplateReq) (*dal.Template, error) {
+	if err := t.checkTemplateReq(req); err != nil {
+		return nil, errors.Join(err, t.err)
+	}
+	template := &dal.Template{
+		Id:        id,
+		UserId:    uuid,
+		Timestamp: util.GetTimestamp(),
+		Name:      strings.TrimSpace(req.Name),
+		Content:   req.Content,
+		Variables: req.Variables,
+		Shared:    req.Shared,
+	}
+	if err := t.template.ReplaceById(template); err != nil {
+		return nil, errors.Join(err, t.err)
+	}
+	return template, nil
+}
+
+func (t *Template) Delete(uuid, id string) error {
+	if err := t.template.DeleteById(id, uuid); err != nil {
+		return errors.Join(err, t.err)
+	}
+	return nil
+}
+
+// Render fills the template visible to the user with the given values,
+// missing values fall back to the defaults and every value is checked against its type
+func (t *Template) Render(uuid, id string, values map[string]any) (string, error) {
+	template, err := t.template.SelectById(id)
+	if err != nil {
+		return "", errors.Join(err, t.err)
+	}
+	if template.UserId != uuid && !template.Shared {
+		return "", errors.Join(errors.New("template is not visible to the user"), t.err)
+	}
+	rendered := make(map[string]string, len(template.Variables))
+	for _, variable := range template.Variables {
+		value, ok := values[variable.Name]
+		if !ok || value == nil {
+			if variable.Default == "" && variable.Required {
+				return "", errors.Join(fmt.Errorf("variable %v is required", variable.Name), t.err)
+			}
+			rendered[variable.Name] = variable.Default
+			continue
+		}
+		str, err := t.formatValue(variable, value)
+		if err != nil {
+			return "", errors.Join(err, t.err)
+		}
+		rendered[variable.Name] = str
+	}
+	for name := range values {
+		if _, ok := rendered[name]; !ok {
+			return "", errors.Join(fmt.Errorf("unknown variable %v", name), t.err)
+		}
+	}
+	content := templatePlaceholder.ReplaceAllStringFunc(template.Content, func(placeholder string) string {
+		return rendered[templatePlaceholder.FindStringSubmatch(placeholder)[1]]
+	})
+	if strings.TrimSpace(content) == "" {
+		return "", errors.Join(errors.New("rendered template is empty"), t.err)
+	}
+	return content, nil
+}
+
+func (t *Template) formatValue(variable *dal.TemplateVariable, value any) (string, error) {
+	switch variable.Type {
+	case dal.TemplateVariableString:
+		if str, ok := value.(string); ok {
+			return str, nil
+		}
+	case dal.TemplateVariableNumber:
+		switch v := value.(type) {
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), nil
+		case string:
+			if _, err := strconv.ParseFloat(v, 64); err == nil {
+				return v, nil
+			}
+		}
+	case dal.TemplateVariableBoolean:
+		switch v := value.(type) {
+		case bool:
+			return strconv.FormatBool(v), nil
+		case string:
+			if _, err := strconv.ParseBool(v); err == nil {
+				return v, nil
+			}
+		}
+	case dal.TemplateVariableEnum:
+		if str, ok := value.(string); ok && slices.Contains(variable.Options, str) {
+			return str, nil
+		}
+	}
+	return "", fmt.Errorf("variable %v should be a valid %v", variable.Name, variable.Type)
+}
+
+func (t *Template) checkTemplateReq(req *dto.TemplateReq) error {
+	if req == nil {
+		return errors.New("request body should not be nil")
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > templateNameLimit {
+		return errors.New("template name should not be empty or too long")
+	}
+	if strings.TrimSpace(req.Content) == "" {
+		return errors.New("template content should not be empty")
+	}
+	if len(req.Content) > t.conf.MessageLengthLimit {
+		return errors.New("template content too long")
+	}
+	if len(req.Variables) > templateVariableLimit {
+		return errors.New("too many template variables")
+	}
+	defined := make(map[string]bool, len(req.Variables))
+	for _, variable := range req.Variables {
+		if variable == nil || !templateVariableName.MatchString(variable.Name) {
+			return errors.New("invalid template variable name")
+		}
+		if defined[variable.Name] {
+			return fmt.Errorf("duplicated variable %v", variable.Name)
+		}
+		defined[variable.Name] = true
+		if variable.Type != dal.TemplateVariableString && variable.Type != dal.TemplateVariableNumber &&
+			variable.Type != dal.TemplateVariableBoolean && variable.Type != dal.TemplateVariableEnum {
+			return fmt.Errorf("unsupported variable type %v", variable.Type)
+		}
+		if variable.Type == dal.TemplateVariableEnum && len(variable.Options) == 0 {
+			return fmt.Errorf("enum variable %v should have options", variable.Name)
+		}
+		if variable.Type != dal.TemplateVariableEnum {
+			variable.Options = nil
+		}
+		if variable.Default != "" {
+			if _, err := t.formatValue(variable, variable.Default); err != nil {
+				return fmt.Errorf("invalid default value: %w", err)
+			}
+		}
+	}
+	for _, match := range templatePlaceholder.FindAllStringSubmatch(req.Content, -1) {
+		if !defined[match[1]] {
+			return fmt.Errorf("placeholder %v is not defined", match[1])
+		}
+	}
+	return nil
+}
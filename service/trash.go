@@ -0,0 +1,163 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/zenpk/chatbone/dal"
+	"github.com/zenpk/chatbone/util"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	trashPurgeInterval = time.Hour
+	trashPurgeBatch    = 100
+)
+
+// GetTrash returns a page of the metadata of the user's deleted sessions
+func (m *Message) GetTrash(uuid string, page *dal.Page) ([]*dal.Message, string, error) {
+	sessions, next, err := m.db.Message.SelectDeletedByUserId(uuid, page)
+	if err != nil {
+		return nil, "", errors.Join(err, m.err)
+	}
+	return sessions, next, nil
+}
+
+// Restore moves the session out of the trash,
+// it fails if a new session has been saved with the same ID in the meantime
+func (m *Message) Restore(uuid, sessionId string) error {
+	if _, err := m.getDeletedSession(uuid, sessionId); err != nil {
+		return err
+	}
+	if _, err := m.getOwnedSession(uuid, sessionId); err == nil {
+		return errors.Join(errors.New("a session with the same ID already exists"), m.err)
+	} else if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if err := m.db.Message.RestoreBySessionId(sessionId, uuid); err != nil {
+		return errors.Join(err, m.err)
+	}
+	return nil
+}
+
+// DeletePermanently hard deletes the session in the trash
+func (m *Message) DeletePermanently(uuid, sessionId string) error {
+	if _, err := m.getDeletedSession(uuid, sessionId); err != nil {
+		return err
+	}
+	return m.purge(uuid, sessionId)
+}
+
+// EmptyTrash hard deletes all the user's deleted sessions and returns how many were deleted
+func (m *Message) EmptyTrash(uuid string) (int, error) {
+	count := 0
+	page := &dal.Page{Size: dal.PageSizeMax}
+	for {
+		sessions, next, err := m.db.Message.SelectDeletedByUserId(uuid, page)
+		if err != nil {
+			return count, errors.Join(err, m.err)
+		}
+		for _, session := range sessions {
+			if err := m.purge(uuid, session.SessionId); err != nil {
+				if errors.Is(err, mongo.ErrNoDocuments) {
+					continue // restored or purged concurrently
+				}
+				return count, err
+			}
+			count++
+		}
+		if next == "" {
+			return count, nil
+		}
+		page.Cursor = next
+	}
+}
+
+// PurgeTrash hard deletes the sessions kept in the trash longer than the retention period,
+// it blocks until the context is done
+func (m *Message) PurgeTrash(ctx context.Context) {
+	if m.conf.TrashRetentionDay <= 0 {
+		return
+	}
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+	for {
+		m.purgeExpired()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *Message) purgeExpired() {
+	retention := time.Duration(m.conf.TrashRetentionDay) * 24 * time.Hour
+	before := util.GetTimestamp() - retention.Milliseconds()
+	count := 0
+	for {
+		sessions, err := m.db.Message.SelectDeletedBefore(before, trashPurgeBatch)
+		if err != nil {
+			m.logger.Warnln(errors.Join(err, m.err))
+			return
+		}
+		for _, session := range sessions {
+			if err := m.purge(session.UserId, session.SessionId); err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+				m.logger.Warnln(err)
+				return
+			}
+			count++
+		}
+		if len(sessions) < trashPurgeBatch {
+			break
+		}
+	}
+	if count > 0 {
+		m.logger.Printf("purged %v sessions from the trash\n", count)
+	}
+}
+
+// purge hard deletes the trashed session with everything that belongs to it
+func (m *Message) purge(uuid, sessionId string) error {
+	if err := m.db.Message.PurgeBySessionId(sessionId, uuid); err != nil {
+		return errors.Join(err, m.err)
+	}
+	// the session might have been saved again under the same ID
+	if _, err := m.getOwnedSession(uuid, sessionId); err == nil {
+		return nil
+	}
+	if err := m.db.Share.DeleteBySessionId(sessionId); err != nil {
+		return errors.Join(err, m.err)
+	}
+	if err := m.db.Version.DeleteBySessionId(sessionId); err != nil {
+		return errors.Join(err, m.err)
+	}
+	if err := m.db.Feedback.DeleteBySessionId(sessionId); err != nil {
+		return errors.Join(err, m.err)
+	}
+	if err := m.db.Attachment.ReleaseBySessionId(sessionId); err != nil {
+		return errors.Join(err, m.err)
+	}
+	if err := m.db.Member.DeleteBySessionId(sessionId); err != nil {
+		return errors.Join(err, m.err)
+	}
+	return nil
+}
+
+func (m *Message) getDeletedSession(uuid, sessionId string) (*dal.Message, error) {
+	if uuid == "" || sessionId == "" {
+		return nil, errors.Join(ErrNotFound, m.err)
+	}
+	session, err := m.db.Message.SelectDeletedBySessionId(sessionId)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, errors.Join(ErrNotFound, m.err)
+		}
+		return nil, errors.Join(err, m.err)
+	}
+	if session.UserId != uuid {
+		return nil, errors.Join(ErrForbidden, m.err)
+	}
+	return session, nil
+}
@@ -2,6 +2,7 @@ package service
 
 import (
 	"errors"
+	"sync"
 
 	"github.com/zenpk/chatbone/cal"
 	"github.com/zenpk/chatbone/dal"
@@ -15,20 +16,45 @@ type User struct {
 
 	model   *dal.Model
 	history *dal.History
-	user    dal.IUser
+	ledger  *dal.Ledger
+	lease   *dal.Lease
+	users   *dal.User // read without the cache
+	user    cal.IUser
+
+	broadcastService *Broadcast
+
+	clipboardMutex       sync.Mutex
+	clipboardSubscribers map[string]map[*clipboardSubscriber]struct{} // uuid -> subscribers
 }
 
-func NewUser(conf *util.Configuration, logger util.ILogger, db *dal.Database, cache *cal.Cache) (*User, error) {
+func NewUser(conf *util.Configuration, logger util.ILogger, db *dal.Database, cache *cal.Cache,
+	broadcastService *Broadcast,
+) (*User, error) {
 	u := new(User)
 	u.conf = conf
 	u.logger = logger
 	u.model = db.Model
 	u.history = db.History
+	u.ledger = db.Ledger
+	u.lease = db.Lease
+	u.users = db.User
 	u.user = cache.User
+	u.broadcastService = broadcastService
+	u.clipboardSubscribers = make(map[string]map[*clipboardSubscriber]struct{})
 	u.err = errors.New("at User service")
+	broadcastService.Handle(dal.BroadcastTopicClipboard, u.deliverClipboard)
 	return u, nil
 }
 
 func (u *User) GetInfo(uuid string) (*dal.User, error) {
 	return u.user.SelectByIdInsertIfNotExists(uuid)
 }
+
+// GetUsage returns a page of the user's chat history, the most recent first
+func (u *User) GetUsage(uuid string, page *dal.Page) ([]*dal.History, string, error) {
+	usage, next, err := u.history.SelectByUserId(uuid, page)
+	if err != nil {
+		return nil, "", errors.Join(err, u.err)
+	}
+	return usage, next, nil
+}
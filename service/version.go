@@ -0,0 +1,121 @@
+package service
+
+import (
+	"errors"
+
+	"github.com/zenpk/chatbone/dal"
+	"github.com/zenpk/chatbone/dto"
+	"github.com/zenpk/chatbone/util"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// GetVersions returns the previous versions of the message, the most recent first
+func (m *Message) GetVersions(uuid, sessionId, messageId string) ([]*dal.Version, error) {
+	if _, err := m.getOwnedSession(uuid, sessionId); err != nil {
+		return nil, err
+	}
+	versions, err := m.db.Version.SelectByMessageId(sessionId, uuid, messageId)
+	if err != nil {
+		return nil, errors.Join(err, m.err)
+	}
+	return versions, nil
+}
+
+// EditMessage replaces the content of the message, the previous content is kept as a version,
+// the following messages are left as they are
+func (m *Message) EditMessage(uuid, sessionId, messageId, content string) (*dal.ChatMessage, error) {
+	if content == "" || len(content) > m.conf.MessageLengthLimit {
+		return nil, errors.Join(errors.New("message should not be empty or too long"), m.err)
+	}
+	session, err := m.getOwnedSession(uuid, sessionId)
+	if err != nil {
+		return nil, err
+	}
+	current := findChatMessage(session.Messages, messageId)
+	if current == nil {
+		return nil, errors.Join(ErrNotFound, m.err)
+	}
+	if current.Text() == content {
+		return current, nil
+	}
+	edited := chatMessage(current.Id, dto.OpenAiMessage{Role: current.Role, Content: content,
+		AttachmentIds: current.AttachmentIds()}, util.GetTimestamp())
+	if err := m.replaceMessage(uuid, sessionId, current, edited); err != nil {
+		return nil, err
+	}
+	return edited, nil
+}
+
+// RestoreVersion brings back the version as the current content of its message,
+// the replaced content is kept as a new version so the restore can be undone too
+func (m *Message) RestoreVersion(uuid, sessionId, messageId, versionId string) (*dal.ChatMessage, error) {
+	session, err := m.getOwnedSession(uuid, sessionId)
+	if err != nil {
+		return nil, err
+	}
+	version, err := m.db.Version.SelectById(versionId)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, errors.Join(ErrNotFound, m.err)
+		}
+		return nil, errors.Join(err, m.err)
+	}
+	if version.UserId != uuid || version.SessionId != sessionId || version.MessageId != messageId {
+		return nil, errors.Join(ErrNotFound, m.err)
+	}
+	current := findChatMessage(session.Messages, messageId)
+	if current == nil {
+		// removed from the conversation
+		return nil, errors.Join(ErrNotFound, m.err)
+	}
+	if err := m.replaceMessage(uuid, sessionId, current, version.Message); err != nil {
+		return nil, err
+	}
+	return version.Message, nil
+}
+
+func (m *Message) replaceMessage(uuid, sessionId string, current, next *dal.ChatMessage) error {
+	if err := m.archive(uuid, sessionId, []*dal.ChatMessage{current}); err != nil {
+		return err
+	}
+	if err := m.db.Message.UpdateMessage(sessionId, uuid, next); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return errors.Join(ErrNotFound, m.err)
+		}
+		return errors.Join(err, m.err)
+	}
+	return nil
+}
+
+// archive keeps the replaced messages as versions
+func (m *Message) archive(uuid, sessionId string, replaced []*dal.ChatMessage) error {
+	now := util.GetTimestamp()
+	versions := make([]*dal.Version, 0, len(replaced))
+	for _, message := range replaced {
+		id, err := util.RandomString(12)
+		if err != nil {
+			return errors.Join(err, m.err)
+		}
+		versions = append(versions, &dal.Version{
+			Id:        id,
+			SessionId: sessionId,
+			UserId:    uuid,
+			MessageId: message.Id,
+			Timestamp: now,
+			Message:   message,
+		})
+	}
+	if err := m.db.Version.InsertMany(versions); err != nil {
+		return errors.Join(err, m.err)
+	}
+	return nil
+}
+
+func findChatMessage(messages []*dal.ChatMessage, id string) *dal.ChatMessage {
+	for _, message := range messages {
+		if message.Id == id {
+			return message
+		}
+	}
+	return nil
+}
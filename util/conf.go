@@ -6,24 +6,34 @@ import (
 )
 
 type Configuration struct {
-	TimeoutSecond      int      `json:"timeoutSecond"`
-	HttpAddress        string   `json:"httpAddress"`
-	LogFilePath        string   `json:"logFilePath"`
-	Domain             string   `json:"domain"`
-	AllowOrigins       []string `json:"allowOrigins"`
-	AuthEnabled        bool     `json:"authEnabled"`
-	CookiePathPrefix   string   `json:"cookiePathPrefix"`
-	OAuthJwkPath       string   `json:"oAuthJwkPath"`
-	OAuthAuthPath      string   `json:"oAuthAuthPath"`
-	OAuthRefreshPath   string   `json:"oAuthRefreshPath"`
-	OAuthClientId      string   `json:"oAuthClientId"`
-	OAuthClientSecret  string   `json:"oAuthClientSecret"`
-	OAuthIssuer        string   `json:"oAuthIssuer"`
-	MongoDbUri         string   `json:"mongoDbUri"`
-	MongoDbName        string   `json:"mongoDbName"`
-	OpenAiOrgId        string   `json:"openAiOrgId"`
-	OpenAiApiKey       string   `json:"openAiApiKey"`
-	MessageLengthLimit int      `json:"messageLengthLimit"`
+	TimeoutSecond       int      `json:"timeoutSecond"`
+	HttpAddress         string   `json:"httpAddress"`
+	LogFilePath         string   `json:"logFilePath"`
+	Domain              string   `json:"domain"`
+	AllowOrigins        []string `json:"allowOrigins"`
+	AuthEnabled         bool     `json:"authEnabled"`
+	CookiePathPrefix    string   `json:"cookiePathPrefix"`
+	OAuthJwkPath        string   `json:"oAuthJwkPath"`
+	OAuthAuthPath       string   `json:"oAuthAuthPath"`
+	OAuthRefreshPath    string   `json:"oAuthRefreshPath"`
+	OAuthClientId       string   `json:"oAuthClientId"`
+	OAuthClientSecret   string   `json:"oAuthClientSecret"`
+	OAuthIssuer         string   `json:"oAuthIssuer"`
+	MongoDbUri          string   `json:"mongoDbUri"`
+	MongoDbName         string   `json:"mongoDbName"`
+	OpenAiOrgId         string   `json:"openAiOrgId"`
+	OpenAiApiKey        string   `json:"openAiApiKey"`
+	MessageLengthLimit  int      `json:"messageLengthLimit"`
+	ImportSizeLimit     string   `json:"importSizeLimit"`    // e.g. 50M
+	TrashRetentionDay   int      `json:"trashRetentionDay"`  // 0 keeps the trash until it's emptied by the user
+	ClipboardSizeLimit  int      `json:"clipboardSizeLimit"` // bytes
+	AdminUuids          []string `json:"adminUuids"`
+	AttachmentSizeLimit string   `json:"attachmentSizeLimit"` // per file, e.g. 10M
+	AttachmentQuota     int64    `json:"attachmentQuota"`     // bytes per user, 0 means unlimited
+	EmbeddingModelId    int      `json:"embeddingModelId"`    // 0 disables the document libraries
+	DocumentSizeLimit   string   `json:"documentSizeLimit"`   // per file, e.g. 20M
+	LibraryChunkLimit   int      `json:"libraryChunkLimit"`   // chunks per library
+	RetrievalTopK       int      `json:"retrievalTopK"`       // chunks retrieved per turn
 }
 
 func NewConf(mode string) (*Configuration, error) {